@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/uswitch/yggdrasil/pkg/envoy"
+	"sigs.k8s.io/yaml"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff [before after]",
+	Short: "diff prints how the envoy configuration changes between two inputs",
+	Long: `diff compares two envoy configurations, either two outputs of yggdrasil render given as arguments,
+or the configurations generated from the --from and --to manifests with the same config file and flags as the server`,
+	Args: cobra.RangeArgs(0, 2),
+	RunE: diff,
+}
+
+func init() {
+	diffCmd.Flags().StringArray("from", nil, "Manifest file or directory the configuration is currently generated from, can be repeated")
+	diffCmd.Flags().StringArray("to", nil, "Manifest file or directory the configuration will be generated from, can be repeated")
+	diffCmd.Flags().StringP("output", "o", "text", "Output format, text, json or yaml")
+	diffCmd.Flags().String("node-group", "", "Node group to compare the configuration of, the default nodes when empty")
+	diffCmd.Flags().String("source", "", "Name of the cluster the manifests are read from, applying its per cluster options")
+	rootCmd.AddCommand(diffCmd)
+}
+
+func diff(cmd *cobra.Command, args []string) error {
+	from, _ := cmd.Flags().GetStringArray("from")
+	to, _ := cmd.Flags().GetStringArray("to")
+	output, _ := cmd.Flags().GetString("output")
+	nodeGroup, _ := cmd.Flags().GetString("node-group")
+	source, _ := cmd.Flags().GetString("source")
+
+	if output != "text" && output != "json" && output != "yaml" {
+		return fmt.Errorf("invalid output format %s, text, json or yaml are supported", output)
+	}
+
+	var before, after envoy.RenderedSnapshot
+	var err error
+	switch {
+	case len(args) == 2 && len(from) == 0 && len(to) == 0:
+		if before, err = readRendered(args[0]); err != nil {
+			return err
+		}
+		if after, err = readRendered(args[1]); err != nil {
+			return err
+		}
+	case len(args) == 0 && len(from) > 0 && len(to) > 0:
+		if before, err = renderManifests(from, nodeGroup, source); err != nil {
+			return err
+		}
+		if after, err = renderManifests(to, nodeGroup, source); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("either two rendered configurations or the --from and --to manifests are required")
+	}
+
+	diffs, err := envoy.Diff(before, after)
+	if err != nil {
+		return err
+	}
+	if output != "text" {
+		return printRendered(diffs, output)
+	}
+	for _, resourceDiff := range diffs {
+		fmt.Fprintln(os.Stdout, resourceDiff)
+	}
+	return nil
+}
+
+// readRendered reads a configuration printed by yggdrasil render, in JSON or YAML
+func readRendered(path string) (envoy.RenderedSnapshot, error) {
+	rendered := envoy.RenderedSnapshot{}
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rendered, err
+	}
+	if bytes, err = yaml.YAMLToJSON(bytes); err != nil {
+		return rendered, fmt.Errorf("error reading %s: %s", path, err)
+	}
+	if err := json.Unmarshal(bytes, &rendered); err != nil {
+		return rendered, fmt.Errorf("error reading %s: %s", path, err)
+	}
+	return rendered, nil
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/uswitch/yggdrasil/pkg/envoy"
+	"github.com/uswitch/yggdrasil/pkg/k8s"
+	"sigs.k8s.io/yaml"
+)
+
+var renderCmd = &cobra.Command{
+	Use:   "render",
+	Short: "render prints the envoy configuration generated from ingress and secret manifests",
+	Long: `render generates the envoy configuration from ingress and secret manifests, such as the output of kubectl get -o yaml,
+with the same config file and flags as the server, and prints its listeners, clusters and routes`,
+	RunE: render,
+}
+
+func init() {
+	renderCmd.Flags().StringArrayP("filename", "f", nil, "Manifest file or directory to read the ingresses and secrets from, can be repeated")
+	renderCmd.Flags().StringP("output", "o", "json", "Output format, json or yaml")
+	renderCmd.Flags().String("node-group", "", "Node group to render the configuration of, the default nodes when empty")
+	renderCmd.Flags().String("source", "", "Name of the cluster the manifests are read from, applying its per cluster options")
+	rootCmd.AddCommand(renderCmd)
+}
+
+func render(cmd *cobra.Command, args []string) error {
+	paths, _ := cmd.Flags().GetStringArray("filename")
+	output, _ := cmd.Flags().GetString("output")
+	nodeGroup, _ := cmd.Flags().GetString("node-group")
+	source, _ := cmd.Flags().GetString("source")
+
+	if len(paths) == 0 {
+		return fmt.Errorf("at least one manifest file or directory is required")
+	}
+	if output != "json" && output != "yaml" {
+		return fmt.Errorf("invalid output format %s, json or yaml are supported", output)
+	}
+
+	rendered, err := renderManifests(paths, nodeGroup, source)
+	if err != nil {
+		return err
+	}
+	return printRendered(rendered, output)
+}
+
+// renderManifests generates the configuration of a node group from manifest files
+func renderManifests(paths []string, nodeGroup string, source string) (envoy.RenderedSnapshot, error) {
+	c, err := loadConfig()
+	if err != nil {
+		return envoy.RenderedSnapshot{}, err
+	}
+	configurators, err := createConfigurators(c)
+	if err != nil {
+		return envoy.RenderedSnapshot{}, err
+	}
+	configurator, err := configurators.configurator(nodeGroup)
+	if err != nil {
+		return envoy.RenderedSnapshot{}, err
+	}
+
+	var manifestsSource *k8s.Source
+	if source != "" {
+		manifestsSource = &k8s.Source{Name: source}
+		for _, cluster := range c.Clusters {
+			if clusterName(cluster) == source {
+				manifestsSource.Locality = k8s.Locality{Region: cluster.Region, Zone: cluster.Zone, Priority: cluster.Priority}
+			}
+		}
+	}
+	ingresses, secrets, err := k8s.ReadManifests(paths, manifestsSource)
+	if err != nil {
+		return envoy.RenderedSnapshot{}, err
+	}
+
+	snapshot, err := configurator.Generate(ingresses, secrets)
+	if err != nil {
+		return envoy.RenderedSnapshot{}, fmt.Errorf("error generating the configuration: %s", err)
+	}
+	return envoy.Render(&snapshot)
+}
+
+func printRendered(rendered interface{}, output string) error {
+	bytes, err := json.MarshalIndent(rendered, "", "  ")
+	if err != nil {
+		return err
+	}
+	if output == "yaml" {
+		if bytes, err = yaml.JSONToYAML(bytes); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(bytes))
+	return err
+}
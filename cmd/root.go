@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -18,20 +19,46 @@ import (
 	"github.com/spf13/viper"
 	"github.com/uswitch/yggdrasil/pkg/envoy"
 	"github.com/uswitch/yggdrasil/pkg/k8s"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 type clusterConfig struct {
-	APIServer string `json:"apiServer"`
-	Ca        string `json:"ca"`
-	Token     string `json:"token"`
-	TokenPath string `json:"tokenPath"`
+	Name             string   `json:"name"`
+	APIServer        string   `json:"apiServer"`
+	Ca               string   `json:"ca"`
+	Token            string   `json:"token"`
+	TokenPath        string   `json:"tokenPath"`
+	Region           string   `json:"region"`
+	Zone             string   `json:"zone"`
+	Priority         uint32   `json:"priority"`
+	Enabled          *bool    `json:"enabled"`
+	Namespaces       []string `json:"namespaces"`
+	WeightMultiplier uint32   `json:"weightMultiplier"`
+	UpstreamPort     uint32   `json:"upstreamPort"`
+	TrustCA          string   `json:"trustCA"`
+}
+
+// nodeGroupConfig is the configuration served to the envoy nodes of a group, the fields not set are inherited
+type nodeGroupConfig struct {
+	Name                     string                `json:"name"`
+	NodeCluster              string                `json:"nodeCluster"`
+	NodeMetadata             map[string]string     `json:"nodeMetadata"`
+	IngressClasses           []string              `json:"ingressClasses"`
+	GatewayClasses           []string              `json:"gatewayClasses"`
+	Certificates             []envoy.Certificate   `json:"certificates"`
+	EnvoyListenerIpv4Address string                `json:"envoyListenerIpv4Address"`
+	EnvoyPort                uint32                `json:"envoyPort"`
+	HttpExtAuthz             *envoy.HttpExtAuthz   `json:"httpExtAuthz"`
+	HttpGrpcLogger           *envoy.HttpGrpcLogger `json:"httpGrpcLogger"`
+	AccessLogger             *envoy.AccessLogger   `json:"accessLogger"`
 }
 
 type config struct {
 	IngressClass               string                    `json:"ingressClass"`
+	GatewayClasses             []string                  `json:"gatewayClasses"`
 	NodeName                   string                    `json:"nodeName"`
 	Clusters                   []clusterConfig           `json:"clusters"`
 	SyncSecrets                bool                      `json:"syncSecrets"`
@@ -47,10 +74,13 @@ type config struct {
 	HttpExtAuthz               envoy.HttpExtAuthz        `json:"httpExtAuthz"`
 	HttpGrpcLogger             envoy.HttpGrpcLogger      `json:"httpGrpcLogger"`
 	AccessLogger               envoy.AccessLogger        `json:"accessLogger"`
+	NodeGroups                 []nodeGroupConfig         `json:"nodeGroups"`
+	XDSClientNodes             map[string][]string       `json:"xdsClientNodes"`
 }
 
-// Hasher returns node ID as an ID
+// Hasher returns the name of the group of a node as an ID, or the node ID when it is not part of any
 type Hasher struct {
+	groups []envoy.NodeGroup
 }
 
 var (
@@ -82,6 +112,7 @@ func init() {
 	rootCmd.PersistentFlags().String("key", "", "keyfile")
 	rootCmd.PersistentFlags().String("ca", "", "trustedCA")
 	rootCmd.PersistentFlags().StringSlice("ingress-classes", nil, "Ingress classes to watch")
+	rootCmd.PersistentFlags().StringSlice("gateway-classes", nil, "Gateway API gateway classes to watch HTTPRoutes of")
 	rootCmd.PersistentFlags().StringSlice("internal-cidr-ranges", []string{"192.168.0.0/16", "10.0.0.0/8", "172.16.0.0/12"}, "CIDR ranges to treat as internal")
 	rootCmd.PersistentFlags().StringArrayVar(&kubeConfig, "kube-config", nil, "Path to kube config")
 	rootCmd.PersistentFlags().Bool("debug", false, "Log at debug level")
@@ -109,6 +140,28 @@ func init() {
 	rootCmd.PersistentFlags().Bool("http-ext-authz-allow-partial-message", true, "When this field is true, Envoy will buffer the message until max_request_bytes is reached")
 	rootCmd.PersistentFlags().Bool("http-ext-authz-pack-as-bytes", false, "When this field is true, Envoy will send the body as raw bytes.")
 	rootCmd.PersistentFlags().Bool("http-ext-authz-failure-mode-allow", true, "Changes filters behaviour on errors")
+	rootCmd.PersistentFlags().Bool("endpoint-discovery", false, "Resolve the upstream ingress hosts in yggdrasil and serve them to envoy over EDS")
+	rootCmd.PersistentFlags().Duration("endpoint-refresh-interval", 30*time.Second, "How often the upstream ingress hosts are resolved again when using endpoint discovery")
+	rootCmd.PersistentFlags().Duration("debounce-window", 100*time.Millisecond, "How long to wait for Kubernetes changes to settle before taking a snapshot")
+	rootCmd.PersistentFlags().Duration("debounce-max-delay", time.Second, "How long a snapshot may be delayed at most while Kubernetes changes keep coming")
+	rootCmd.PersistentFlags().Duration("snapshot-max-retry-delay", 5*time.Minute, "How long a failing snapshot may wait at most before being retried, the delay doubling after every failure until the Kubernetes resources change")
+	rootCmd.PersistentFlags().Duration("resync-interval", 5*time.Minute, "How often the snapshot is rebuilt from all the resources without any change, 0 disables it")
+	rootCmd.PersistentFlags().Duration("sync-timeout", 30*time.Second, "How long to wait for the clusters to sync at startup before serving without the ones not synced yet, 0 waits for all of them")
+	rootCmd.PersistentFlags().Duration("cluster-retry-interval", 10*time.Second, "How often unreachable clusters are retried and the reachable ones checked")
+	rootCmd.PersistentFlags().String("xds-cert", "", "Certificate of the xDS server, served over TLS when set")
+	rootCmd.PersistentFlags().String("xds-key", "", "Key of the xDS server certificate")
+	rootCmd.PersistentFlags().String("xds-ca", "", "CA verifying the xDS client certificates, required when set")
+	rootCmd.PersistentFlags().Duration("xds-cert-reload-interval", 10*time.Second, "How often the xDS server certificate, key and CA files are checked for changes")
+	rootCmd.PersistentFlags().Int("history-size", 10, "How many published snapshots are kept for each node ID to be compared with or rolled back to")
+	rootCmd.PersistentFlags().String("history-dir", "", "Directory the published snapshots are written to, without their secrets, so that the history survives restarts")
+	rootCmd.PersistentFlags().Duration("upstream-grace-period", 0, "How long the upstreams removed from the ingresses, or of the ingresses being deleted, are kept draining before being removed, 0 removes them right away")
+	rootCmd.PersistentFlags().Int("max-deletion-percentage", 0, "Refuse to publish the snapshots removing more than this percentage of the virtual hosts or clusters, or all the upstreams of a cluster, until overridden through the admin API, 0 disables it")
+	rootCmd.PersistentFlags().Bool("freeze", false, "Start with the publication of snapshots frozen, serving the last published ones from the history directory until unfrozen through the admin API")
+	rootCmd.PersistentFlags().String("admin-token-file", "", "File containing the bearer token of the admin API, the admin API is disabled when not set")
+	rootCmd.PersistentFlags().String("admin-address", "127.0.0.1:8082", "Listen address of the admin API, only reachable from the host by default")
+	rootCmd.PersistentFlags().String("admin-cert", "", "Certificate of the admin API, served over TLS when set")
+	rootCmd.PersistentFlags().String("admin-key", "", "Key of the admin API certificate")
+	rootCmd.PersistentFlags().Duration("cluster-staleness-limit", 0, "How long the last known ingresses of an unreachable cluster are served before being dropped, 0 serves them until it is reachable again")
 
 	viper.BindPFlag("debug", rootCmd.PersistentFlags().Lookup("debug"))
 	viper.BindPFlag("configDump", rootCmd.PersistentFlags().Lookup("config-dump"))
@@ -116,6 +169,7 @@ func init() {
 	viper.BindPFlag("healthAddress", rootCmd.PersistentFlags().Lookup("health-address"))
 	viper.BindPFlag("nodeName", rootCmd.PersistentFlags().Lookup("node-name"))
 	viper.BindPFlag("ingressClasses", rootCmd.PersistentFlags().Lookup("ingress-classes"))
+	viper.BindPFlag("gatewayClasses", rootCmd.PersistentFlags().Lookup("gateway-classes"))
 	viper.BindPFlag("internalCidrRanges", rootCmd.PersistentFlags().Lookup("internal-cidr-ranges"))
 	viper.BindPFlag("cert", rootCmd.PersistentFlags().Lookup("cert"))
 	viper.BindPFlag("key", rootCmd.PersistentFlags().Lookup("key"))
@@ -143,6 +197,28 @@ func init() {
 	viper.BindPFlag("httpExtAuthz.allowPartialMessage", rootCmd.PersistentFlags().Lookup("http-ext-authz-allow-partial-message"))
 	viper.BindPFlag("httpExtAuthz.packAsBytes", rootCmd.PersistentFlags().Lookup("http-ext-authz-pack-as-bytes"))
 	viper.BindPFlag("httpExtAuthz.FailureModeAllow", rootCmd.PersistentFlags().Lookup("http-ext-authz-failure-mode-allow"))
+	viper.BindPFlag("endpointDiscovery", rootCmd.PersistentFlags().Lookup("endpoint-discovery"))
+	viper.BindPFlag("endpointRefreshInterval", rootCmd.PersistentFlags().Lookup("endpoint-refresh-interval"))
+	viper.BindPFlag("debounceWindow", rootCmd.PersistentFlags().Lookup("debounce-window"))
+	viper.BindPFlag("debounceMaxDelay", rootCmd.PersistentFlags().Lookup("debounce-max-delay"))
+	viper.BindPFlag("snapshotMaxRetryDelay", rootCmd.PersistentFlags().Lookup("snapshot-max-retry-delay"))
+	viper.BindPFlag("resyncInterval", rootCmd.PersistentFlags().Lookup("resync-interval"))
+	viper.BindPFlag("syncTimeout", rootCmd.PersistentFlags().Lookup("sync-timeout"))
+	viper.BindPFlag("clusterRetryInterval", rootCmd.PersistentFlags().Lookup("cluster-retry-interval"))
+	viper.BindPFlag("clusterStalenessLimit", rootCmd.PersistentFlags().Lookup("cluster-staleness-limit"))
+	viper.BindPFlag("historySize", rootCmd.PersistentFlags().Lookup("history-size"))
+	viper.BindPFlag("historyDir", rootCmd.PersistentFlags().Lookup("history-dir"))
+	viper.BindPFlag("upstreamGracePeriod", rootCmd.PersistentFlags().Lookup("upstream-grace-period"))
+	viper.BindPFlag("maxDeletionPercentage", rootCmd.PersistentFlags().Lookup("max-deletion-percentage"))
+	viper.BindPFlag("freeze", rootCmd.PersistentFlags().Lookup("freeze"))
+	viper.BindPFlag("adminTokenFile", rootCmd.PersistentFlags().Lookup("admin-token-file"))
+	viper.BindPFlag("adminAddress", rootCmd.PersistentFlags().Lookup("admin-address"))
+	viper.BindPFlag("adminCert", rootCmd.PersistentFlags().Lookup("admin-cert"))
+	viper.BindPFlag("adminKey", rootCmd.PersistentFlags().Lookup("admin-key"))
+	viper.BindPFlag("xdsCert", rootCmd.PersistentFlags().Lookup("xds-cert"))
+	viper.BindPFlag("xdsKey", rootCmd.PersistentFlags().Lookup("xds-key"))
+	viper.BindPFlag("xdsCA", rootCmd.PersistentFlags().Lookup("xds-ca"))
+	viper.BindPFlag("xdsCertReloadInterval", rootCmd.PersistentFlags().Lookup("xds-cert-reload-interval"))
 }
 
 func initConfig() {
@@ -158,23 +234,9 @@ func initConfig() {
 }
 
 func main(*cobra.Command, []string) error {
-	flag.Set("logtostderr", "true")
-	var c config
-	err := viper.Unmarshal(&c)
+	c, err := loadConfig()
 	if err != nil {
-		return fmt.Errorf("error unmarshalling viper config: %s", err)
-	}
-
-	if !envoy.ValidateEnvoyRetryOn(viper.GetString("retryOn")) {
-		return fmt.Errorf("invalid retry-on parameter: %s", viper.GetString("retryOn"))
-	}
-
-	if viper.Get("debug") == true {
-		log.SetLevel(log.DebugLevel)
-	}
-
-	if c.SyncSecrets && len(c.Certificates) > 1 {
-		return fmt.Errorf("only one certificate can be declared when syncSecrets is true")
+		return err
 	}
 
 	clusterSources, err := createSources(c.Clusters)
@@ -195,10 +257,129 @@ func main(*cobra.Command, []string) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	hash := Hasher{}
-	envoyCache := cache.NewSnapshotCache(false, hash, nil)
+	configurators, err := createConfigurators(c)
+	if err != nil {
+		return err
+	}
+
+	aggregator := k8s.NewAggregator(sources, ctx, c.SyncSecrets, configurators.syncGatewayAPI,
+		k8s.WithSyncTimeout(viper.GetDuration("syncTimeout")),
+		k8s.WithRetryInterval(viper.GetDuration("clusterRetryInterval")),
+		k8s.WithStalenessLimit(viper.GetDuration("clusterStalenessLimit")),
+	)
+	configurator := configurators.defaultNodes
+	hash := configurators.hash
+	envoyCache := cache.NewSnapshotCache(true, hash, nil)
+
+	// resolved endpoints have to be refreshed even when nothing changes in the clusters
+	refreshInterval := time.Duration(0)
+	if viper.GetBool("endpointDiscovery") {
+		refreshInterval = viper.GetDuration("endpointRefreshInterval")
+	}
+	// as are the draining upstreams once their grace period expires, removed at most a tenth of it late
+	if drainingCheck := viper.GetDuration("upstreamGracePeriod") / 10; drainingCheck > 0 && (refreshInterval == 0 || drainingCheck < refreshInterval) {
+		refreshInterval = drainingCheck
+	}
+	snapshotter := envoy.NewSnapshotter(envoyCache, configurator, aggregator,
+		envoy.WithRefreshInterval(refreshInterval),
+		envoy.WithResyncInterval(viper.GetDuration("resyncInterval")),
+		envoy.WithDebounce(viper.GetDuration("debounceWindow"), viper.GetDuration("debounceMaxDelay")),
+		envoy.WithMaxRetryDelay(viper.GetDuration("snapshotMaxRetryDelay")),
+		envoy.WithNodeGroups(configurators.nodeGroups...),
+		envoy.WithHistory(viper.GetInt("historySize"), viper.GetString("historyDir")),
+		envoy.WithDeletionGuard(viper.GetInt("maxDeletionPercentage")),
+	)
+	if err := snapshotter.LoadHistory(); err != nil {
+		return fmt.Errorf("error loading the snapshot history: %s", err)
+	}
+	if viper.GetBool("freeze") {
+		snapshotter.Freeze()
+	}
+
+	go snapshotter.Run(aggregator)
+
+	var xdsCertificates *envoy.XDSCertificates
+	if viper.GetString("xdsCert") != "" || viper.GetString("xdsKey") != "" {
+		xdsCertificates, err = envoy.NewXDSCertificates(viper.GetString("xdsCert"), viper.GetString("xdsKey"), viper.GetString("xdsCA"))
+		if err != nil {
+			return fmt.Errorf("error loading the xDS server certificates: %s", err)
+		}
+		go xdsCertificates.Watch(ctx, viper.GetDuration("xdsCertReloadInterval"))
+	}
+	if len(c.XDSClientNodes) > 0 && (xdsCertificates == nil || viper.GetString("xdsCA") == "") {
+		return fmt.Errorf("xdsClientNodes requires client certificates to be verified with xds-cert, xds-key and xds-ca")
+	}
+
+	adminToken := ""
+	if viper.GetString("adminTokenFile") != "" {
+		bytes, err := ioutil.ReadFile(viper.GetString("adminTokenFile"))
+		if err != nil {
+			return fmt.Errorf("error reading the admin token: %s", err)
+		}
+		adminToken = strings.TrimSpace(string(bytes))
+		if adminToken == "" {
+			return fmt.Errorf("the admin token file %s is empty", viper.GetString("adminTokenFile"))
+		}
+	}
+	if (viper.GetString("adminCert") == "") != (viper.GetString("adminKey") == "") {
+		return fmt.Errorf("the admin API is served over TLS with both admin-cert and admin-key")
+	}
+
+	nodes := envoy.NewNodeTracker()
+	envoyServer := server.NewServer(ctx, envoyCache, newCallbacks(nodes, envoy.NewNodeAuthorizer(c.XDSClientNodes), hash))
+	go runEnvoyServer(envoyServer, snapshotter, aggregator, nodes, xdsCertificates, viper.GetBool("configDump"), viper.GetString("address"), viper.GetString("healthAddress"), ctx.Done())
+	if adminToken != "" {
+		go runAdminServer(snapshotter, adminToken, viper.GetString("adminAddress"), viper.GetString("adminCert"), viper.GetString("adminKey"))
+	}
+
+	<-stopCh
+	return nil
+}
+
+// loadConfig reads the configuration from the config file and the flags
+func loadConfig() (config, error) {
+	flag.Set("logtostderr", "true")
+	var c config
+	err := viper.Unmarshal(&c)
+	if err != nil {
+		return c, fmt.Errorf("error unmarshalling viper config: %s", err)
+	}
+
+	if !envoy.ValidateEnvoyRetryOn(viper.GetString("retryOn")) {
+		return c, fmt.Errorf("invalid retry-on parameter: %s", viper.GetString("retryOn"))
+	}
+
+	if viper.Get("debug") == true {
+		log.SetLevel(log.DebugLevel)
+	}
 
-	err = checkDownStreamTLSSetup(viper.GetString("cert"), viper.GetString("key"))
+	return c, nil
+}
+
+// configurators generate the configuration of the default nodes and of each node group
+type configurators struct {
+	defaultNodes   *envoy.KubernetesConfigurator
+	nodeGroups     []envoy.Configurator
+	hash           Hasher
+	syncGatewayAPI bool
+}
+
+// configurator returns the configurator of a node group, or of the default nodes when empty
+func (c configurators) configurator(nodeGroup string) (envoy.Configurator, error) {
+	if nodeGroup == "" {
+		return c.defaultNodes, nil
+	}
+	for _, configurator := range c.nodeGroups {
+		if configurator.NodeID() == nodeGroup {
+			return configurator, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown node group %s", nodeGroup)
+}
+
+// createConfigurators loads the certificates and creates the configurators of the default nodes and the node groups
+func createConfigurators(c config) (configurators, error) {
+	err := checkDownStreamTLSSetup(viper.GetString("cert"), viper.GetString("key"))
 	if err != nil {
 		log.Fatalf("TLS setup failed: %s", err)
 	}
@@ -209,55 +390,69 @@ func main(*cobra.Command, []string) error {
 		}
 	}
 
-	// load the certificates from the file system
-	for idx, certificate := range c.Certificates {
-		certPath := certificate.Cert
-		keyPath := certificate.Key
+	defaultGroup := nodeGroupConfig{
+		Name:                     viper.GetString("nodeName"),
+		IngressClasses:           viper.GetStringSlice("ingressClasses"),
+		GatewayClasses:           viper.GetStringSlice("gatewayClasses"),
+		Certificates:             c.Certificates,
+		EnvoyListenerIpv4Address: viper.GetString("envoyListenerIpv4Address"),
+		EnvoyPort:                uint32(viper.GetInt32("envoyPort")),
+		HttpExtAuthz:             &c.HttpExtAuthz,
+		HttpGrpcLogger:           &c.HttpGrpcLogger,
+		AccessLogger:             &c.AccessLogger,
+	}
+	nodeGroups, err := createNodeGroups(c.NodeGroups, defaultGroup)
+	if err != nil {
+		return configurators{}, fmt.Errorf("error creating node groups: %s", err)
+	}
 
-		certBytes, err := ioutil.ReadFile(certPath)
-		if err != nil {
-			log.Fatalf("Failed to read %s: %v", certPath, err)
+	// load the certificates from the file system, node groups not declaring any share the default ones
+	created := configurators{}
+	for _, group := range append([]*nodeGroupConfig{&defaultGroup}, nodeGroups...) {
+		if group != &defaultGroup && len(group.Certificates) == 0 {
+			group.Certificates = defaultGroup.Certificates
+		} else {
+			group.Certificates = loadCertificates(group.Certificates)
 		}
-
-		keyBytes, err := ioutil.ReadFile(keyPath)
-		if err != nil {
-			log.Fatalf("Failed to read %s: %v", keyPath, err)
+		if c.SyncSecrets && len(group.Certificates) > 1 {
+			return configurators{}, fmt.Errorf("only one certificate can be declared when syncSecrets is true")
 		}
+		created.syncGatewayAPI = created.syncGatewayAPI || len(group.GatewayClasses) > 0
+	}
 
-		c.Certificates[idx].Cert = string(certBytes)
-		c.Certificates[idx].Key = string(keyBytes)
-	}
-	aggregator := k8s.NewAggregator(sources, ctx, c.SyncSecrets)
-	configurator := envoy.NewKubernetesConfigurator(
-		viper.GetString("nodeName"),
-		c.Certificates,
-		viper.GetString("trustCA"),
-		viper.GetStringSlice("ingressClasses"),
-		viper.GetStringSlice("internalCidrRanges"),
-		envoy.WithUpstreamPort(uint32(viper.GetInt32("upstreamPort"))),
-		envoy.WithEnvoyListenerIpv4Address(viper.GetString("envoyListenerIpv4Address")),
-		envoy.WithEnvoyPort(uint32(viper.GetInt32("envoyPort"))),
-		envoy.WithOutlierPercentage(viper.GetInt32("maxEjectionPercentage")),
-		envoy.WithHostSelectionRetryAttempts(viper.GetInt64("hostSelectionRetryAttempts")),
-		envoy.WithUpstreamHealthCheck(c.UpstreamHealthCheck),
-		envoy.WithUseRemoteAddress(c.UseRemoteAddress),
-		envoy.WithHttpExtAuthzCluster(c.HttpExtAuthz),
-		envoy.WithHttpGrpcLogger(c.HttpGrpcLogger),
-		envoy.WithSyncSecrets(c.SyncSecrets),
-		envoy.WithDefaultRetryOn(viper.GetString("retryOn")),
-		envoy.WithAccessLog(c.AccessLogger),
-		envoy.WithTracingProvider(viper.GetString("tracingProvider")),
-	)
-	snapshotter := envoy.NewSnapshotter(envoyCache, configurator, aggregator)
-
-	go snapshotter.Run(aggregator)
-	go aggregator.Run()
-
-	envoyServer := server.NewServer(ctx, envoyCache, &callbacks{})
-	go runEnvoyServer(envoyServer, snapshotter, viper.GetBool("configDump"), viper.GetString("address"), viper.GetString("healthAddress"), ctx.Done())
+	newConfigurator := func(group *nodeGroupConfig) *envoy.KubernetesConfigurator {
+		return envoy.NewKubernetesConfigurator(
+			group.Name,
+			group.Certificates,
+			viper.GetString("trustCA"),
+			group.IngressClasses,
+			viper.GetStringSlice("internalCidrRanges"),
+			envoy.WithUpstreamPort(uint32(viper.GetInt32("upstreamPort"))),
+			envoy.WithEnvoyListenerIpv4Address(group.EnvoyListenerIpv4Address),
+			envoy.WithEnvoyPort(group.EnvoyPort),
+			envoy.WithOutlierPercentage(viper.GetInt32("maxEjectionPercentage")),
+			envoy.WithHostSelectionRetryAttempts(viper.GetInt64("hostSelectionRetryAttempts")),
+			envoy.WithUpstreamHealthCheck(c.UpstreamHealthCheck),
+			envoy.WithUseRemoteAddress(c.UseRemoteAddress),
+			envoy.WithHttpExtAuthzCluster(*group.HttpExtAuthz),
+			envoy.WithHttpGrpcLogger(*group.HttpGrpcLogger),
+			envoy.WithSyncSecrets(c.SyncSecrets),
+			envoy.WithDefaultRetryOn(viper.GetString("retryOn")),
+			envoy.WithAccessLog(*group.AccessLogger),
+			envoy.WithTracingProvider(viper.GetString("tracingProvider")),
+			envoy.WithGatewayClasses(group.GatewayClasses),
+			envoy.WithEndpointDiscovery(viper.GetBool("endpointDiscovery")),
+			envoy.WithSourceOptions(createSourceOptions(c.Clusters)),
+			envoy.WithUpstreamGracePeriod(viper.GetDuration("upstreamGracePeriod")),
+		)
+	}
+	created.defaultNodes = newConfigurator(&defaultGroup)
+	for _, group := range nodeGroups {
+		created.nodeGroups = append(created.nodeGroups, newConfigurator(group))
+		created.hash.groups = append(created.hash.groups, envoy.NodeGroup{Name: group.Name, Cluster: group.NodeCluster, Metadata: group.NodeMetadata})
+	}
 
-	<-stopCh
-	return nil
+	return created, nil
 }
 
 // checkDownStreamTLSSetup if only one of the two values is set.
@@ -272,6 +467,75 @@ func checkDownStreamTLSSetup(cert string, key string) error {
 	return nil
 }
 
+// loadCertificates replaces the paths of the certificates by the content of the files
+func loadCertificates(certificates []envoy.Certificate) []envoy.Certificate {
+	loaded := []envoy.Certificate{}
+	for _, certificate := range certificates {
+		certPath := certificate.Cert
+		keyPath := certificate.Key
+
+		certBytes, err := ioutil.ReadFile(certPath)
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", certPath, err)
+		}
+
+		keyBytes, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", keyPath, err)
+		}
+
+		certificate.Cert = string(certBytes)
+		certificate.Key = string(keyBytes)
+		loaded = append(loaded, certificate)
+	}
+	return loaded
+}
+
+// createNodeGroups validates the node groups and fills the settings they do not set from the default ones
+func createNodeGroups(groups []nodeGroupConfig, defaultGroup nodeGroupConfig) ([]*nodeGroupConfig, error) {
+	nodeGroups := []*nodeGroupConfig{}
+	names := map[string]bool{defaultGroup.Name: true}
+
+	for _, group := range groups {
+		group := group
+		if group.Name == "" {
+			return nil, fmt.Errorf("node groups must have a name")
+		}
+		if names[group.Name] {
+			return nil, fmt.Errorf("node group %s is declared twice or named after the node name", group.Name)
+		}
+		names[group.Name] = true
+		if group.NodeCluster == "" && len(group.NodeMetadata) == 0 {
+			return nil, fmt.Errorf("node group %s must match nodes by nodeCluster or nodeMetadata", group.Name)
+		}
+
+		if len(group.IngressClasses) == 0 {
+			group.IngressClasses = defaultGroup.IngressClasses
+		}
+		if len(group.GatewayClasses) == 0 {
+			group.GatewayClasses = defaultGroup.GatewayClasses
+		}
+		if group.EnvoyListenerIpv4Address == "" {
+			group.EnvoyListenerIpv4Address = defaultGroup.EnvoyListenerIpv4Address
+		}
+		if group.EnvoyPort == 0 {
+			group.EnvoyPort = defaultGroup.EnvoyPort
+		}
+		if group.HttpExtAuthz == nil {
+			group.HttpExtAuthz = defaultGroup.HttpExtAuthz
+		}
+		if group.HttpGrpcLogger == nil {
+			group.HttpGrpcLogger = defaultGroup.HttpGrpcLogger
+		}
+		if group.AccessLogger == nil {
+			group.AccessLogger = defaultGroup.AccessLogger
+		}
+		nodeGroups = append(nodeGroups, &group)
+	}
+
+	return nodeGroups, nil
+}
+
 func createClientConfig(path string) (*rest.Config, error) {
 	if path == "" {
 		return rest.InClusterConfig()
@@ -279,10 +543,26 @@ func createClientConfig(path string) (*rest.Config, error) {
 	return clientcmd.BuildConfigFromFlags("", path)
 }
 
-func createSources(clusters []clusterConfig) ([]*kubernetes.Clientset, error) {
-	sources := []*kubernetes.Clientset{}
+func newSource(config *rest.Config) (*k8s.Source, error) {
+	clientSet, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &k8s.Source{Name: config.Host, Client: clientSet, DynamicClient: dynamicClient}, nil
+}
+
+func createSources(clusters []clusterConfig) ([]*k8s.Source, error) {
+	sources := []*k8s.Source{}
 
 	for _, cluster := range clusters {
+		if cluster.Enabled != nil && !*cluster.Enabled {
+			log.Infof("skipping disabled cluster %s", clusterName(cluster))
+			continue
+		}
 
 		var token string
 
@@ -303,29 +583,56 @@ func createSources(clusters []clusterConfig) ([]*kubernetes.Clientset, error) {
 				CAFile: cluster.Ca,
 			},
 		}
-		clientSet, err := kubernetes.NewForConfig(config)
+		source, err := newSource(config)
 		if err != nil {
 			return sources, err
 		}
-		sources = append(sources, clientSet)
+		source.Name = clusterName(cluster)
+		source.Locality = k8s.Locality{Region: cluster.Region, Zone: cluster.Zone, Priority: cluster.Priority}
+		source.Namespaces = cluster.Namespaces
+		sources = append(sources, source)
 	}
 
 	return sources, nil
 }
 
-func configFromKubeConfig(paths []string) ([]*kubernetes.Clientset, error) {
-	sources := []*kubernetes.Clientset{}
+// clusterName names a cluster after its API server unless it is given a name
+func clusterName(cluster clusterConfig) string {
+	if cluster.Name != "" {
+		return cluster.Name
+	}
+	return cluster.APIServer
+}
+
+// createSourceOptions returns the upstream settings of the clusters overriding the global ones
+func createSourceOptions(clusters []clusterConfig) map[string]envoy.SourceOptions {
+	sourceOptions := map[string]envoy.SourceOptions{}
+	for _, cluster := range clusters {
+		if cluster.WeightMultiplier == 0 && cluster.UpstreamPort == 0 && cluster.TrustCA == "" {
+			continue
+		}
+		sourceOptions[clusterName(cluster)] = envoy.SourceOptions{
+			WeightMultiplier: cluster.WeightMultiplier,
+			UpstreamPort:     cluster.UpstreamPort,
+			TrustCA:          cluster.TrustCA,
+		}
+	}
+	return sourceOptions
+}
+
+func configFromKubeConfig(paths []string) ([]*k8s.Source, error) {
+	sources := []*k8s.Source{}
 
 	for _, configPath := range paths {
 		config, err := createClientConfig(configPath)
 		if err != nil {
 			return sources, err
 		}
-		clientSet, err := kubernetes.NewForConfig(config)
+		source, err := newSource(config)
 		if err != nil {
 			return sources, err
 		}
-		sources = append(sources, clientSet)
+		sources = append(sources, source)
 	}
 
 	return sources, nil
@@ -336,5 +643,8 @@ func (h Hasher) ID(node *core.Node) string {
 	if node == nil {
 		return "unknown"
 	}
+	if group, ok := envoy.MatchNodeGroup(h.groups, node); ok {
+		return group
+	}
 	return node.Id
 }
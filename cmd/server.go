@@ -2,49 +2,125 @@ package cmd
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
 
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	cluster "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
 	listener "github.com/envoyproxy/go-control-plane/envoy/service/listener/v3"
 	route "github.com/envoyproxy/go-control-plane/envoy/service/route/v3"
+	secret "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
 	server "github.com/envoyproxy/go-control-plane/pkg/server/v3"
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
 	"github.com/uswitch/yggdrasil/pkg/envoy"
+	"github.com/uswitch/yggdrasil/pkg/k8s"
 )
 
 type callbacks struct {
-	fetchReq  int
-	fetchResp int
+	fetchReq   int
+	fetchResp  int
+	nodes      *envoy.NodeTracker
+	authorizer *envoy.NodeAuthorizer
+	hash       Hasher
+
+	// contexts of the open streams, carrying their client certificates
+	streams      map[int64]context.Context
+	deltaStreams map[int64]context.Context
+	sync.Mutex
+}
+
+func newCallbacks(nodes *envoy.NodeTracker, authorizer *envoy.NodeAuthorizer, hash Hasher) *callbacks {
+	return &callbacks{
+		nodes:        nodes,
+		authorizer:   authorizer,
+		hash:         hash,
+		streams:      map[int64]context.Context{},
+		deltaStreams: map[int64]context.Context{},
+	}
+}
+
+// authorize checks the client of a stream may be served the snapshot of the node
+func (c *callbacks) authorize(streams map[int64]context.Context, streamID int64, node *core.Node) error {
+	if node == nil {
+		return nil
+	}
+	c.Lock()
+	ctx, ok := streams[streamID]
+	c.Unlock()
+	if !ok {
+		ctx = context.Background()
+	}
+	if err := c.authorizer.Authorize(ctx, c.hash.ID(node)); err != nil {
+		log.Warnf("refusing node %s: %s", node.Id, err)
+		return err
+	}
+	return nil
 }
 
-func (c *callbacks) OnDeltaStreamClosed(int64) {}
-func (c *callbacks) OnDeltaStreamOpen(context.Context, int64, string) error {
+func (c *callbacks) OnDeltaStreamClosed(streamID int64) {
+	c.Lock()
+	delete(c.deltaStreams, streamID)
+	c.Unlock()
+	c.nodes.StreamClosed(streamID, true)
+}
+func (c *callbacks) OnDeltaStreamOpen(ctx context.Context, streamID int64, typeURL string) error {
+	c.Lock()
+	defer c.Unlock()
+	c.deltaStreams[streamID] = ctx
 	return nil
 }
-func (c *callbacks) OnStreamDeltaRequest(int64, *discovery.DeltaDiscoveryRequest) error {
+func (c *callbacks) OnStreamDeltaRequest(streamID int64, req *discovery.DeltaDiscoveryRequest) error {
+	if err := c.authorize(c.deltaStreams, streamID, req.Node); err != nil {
+		return err
+	}
+	c.nodes.StreamRequest(streamID, true, req.Node, req.TypeUrl, "", req.ResponseNonce, req.ErrorDetail)
 	return nil
 }
-func (c *callbacks) OnStreamDeltaResponse(int64, *discovery.DeltaDiscoveryRequest, *discovery.DeltaDiscoveryResponse) {
+func (c *callbacks) OnStreamDeltaResponse(streamID int64, req *discovery.DeltaDiscoveryRequest, resp *discovery.DeltaDiscoveryResponse) {
+	c.nodes.StreamResponse(streamID, true, resp.TypeUrl, resp.SystemVersionInfo, resp.Nonce)
 }
-func (c *callbacks) OnStreamOpen(context.Context, int64, string) error {
+func (c *callbacks) OnStreamOpen(ctx context.Context, streamID int64, typeURL string) error {
+	c.Lock()
+	defer c.Unlock()
+	c.streams[streamID] = ctx
 	return nil
 }
-func (c *callbacks) OnStreamClosed(int64) {}
-func (c *callbacks) OnStreamRequest(int64, *discovery.DiscoveryRequest) error {
+func (c *callbacks) OnStreamClosed(streamID int64) {
+	c.Lock()
+	delete(c.streams, streamID)
+	c.Unlock()
+	c.nodes.StreamClosed(streamID, false)
+}
+func (c *callbacks) OnStreamRequest(streamID int64, req *discovery.DiscoveryRequest) error {
+	if err := c.authorize(c.streams, streamID, req.Node); err != nil {
+		return err
+	}
+	c.nodes.StreamRequest(streamID, false, req.Node, req.TypeUrl, req.VersionInfo, req.ResponseNonce, req.ErrorDetail)
 	return nil
 }
-func (c *callbacks) OnStreamResponse(context.Context, int64, *discovery.DiscoveryRequest, *discovery.DiscoveryResponse) {
+func (c *callbacks) OnStreamResponse(ctx context.Context, streamID int64, req *discovery.DiscoveryRequest, resp *discovery.DiscoveryResponse) {
+	c.nodes.StreamResponse(streamID, false, resp.TypeUrl, resp.VersionInfo, resp.Nonce)
 }
-func (c *callbacks) OnFetchRequest(context.Context, *discovery.DiscoveryRequest) error {
+func (c *callbacks) OnFetchRequest(ctx context.Context, req *discovery.DiscoveryRequest) error {
+	if req.Node != nil {
+		if err := c.authorizer.Authorize(ctx, c.hash.ID(req.Node)); err != nil {
+			return err
+		}
+	}
 	c.fetchReq++
 	return nil
 }
@@ -52,12 +128,16 @@ func (c *callbacks) OnFetchResponse(*discovery.DiscoveryRequest, *discovery.Disc
 	c.fetchResp++
 }
 
-func runEnvoyServer(envoyServer server.Server, snapshotter *envoy.Snapshotter, enableConfigDump bool, address string, healthAddress string, stopCh <-chan struct{}) {
+func runEnvoyServer(envoyServer server.Server, snapshotter *envoy.Snapshotter, aggregator *k8s.Aggregator, nodes *envoy.NodeTracker, xdsCertificates *envoy.XDSCertificates, enableConfigDump bool, address string, healthAddress string, stopCh <-chan struct{}) {
 
-	grpcServer := grpc.NewServer(
+	serverOptions := []grpc.ServerOption{
 		grpc.StreamInterceptor(grpc_prometheus.StreamServerInterceptor),
 		grpc.UnaryInterceptor(grpc_prometheus.UnaryServerInterceptor),
-	)
+	}
+	if xdsCertificates != nil {
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(xdsCertificates.TLSConfig())))
+	}
+	grpcServer := grpc.NewServer(serverOptions...)
 
 	lis, err := net.Listen("tcp", address)
 	if err != nil {
@@ -69,6 +149,7 @@ func runEnvoyServer(envoyServer server.Server, snapshotter *envoy.Snapshotter, e
 	cluster.RegisterClusterDiscoveryServiceServer(grpcServer, envoyServer)
 	route.RegisterRouteDiscoveryServiceServer(grpcServer, envoyServer)
 	listener.RegisterListenerDiscoveryServiceServer(grpcServer, envoyServer)
+	secret.RegisterSecretDiscoveryServiceServer(grpcServer, envoyServer)
 
 	healthMux := http.NewServeMux()
 
@@ -79,8 +160,13 @@ func runEnvoyServer(envoyServer server.Server, snapshotter *envoy.Snapshotter, e
 
 	healthMux.Handle("/metrics", promhttp.Handler())
 	healthMux.HandleFunc("/healthz", health)
+	healthMux.HandleFunc("/sources", handleSources(aggregator))
+	healthMux.HandleFunc("/status", handleStatus(snapshotter))
+	healthMux.HandleFunc("/ingress-errors", handleIngressErrors(snapshotter))
+	healthMux.HandleFunc("/nodes", handleNodes(nodes))
 	if enableConfigDump {
 		healthMux.HandleFunc("/configdump", handleConfigDump(snapshotter))
+		healthMux.HandleFunc("/configdump/diff", handleConfigDumpDiff(snapshotter))
 	}
 
 	go func() {
@@ -100,6 +186,34 @@ func runEnvoyServer(envoyServer server.Server, snapshotter *envoy.Snapshotter, e
 	grpcServer.GracefulStop()
 }
 
+// runAdminServer serves the admin API on its own listener, over TLS when a certificate is given,
+// so that its bearer token is not sent over the plain HTTP health server
+func runAdminServer(snapshotter *envoy.Snapshotter, adminToken string, address string, cert string, key string) {
+	adminMux := http.NewServeMux()
+	adminMux.HandleFunc("/admin/history", requireAdmin(adminToken, handleHistory(snapshotter)))
+	adminMux.HandleFunc("/admin/rollback", requireAdmin(adminToken, handleRollback(snapshotter)))
+	adminMux.HandleFunc("/admin/release", requireAdmin(adminToken, handleRelease(snapshotter)))
+	adminMux.HandleFunc("/admin/freeze", requireAdmin(adminToken, handleFreeze(snapshotter)))
+	adminMux.HandleFunc("/admin/unfreeze", requireAdmin(adminToken, handleUnfreeze(snapshotter)))
+	adminMux.HandleFunc("/admin/pending", requireAdmin(adminToken, handlePending(snapshotter)))
+	adminMux.HandleFunc("/admin/override-guard", requireAdmin(adminToken, handleOverrideGuard(snapshotter)))
+
+	adminServer := &http.Server{
+		Addr:      address,
+		Handler:   adminMux,
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+	var err error
+	if cert != "" {
+		err = adminServer.ListenAndServeTLS(cert, key)
+	} else {
+		err = adminServer.ListenAndServe()
+	}
+	if err != nil {
+		log.Fatalf("Failed to listen and serve admin server: %v", err)
+	}
+}
+
 func health(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 }
@@ -116,7 +230,7 @@ func handleConfigDump(snapshotter *envoy.Snapshotter) http.HandlerFunc {
 			return
 		}
 
-		snapshot, err := snapshotter.ConfigDump()
+		snapshot, err := snapshotter.ConfigDump(r.URL.Query().Get("nodeGroup"))
 		if err != nil {
 			respErr := ConfigDumpError{
 				Error:   err,
@@ -134,3 +248,223 @@ func handleConfigDump(snapshotter *envoy.Snapshotter) http.HandlerFunc {
 		json.NewEncoder(w).Encode(snapshot)
 	}
 }
+
+func handleConfigDumpDiff(snapshotter *envoy.Snapshotter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		since := r.URL.Query().Get("since")
+		if since == "" {
+			http.Error(w, "the since parameter is required", http.StatusBadRequest)
+			return
+		}
+
+		diffs, err := snapshotter.DiffSince(r.URL.Query().Get("nodeGroup"), since)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, envoy.ErrUnknownVersion) {
+				status = http.StatusNotFound
+			}
+			respErr := ConfigDumpError{
+				Error:   err,
+				Message: fmt.Sprintf("Unable to diff the current snapshot: %s", err),
+			}
+
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(respErr)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(diffs)
+	}
+}
+
+// requireAdmin only lets the requests bearing the admin token through
+func requireAdmin(token string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// writeAdminError answers with the status matching an error of the snapshotter
+func writeAdminError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, envoy.ErrUnknownVersion) {
+		status = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func handleHistory(snapshotter *envoy.Snapshotter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshotter.History(r.URL.Query().Get("nodeGroup")))
+	}
+}
+
+func handleRollback(snapshotter *envoy.Snapshotter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		version := r.URL.Query().Get("version")
+		if version == "" {
+			http.Error(w, "the version parameter is required", http.StatusBadRequest)
+			return
+		}
+		if err := snapshotter.Rollback(r.URL.Query().Get("nodeGroup"), version); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func handleRelease(snapshotter *envoy.Snapshotter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := snapshotter.Release(r.URL.Query().Get("nodeGroup")); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func handleFreeze(snapshotter *envoy.Snapshotter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		snapshotter.Freeze()
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func handleUnfreeze(snapshotter *envoy.Snapshotter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := snapshotter.Unfreeze(); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func handlePending(snapshotter *envoy.Snapshotter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		diffs, err := snapshotter.PendingDiff(r.URL.Query().Get("nodeGroup"))
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(diffs)
+	}
+}
+
+func handleOverrideGuard(snapshotter *envoy.Snapshotter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := snapshotter.OverrideGuard(r.URL.Query().Get("nodeGroup")); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func handleSources(aggregator *k8s.Aggregator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(aggregator.SourceStatuses())
+	}
+}
+
+func handleStatus(snapshotter *envoy.Snapshotter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		status := snapshotter.Status()
+		w.Header().Add("Content-Type", "application/json")
+		if status.Error != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+func handleIngressErrors(snapshotter *envoy.Snapshotter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(snapshotter.IngressErrors())
+	}
+}
+
+func handleNodes(nodes *envoy.NodeTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(nodes.Nodes())
+	}
+}
@@ -3,6 +3,7 @@ package envoy
 import (
 	"fmt"
 	"log"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -22,10 +23,10 @@ import (
 	previousHosts "github.com/envoyproxy/go-control-plane/envoy/extensions/retry/host/previous_hosts/v3"
 	auth "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
 	matcherv3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
-	any "github.com/golang/protobuf/ptypes/any"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	"github.com/golang/protobuf/ptypes/duration"
 	"github.com/golang/protobuf/ptypes/wrappers"
-	"google.golang.org/protobuf/types/known/anypb"
+	"github.com/uswitch/yggdrasil/pkg/k8s"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/structpb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
@@ -78,52 +79,206 @@ func makeVirtualHost(vhost *virtualHost, reselectionAttempts int64, defaultRetry
 		retryOn = defaultRetryOn
 	}
 
-	action := &route.Route_Route{
-		Route: &route.RouteAction{
-			Timeout: &duration.Duration{Seconds: int64(vhost.Timeout.Seconds())},
-			ClusterSpecifier: &route.RouteAction_Cluster{
-				Cluster: vhost.UpstreamCluster,
-			},
-			RetryPolicy: &route.RetryPolicy{
-				RetryOn:       retryOn,
-				PerTryTimeout: &duration.Duration{Seconds: int64(vhost.PerTryTimeout.Seconds())},
-			},
-		},
-	}
-
 	hosts := &previousHosts.PreviousHostsPredicate{}
 
-	anyHosts, err := anypb.New(hosts)
+	anyHosts, err := newAny(hosts)
 	if err != nil {
 		return &route.VirtualHost{}, fmt.Errorf("failed to marshal hosts config struct to typed struct: %s", err)
 	}
 
-	if reselectionAttempts >= 0 {
-		action.Route.RetryPolicy.RetryHostPredicate = []*route.RetryPolicy_RetryHostPredicate{
-			{
-				Name:       "envoy.retry_host_predicates.previous_hosts",
-				ConfigType: &route.RetryPolicy_RetryHostPredicate_TypedConfig{TypedConfig: anyHosts},
+	vhostRoutes := vhost.Routes
+	if len(vhostRoutes) == 0 {
+		vhostRoutes = []*httpRoute{{Path: "/", PathType: k8s.PathTypePrefix, UpstreamCluster: vhost.UpstreamCluster}}
+	}
+
+	routes := []*route.Route{}
+	for _, vhostRoute := range vhostRoutes {
+		envoyRoute := &route.Route{
+			Match: makeRouteMatch(vhostRoute),
+		}
+
+		if vhostRoute.isRedirect() {
+			envoyRoute.Action = &route.Route_Redirect{Redirect: makeRedirectAction(vhostRoute.Filters.Redirect)}
+			addHeaderModifiers(envoyRoute, vhostRoute.Filters)
+			routes = append(routes, envoyRoute)
+			continue
+		}
+
+		action := &route.Route_Route{
+			Route: &route.RouteAction{
+				Timeout: &duration.Duration{Seconds: int64(vhost.Timeout.Seconds())},
+				ClusterSpecifier: &route.RouteAction_Cluster{
+					Cluster: vhostRoute.UpstreamCluster,
+				},
+				RetryPolicy: &route.RetryPolicy{
+					RetryOn:       retryOn,
+					PerTryTimeout: &duration.Duration{Seconds: int64(vhost.PerTryTimeout.Seconds())},
+				},
 			},
 		}
-		action.Route.RetryPolicy.HostSelectionRetryMaxAttempts = reselectionAttempts
+
+		if reselectionAttempts >= 0 {
+			action.Route.RetryPolicy.RetryHostPredicate = []*route.RetryPolicy_RetryHostPredicate{
+				{
+					Name:       "envoy.retry_host_predicates.previous_hosts",
+					ConfigType: &route.RetryPolicy_RetryHostPredicate_TypedConfig{TypedConfig: anyHosts},
+				},
+			}
+			action.Route.RetryPolicy.HostSelectionRetryMaxAttempts = reselectionAttempts
+		}
+
+		if len(vhostRoute.WeightedClusters) > 0 {
+			action.Route.ClusterSpecifier = &route.RouteAction_WeightedClusters{WeightedClusters: makeWeightedClusters(vhostRoute.WeightedClusters)}
+		}
+
+		if vhostRoute.Mirror != nil {
+			action.Route.RequestMirrorPolicies = []*route.RouteAction_RequestMirrorPolicy{makeRequestMirrorPolicy(vhostRoute.Mirror)}
+		}
+
+		if vhostRoute.Filters != nil && vhostRoute.Filters.Rewrite != nil {
+			addRewrite(action.Route, vhostRoute.Filters.Rewrite)
+		}
+
+		envoyRoute.Action = action
+		addHeaderModifiers(envoyRoute, vhostRoute.Filters)
+		routes = append(routes, envoyRoute)
 	}
+
 	virtualHost := route.VirtualHost{
 		Name:    "local_service",
 		Domains: []string{vhost.Host},
-		Routes: []*route.Route{
-			{
-				Match: &route.RouteMatch{
-					PathSpecifier: &route.RouteMatch_Prefix{
-						Prefix: "/",
-					},
-				},
-				Action: action,
-			},
-		},
+		Routes:  routes,
 	}
 	return &virtualHost, nil
 }
 
+// makeWeightedClusters splits the requests between the clusters in proportion to their weights
+func makeWeightedClusters(weightedClusters []weightedCluster) *route.WeightedCluster {
+	weighted := &route.WeightedCluster{}
+	total := uint32(0)
+	for _, weightedCluster := range weightedClusters {
+		weighted.Clusters = append(weighted.Clusters, &route.WeightedCluster_ClusterWeight{
+			Name:   weightedCluster.Name,
+			Weight: &wrappers.UInt32Value{Value: weightedCluster.Weight},
+		})
+		total += weightedCluster.Weight
+	}
+	weighted.TotalWeight = &wrappers.UInt32Value{Value: total}
+	return weighted
+}
+
+// makeRequestMirrorPolicy copies the percentage of the requests to the mirror cluster, its responses being discarded
+func makeRequestMirrorPolicy(mirror *routeMirror) *route.RouteAction_RequestMirrorPolicy {
+	return &route.RouteAction_RequestMirrorPolicy{
+		Cluster: mirror.Cluster,
+		RuntimeFraction: &core.RuntimeFractionalPercent{
+			DefaultValue: &typev3.FractionalPercent{Numerator: mirror.Percentage, Denominator: typev3.FractionalPercent_HUNDRED},
+		},
+	}
+}
+
+func makeRegexMatcher(regex string) *matcherv3.RegexMatcher {
+	return &matcherv3.RegexMatcher{
+		EngineType: &matcherv3.RegexMatcher_GoogleRe2{GoogleRe2: &matcherv3.RegexMatcher_GoogleRE2{}},
+		Regex:      regex,
+	}
+}
+
+func makeRouteMatch(vhostRoute *httpRoute) *route.RouteMatch {
+	match := &route.RouteMatch{}
+	switch vhostRoute.PathType {
+	case k8s.PathTypeExact:
+		match.PathSpecifier = &route.RouteMatch_Path{Path: vhostRoute.Path}
+	case k8s.PathTypeRegularExpression:
+		match.PathSpecifier = &route.RouteMatch_SafeRegex{SafeRegex: makeRegexMatcher(vhostRoute.Path)}
+	case k8s.PathTypePrefix:
+		// Prefix paths match by path element, /api does not match /apix
+		if vhostRoute.Path == "/" {
+			match.PathSpecifier = &route.RouteMatch_Prefix{Prefix: "/"}
+		} else {
+			match.PathSpecifier = &route.RouteMatch_PathSeparatedPrefix{PathSeparatedPrefix: vhostRoute.Path}
+		}
+	default:
+		match.PathSpecifier = &route.RouteMatch_Prefix{Prefix: vhostRoute.Path}
+	}
+
+	for _, header := range vhostRoute.Headers {
+		stringMatch := &matcherv3.StringMatcher{
+			MatchPattern: &matcherv3.StringMatcher_Exact{Exact: header.Value},
+		}
+		if header.Regex {
+			stringMatch.MatchPattern = &matcherv3.StringMatcher_SafeRegex{SafeRegex: makeRegexMatcher(header.Value)}
+		}
+		match.Headers = append(match.Headers, &route.HeaderMatcher{
+			Name:                 header.Name,
+			HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{StringMatch: stringMatch},
+		})
+	}
+	return match
+}
+
+var redirectResponseCodes = map[int]route.RedirectAction_RedirectResponseCode{
+	301: route.RedirectAction_MOVED_PERMANENTLY,
+	302: route.RedirectAction_FOUND,
+	303: route.RedirectAction_SEE_OTHER,
+	307: route.RedirectAction_TEMPORARY_REDIRECT,
+	308: route.RedirectAction_PERMANENT_REDIRECT,
+}
+
+func makeRedirectAction(redirect *k8s.IngressRedirect) *route.RedirectAction {
+	action := &route.RedirectAction{
+		HostRedirect: redirect.Hostname,
+		PortRedirect: redirect.Port,
+		ResponseCode: redirectResponseCodes[redirect.StatusCode],
+	}
+	if redirect.Scheme != "" {
+		action.SchemeRewriteSpecifier = &route.RedirectAction_SchemeRedirect{SchemeRedirect: redirect.Scheme}
+	}
+	if redirect.Path != "" {
+		action.PathRewriteSpecifier = &route.RedirectAction_PathRedirect{PathRedirect: redirect.Path}
+	}
+	if redirect.PrefixReplace != "" {
+		action.PathRewriteSpecifier = &route.RedirectAction_PrefixRewrite{PrefixRewrite: redirect.PrefixReplace}
+	}
+	return action
+}
+
+func addRewrite(action *route.RouteAction, rewrite *k8s.IngressRewrite) {
+	if rewrite.Hostname != "" {
+		action.HostRewriteSpecifier = &route.RouteAction_HostRewriteLiteral{HostRewriteLiteral: rewrite.Hostname}
+	}
+	if rewrite.PrefixReplace != "" {
+		action.PrefixRewrite = rewrite.PrefixReplace
+	}
+	if rewrite.FullPath != "" {
+		action.RegexRewrite = &matcherv3.RegexMatchAndSubstitute{
+			Pattern:      makeRegexMatcher("^.*$"),
+			Substitution: rewrite.FullPath,
+		}
+	}
+}
+
+func makeHeaderValueOptions(headers []k8s.HTTPHeader, appendValue bool) []*core.HeaderValueOption {
+	options := []*core.HeaderValueOption{}
+	for _, header := range headers {
+		options = append(options, &core.HeaderValueOption{
+			Header: &core.HeaderValue{Key: header.Name, Value: header.Value},
+			Append: &wrappers.BoolValue{Value: appendValue},
+		})
+	}
+	return options
+}
+
+func addHeaderModifiers(envoyRoute *route.Route, filters *k8s.IngressPathFilters) {
+	if filters == nil {
+		return
+	}
+	envoyRoute.RequestHeadersToAdd = append(makeHeaderValueOptions(filters.RequestHeadersToSet, false), makeHeaderValueOptions(filters.RequestHeadersToAdd, true)...)
+	envoyRoute.RequestHeadersToRemove = filters.RequestHeadersToRemove
+	envoyRoute.ResponseHeadersToAdd = append(makeHeaderValueOptions(filters.ResponseHeadersToSet, false), makeHeaderValueOptions(filters.ResponseHeadersToAdd, true)...)
+	envoyRoute.ResponseHeadersToRemove = filters.ResponseHeadersToRemove
+}
+
 func makeHealthConfig() *hcfg.HealthCheck {
 	return &hcfg.HealthCheck{
 		PassThroughMode: &wrappers.BoolValue{Value: false},
@@ -217,10 +372,10 @@ func makeZipkinTracingProvider() *tracing.ZipkinConfig {
 	return zipkinTracingProviderConfig
 }
 
-func (c *KubernetesConfigurator) makeConnectionManager(virtualHosts []*route.VirtualHost) (*hcm.HttpConnectionManager, error) {
+func (c *KubernetesConfigurator) makeConnectionManager(routeConfigName string) (*hcm.HttpConnectionManager, error) {
 	// Access Logs
 	accessLogConfig := makeFileAccessLog(c.accessLogger)
-	anyAccessLogConfig, err := anypb.New(accessLogConfig)
+	anyAccessLogConfig, err := newAny(accessLogConfig)
 	if err != nil {
 		log.Fatalf("failed to marshal access log config struct to typed struct: %s", err)
 	}
@@ -233,7 +388,7 @@ func (c *KubernetesConfigurator) makeConnectionManager(virtualHosts []*route.Vir
 	}
 
 	if c.httpGrpcLogger.Cluster != "" {
-		anyGrpcLoggerConfig, err := anypb.New(makeGrpcLoggerConfig(c.httpGrpcLogger))
+		anyGrpcLoggerConfig, err := newAny(makeGrpcLoggerConfig(c.httpGrpcLogger))
 		if err != nil {
 			log.Fatalf("failed to marshal healthcheck config struct to typed struct: %s", err)
 		}
@@ -246,7 +401,7 @@ func (c *KubernetesConfigurator) makeConnectionManager(virtualHosts []*route.Vir
 	// HTTP Filters
 	filterBuilder := &httpFilterBuilder{}
 
-	anyHealthConfig, err := anypb.New(makeHealthConfig())
+	anyHealthConfig, err := newAny(makeHealthConfig())
 	if err != nil {
 		log.Fatalf("failed to marshal healthcheck config struct to typed struct: %s", err)
 	}
@@ -257,7 +412,7 @@ func (c *KubernetesConfigurator) makeConnectionManager(virtualHosts []*route.Vir
 	})
 
 	if c.httpExtAuthz.Cluster != "" {
-		anyExtAuthzConfig, err := anypb.New(makeExtAuthzConfig(c.httpExtAuthz))
+		anyExtAuthzConfig, err := newAny(makeExtAuthzConfig(c.httpExtAuthz))
 		if err != nil {
 			log.Fatalf("failed to marshal extAuthz config struct to typed struct: %s", err)
 		}
@@ -276,7 +431,7 @@ func (c *KubernetesConfigurator) makeConnectionManager(virtualHosts []*route.Vir
 	tracingConfig := &hcm.HttpConnectionManager_Tracing{}
 
 	if c.tracingProvider == "zipkin" {
-		zipkinTracingProvider, err := anypb.New(makeZipkinTracingProvider())
+		zipkinTracingProvider, err := newAny(makeZipkinTracingProvider())
 		if err != nil {
 			log.Fatalf("failed to set zipkin tracing provider config: %s", err)
 		}
@@ -313,10 +468,10 @@ func (c *KubernetesConfigurator) makeConnectionManager(virtualHosts []*route.Vir
 				UpgradeType: "websocket",
 			},
 		},
-		RouteSpecifier: &hcm.HttpConnectionManager_RouteConfig{
-			RouteConfig: &route.RouteConfiguration{
-				Name:         "local_route",
-				VirtualHosts: virtualHosts,
+		RouteSpecifier: &hcm.HttpConnectionManager_Rds{
+			Rds: &hcm.Rds{
+				RouteConfigName: routeConfigName,
+				ConfigSource:    makeAdsConfigSource(),
 			},
 		},
 		Tracing:          tracingConfig,
@@ -325,47 +480,40 @@ func (c *KubernetesConfigurator) makeConnectionManager(virtualHosts []*route.Vir
 	}, nil
 }
 
-func (c *KubernetesConfigurator) makeFilterChain(certificate Certificate, virtualHosts []*route.VirtualHost) (listener.FilterChain, error) {
-	httpConnectionManager, err := c.makeConnectionManager(virtualHosts)
+func (c *KubernetesConfigurator) makeFilterChain(hosts []string, secretName string, routeConfigName string) (listener.FilterChain, error) {
+	httpConnectionManager, err := c.makeConnectionManager(routeConfigName)
 	if err != nil {
 		return listener.FilterChain{}, fmt.Errorf("failed to get httpConnectionManager: %s", err)
 	}
-	anyHttpConfig, err := anypb.New(httpConnectionManager)
+	anyHttpConfig, err := newAny(httpConnectionManager)
 	if err != nil {
 		return listener.FilterChain{}, fmt.Errorf("failed to marshal HTTP config struct to typed struct: %s", err)
 	}
 
 	tls := &auth.DownstreamTlsContext{}
 	tls.CommonTlsContext = &auth.CommonTlsContext{
-		TlsCertificates: []*auth.TlsCertificate{
-			{
-				CertificateChain: &core.DataSource{
-					Specifier: &core.DataSource_InlineString{InlineString: certificate.Cert},
-				},
-				PrivateKey: &core.DataSource{
-					Specifier: &core.DataSource_InlineString{InlineString: certificate.Key},
-				},
-			},
+		TlsCertificateSdsSecretConfigs: []*auth.SdsSecretConfig{
+			makeSdsSecretConfig(secretName),
 		},
 	}
 
-	anyTls, err := anypb.New(tls)
+	anyTls, err := newAny(tls)
 	if err != nil {
 		return listener.FilterChain{}, fmt.Errorf("failed to marshal TLS config struct to typed struct: %s", err)
 	}
 
 	filterChainMatch := &listener.FilterChainMatch{}
 
-	hosts := []string{}
+	serverNames := []string{}
 
-	for _, host := range certificate.Hosts {
+	for _, host := range hosts {
 		if host != "*" {
-			hosts = append(hosts, host)
+			serverNames = append(serverNames, host)
 		}
 	}
 
-	if len(hosts) > 0 {
-		filterChainMatch.ServerNames = hosts
+	if len(serverNames) > 0 {
+		filterChainMatch.ServerNames = serverNames
 	}
 
 	return listener.FilterChain{
@@ -383,8 +531,47 @@ func (c *KubernetesConfigurator) makeFilterChain(certificate Certificate, virtua
 	}, nil
 }
 
+// makeAdsConfigSource points envoy at the resources yggdrasil serves over ADS
+func makeAdsConfigSource() *core.ConfigSource {
+	return &core.ConfigSource{
+		ResourceApiVersion:    core.ApiVersion_V3,
+		ConfigSourceSpecifier: &core.ConfigSource_Ads{Ads: &core.AggregatedConfigSource{}},
+	}
+}
+
+// makeSdsSecretConfig references a secret served by yggdrasil over ADS
+func makeSdsSecretConfig(name string) *auth.SdsSecretConfig {
+	return &auth.SdsSecretConfig{
+		Name:      name,
+		SdsConfig: makeAdsConfigSource(),
+	}
+}
+
+func makeRouteConfiguration(name string, virtualHosts []*route.VirtualHost) *route.RouteConfiguration {
+	return &route.RouteConfiguration{
+		Name:         name,
+		VirtualHosts: virtualHosts,
+	}
+}
+
+func makeSecret(name string, cert string, key string) *auth.Secret {
+	return &auth.Secret{
+		Name: name,
+		Type: &auth.Secret_TlsCertificate{
+			TlsCertificate: &auth.TlsCertificate{
+				CertificateChain: &core.DataSource{
+					Specifier: &core.DataSource_InlineString{InlineString: cert},
+				},
+				PrivateKey: &core.DataSource{
+					Specifier: &core.DataSource_InlineString{InlineString: key},
+				},
+			},
+		},
+	}
+}
+
 func makeListener(filterChains []*listener.FilterChain, envoyListenerIpv4Address string, envoyListenPort uint32) (*listener.Listener, error) {
-	tlsInspectorConfig, err := anypb.New(&tlsInspector.TlsInspector{})
+	tlsInspectorConfig, err := newAny(&tlsInspector.TlsInspector{})
 	if err != nil {
 		return &listener.Listener{}, fmt.Errorf("failed to marshal tls_inspector config struct to typed struct: %s", err)
 	}
@@ -422,12 +609,16 @@ func makeAddresses(addresses []LBHost, upstreamPort uint32) []*core.Address {
 
 	envoyAddresses := []*core.Address{}
 	for _, address := range addresses {
+		port := upstreamPort
+		if address.Port != 0 {
+			port = address.Port
+		}
 		envoyAddress := &core.Address{
 			Address: &core.Address_SocketAddress{
 				SocketAddress: &core.SocketAddress{
 					Address: address.Host,
 					PortSpecifier: &core.SocketAddress_PortValue{
-						PortValue: upstreamPort,
+						PortValue: port,
 					},
 				},
 			},
@@ -460,71 +651,162 @@ func makeHealthChecks(upstreamVHost string, healthPath string, config UpstreamHe
 	return healthChecks
 }
 
-func makeCluster(c cluster, ca string, healthCfg UpstreamHealthCheck, outlierPercentage int32, addresses []*core.Address) *v3cluster.Cluster {
+// makeLoadAssignment groups the hosts by the locality of their source cluster. Priorities are
+// renumbered from 0 as envoy expects them, keeping their order
+func makeLoadAssignment(name string, hosts []LBHost, upstreamPort uint32) *endpoint.ClusterLoadAssignment {
+	addresses := makeAddresses(hosts, upstreamPort)
 
-	tls := &auth.UpstreamTlsContext{}
-	if ca != "" {
-		tls.CommonTlsContext = &auth.CommonTlsContext{
-			ValidationContextType: &auth.CommonTlsContext_ValidationContext{
-				ValidationContext: &auth.CertificateValidationContext{
-					TrustedCa: &core.DataSource{
-						Specifier: &core.DataSource_Filename{Filename: ca},
-					},
-				},
-			},
+	localities := []k8s.Locality{}
+	endpointsByLocality := map[k8s.Locality][]*endpoint.LbEndpoint{}
+
+	for idx, address := range addresses {
+		locality := hosts[idx].Locality
+		if _, ok := endpointsByLocality[locality]; !ok {
+			localities = append(localities, locality)
+		}
+		lbEndpoint := &endpoint.LbEndpoint{
+			HostIdentifier:      &endpoint.LbEndpoint_Endpoint{Endpoint: &endpoint.Endpoint{Address: address}},
+			LoadBalancingWeight: &wrappers.UInt32Value{Value: hosts[idx].Weight},
+			Metadata:            makeSourceMetadata(hosts[idx].Source),
 		}
-	} else {
-		tls = nil
+		if hosts[idx].Draining {
+			lbEndpoint.HealthStatus = core.HealthStatus_DRAINING
+		}
+		endpointsByLocality[locality] = append(endpointsByLocality[locality], lbEndpoint)
 	}
 
-	var err error
-	var anyTls *any.Any
+	sort.SliceStable(localities, func(i, j int) bool {
+		if localities[i].Priority != localities[j].Priority {
+			return localities[i].Priority < localities[j].Priority
+		}
+		if localities[i].Region != localities[j].Region {
+			return localities[i].Region < localities[j].Region
+		}
+		return localities[i].Zone < localities[j].Zone
+	})
 
-	if tls != nil {
-		anyTls, err = anypb.New(tls)
-		if err != nil {
-			log.Printf("Error marhsalling cluster TLS config: %s", err)
+	localityEndpoints := []*endpoint.LocalityLbEndpoints{}
+	priority := uint32(0)
+	for idx, locality := range localities {
+		if idx > 0 && locality.Priority != localities[idx-1].Priority {
+			priority++
+		}
+		lbEndpoints := &endpoint.LocalityLbEndpoints{
+			LbEndpoints: endpointsByLocality[locality],
+			Priority:    priority,
 		}
+		if locality.Region != "" || locality.Zone != "" {
+			lbEndpoints.Locality = &core.Locality{Region: locality.Region, Zone: locality.Zone}
+		}
+		localityEndpoints = append(localityEndpoints, lbEndpoints)
+	}
+	if len(localityEndpoints) == 0 {
+		localityEndpoints = append(localityEndpoints, &endpoint.LocalityLbEndpoints{LbEndpoints: []*endpoint.LbEndpoint{}})
 	}
 
-	healthChecks := makeHealthChecks(c.VirtualHost, c.HealthCheckPath, healthCfg)
+	return &endpoint.ClusterLoadAssignment{
+		ClusterName: name,
+		Endpoints:   localityEndpoints,
+	}
+}
 
-	endpoints := make([]*endpoint.LbEndpoint, len(addresses))
+// makeCluster returns a STRICT_DNS cluster for the given load assignment,
+// or an EDS cluster served over ADS when there is none
+func makeCluster(c cluster, ca string, healthCfg UpstreamHealthCheck, outlierPercentage int32, loadAssignment *endpoint.ClusterLoadAssignment) *v3cluster.Cluster {
 
-	for idx, address := range addresses {
-		endpoints[idx] = &endpoint.LbEndpoint{
-			HostIdentifier:      &endpoint.LbEndpoint_Endpoint{Endpoint: &endpoint.Endpoint{Address: address}},
-			LoadBalancingWeight: &wrappers.UInt32Value{Value: c.Hosts[idx].Weight},
-		}
-	}
+	healthChecks := makeHealthChecks(c.VirtualHost, c.HealthCheckPath, healthCfg)
 
 	cluster := &v3cluster.Cluster{
 		ClusterDiscoveryType: &v3cluster.Cluster_Type{Type: v3cluster.Cluster_STRICT_DNS},
 		Name:                 c.Name,
 		ConnectTimeout:       durationpb.New(c.Timeout),
-		LoadAssignment: &endpoint.ClusterLoadAssignment{
-			ClusterName: c.Name,
-			Endpoints: []*endpoint.LocalityLbEndpoints{
-				{LbEndpoints: endpoints},
-			},
-		},
-		HealthChecks: healthChecks,
+		LoadAssignment:       loadAssignment,
+		HealthChecks:         healthChecks,
+	}
+	if loadAssignment == nil {
+		cluster.ClusterDiscoveryType = &v3cluster.Cluster_Type{Type: v3cluster.Cluster_EDS}
+		cluster.EdsClusterConfig = &v3cluster.Cluster_EdsClusterConfig{
+			EdsConfig:   makeAdsConfigSource(),
+			ServiceName: c.Name,
+		}
+	}
+	// envoy sends requests to every host, the draining ones included, once less than half of the hosts are
+	// healthy: the panic mode is disabled while hosts drain so that they only complete their requests
+	for _, host := range c.Hosts {
+		if host.Draining {
+			cluster.CommonLbConfig = &v3cluster.Cluster_CommonLbConfig{HealthyPanicThreshold: &typev3.Percent{Value: 0}}
+			break
+		}
 	}
 	if outlierPercentage >= 0 {
 		cluster.OutlierDetection = &v3cluster.OutlierDetection{
 			MaxEjectionPercent: &wrappers.UInt32Value{Value: uint32(outlierPercentage)},
 		}
 	}
-	if anyTls != nil {
-		cluster.TransportSocket = &core.TransportSocket{
-			Name:       "envoy.transport_sockets.tls",
-			ConfigType: &core.TransportSocket_TypedConfig{TypedConfig: anyTls},
+	if ca != "" {
+		transportSocket, err := makeUpstreamTransportSocket(ca)
+		if err != nil {
+			log.Printf("Error marhsalling cluster TLS config: %s", err)
+		} else {
+			cluster.TransportSocket = transportSocket
 		}
 	}
 
 	return cluster
 }
 
+// makeUpstreamTransportSocket returns a TLS transport socket verifying the upstreams against the given CA
+func makeUpstreamTransportSocket(ca string) (*core.TransportSocket, error) {
+	tls := &auth.UpstreamTlsContext{
+		CommonTlsContext: &auth.CommonTlsContext{
+			ValidationContextType: &auth.CommonTlsContext_ValidationContext{
+				ValidationContext: &auth.CertificateValidationContext{
+					TrustedCa: &core.DataSource{
+						Specifier: &core.DataSource_Filename{Filename: ca},
+					},
+				},
+			},
+		},
+	}
+	anyTls, err := newAny(tls)
+	if err != nil {
+		return nil, err
+	}
+	return &core.TransportSocket{
+		Name:       "envoy.transport_sockets.tls",
+		ConfigType: &core.TransportSocket_TypedConfig{TypedConfig: anyTls},
+	}, nil
+}
+
+// makeSourceTransportSocketMatch returns the transport socket used for the endpoints of a source cluster
+func makeSourceTransportSocketMatch(source, ca string) (*v3cluster.Cluster_TransportSocketMatch, error) {
+	transportSocket, err := makeUpstreamTransportSocket(ca)
+	if err != nil {
+		return nil, err
+	}
+	match, err := structpb.NewStruct(map[string]interface{}{"source": source})
+	if err != nil {
+		return nil, err
+	}
+	return &v3cluster.Cluster_TransportSocketMatch{
+		Name:            source,
+		Match:           match,
+		TransportSocket: transportSocket,
+	}, nil
+}
+
+// makeSourceMetadata tags an endpoint with its source cluster, for stats, logs and transport socket matching
+func makeSourceMetadata(source string) *core.Metadata {
+	if source == "" {
+		return nil
+	}
+	filterMetadata := map[string]*structpb.Struct{}
+	for _, key := range []string{"yggdrasil", "envoy.transport_socket_match"} {
+		filterMetadata[key] = &structpb.Struct{Fields: map[string]*structpb.Value{"source": structpb.NewStringValue(source)}}
+	}
+	return &core.Metadata{FilterMetadata: filterMetadata}
+}
+
 func ValidateEnvoyRetryOn(retryOn string) bool {
 	retryOnList := strings.Split(retryOn, ",")
 
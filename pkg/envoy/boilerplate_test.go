@@ -9,6 +9,8 @@ import (
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	eal "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/file/v3"
 	"github.com/golang/protobuf/ptypes/duration"
+	"github.com/uswitch/yggdrasil/pkg/k8s"
+	v1 "k8s.io/api/core/v1"
 )
 
 func TestMakeHealthChecksEmptyPath(t *testing.T) {
@@ -58,6 +60,171 @@ func TestMakeHealthChecksValidPath(t *testing.T) {
 
 }
 
+func TestMakeVirtualHostRoutes(t *testing.T) {
+	vhost := &virtualHost{
+		Host: "app.com",
+		Routes: []*httpRoute{
+			{Path: "/api/v1", PathType: k8s.PathTypeExact, UpstreamCluster: "app_com_exact_api_v1"},
+			{Path: "/", PathType: k8s.PathTypePrefix, UpstreamCluster: "app_com"},
+		},
+	}
+	envoyVhost, err := makeVirtualHost(vhost, -1, "5xx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(envoyVhost.Routes) != 2 {
+		t.Fatalf("expected 2 routes, got %d", len(envoyVhost.Routes))
+	}
+	if envoyVhost.Routes[0].Match.GetPath() != "/api/v1" || envoyVhost.Routes[0].GetRoute().GetCluster() != "app_com_exact_api_v1" {
+		t.Errorf("expected exact match on /api/v1 first, got %v", envoyVhost.Routes[0])
+	}
+	if envoyVhost.Routes[1].Match.GetPrefix() != "/" || envoyVhost.Routes[1].GetRoute().GetCluster() != "app_com" {
+		t.Errorf("expected catch-all prefix route last, got %v", envoyVhost.Routes[1])
+	}
+}
+
+func TestMakeVirtualHostPrefixMatches(t *testing.T) {
+	apiIngress := newGenericIngress("app.com", "api.cluster.com")
+	apiIngress.RulesPaths = map[string][]*k8s.IngressPath{"app.com": {{Path: "/api/", PathType: k8s.PathTypePrefix}}}
+	apixIngress := newGenericIngress("app.com", "apix.cluster.com")
+	apixIngress.Source = "other"
+	apixIngress.RulesPaths = map[string][]*k8s.IngressPath{"app.com": {{Path: "/apix", PathType: k8s.PathTypeImplementationSpecific}}}
+	c := translateIngresses([]*k8s.Ingress{apiIngress, apixIngress}, false, []*v1.Secret{})
+
+	envoyVhost, err := makeVirtualHost(c.VirtualHosts[0], -1, "5xx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(envoyVhost.Routes) != 2 {
+		t.Fatalf("expected 2 routes, got %d", len(envoyVhost.Routes))
+	}
+	// /apix is left to its own ingress, /api only matches /api and the paths under it
+	if envoyVhost.Routes[0].Match.GetPrefix() != "/apix" {
+		t.Errorf("expected a string prefix match on /apix, got %v", envoyVhost.Routes[0].Match)
+	}
+	if envoyVhost.Routes[1].Match.GetPathSeparatedPrefix() != "/api" {
+		t.Errorf("expected a path separated prefix match on /api, got %v", envoyVhost.Routes[1].Match)
+	}
+}
+
+func TestMakeVirtualHostWeightedClusters(t *testing.T) {
+	vhost := &virtualHost{
+		Host: "app.com",
+		Routes: []*httpRoute{
+			{Path: "/", PathType: k8s.PathTypePrefix, UpstreamCluster: "app_com", WeightedClusters: []weightedCluster{{Name: "app_com_a", Weight: 90}, {Name: "app_com_b", Weight: 10}}},
+		},
+	}
+	envoyVhost, err := makeVirtualHost(vhost, -1, "5xx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	weighted := envoyVhost.Routes[0].GetRoute().GetWeightedClusters()
+	if weighted == nil || len(weighted.Clusters) != 2 || weighted.TotalWeight.GetValue() != 100 {
+		t.Fatalf("expected the requests to be split between two clusters, got %v", envoyVhost.Routes[0].GetRoute())
+	}
+	if weighted.Clusters[0].Name != "app_com_a" || weighted.Clusters[0].Weight.GetValue() != 90 || weighted.Clusters[1].Name != "app_com_b" || weighted.Clusters[1].Weight.GetValue() != 10 {
+		t.Errorf("expected 90%% to app_com_a and 10%% to app_com_b, got %v", weighted.Clusters)
+	}
+}
+
+func TestMakeVirtualHostMirror(t *testing.T) {
+	vhost := &virtualHost{
+		Host:   "app.com",
+		Routes: []*httpRoute{{Path: "/", PathType: k8s.PathTypePrefix, UpstreamCluster: "app_com", Mirror: &routeMirror{Cluster: "app_com_mirror", Percentage: 25}}},
+	}
+	envoyVhost, err := makeVirtualHost(vhost, -1, "5xx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	action := envoyVhost.Routes[0].GetRoute()
+	if action.GetCluster() != "app_com" || len(action.RequestMirrorPolicies) != 1 {
+		t.Fatalf("expected the requests to be served by app_com and mirrored, got %v", action)
+	}
+	policy := action.RequestMirrorPolicies[0]
+	if policy.Cluster != "app_com_mirror" || policy.RuntimeFraction.DefaultValue.Numerator != 25 {
+		t.Errorf("expected 25%% of the requests mirrored to app_com_mirror, got %v", policy)
+	}
+}
+
+func TestMakeVirtualHostRouteFilters(t *testing.T) {
+	vhost := &virtualHost{
+		Host: "app.com",
+		Routes: []*httpRoute{
+			{
+				Path:            "/api",
+				PathType:        k8s.PathTypePrefix,
+				Headers:         []k8s.HeaderMatch{{Name: "x-canary", Value: "true"}},
+				UpstreamCluster: "app_com_prefix_api_00000000",
+				Filters: &k8s.IngressPathFilters{
+					RequestHeadersToSet: []k8s.HTTPHeader{{Name: "x-team", Value: "api"}},
+					Rewrite:             &k8s.IngressRewrite{PrefixReplace: "/"},
+				},
+			},
+			{
+				Path:     "/",
+				PathType: k8s.PathTypePrefix,
+				Filters: &k8s.IngressPathFilters{
+					Redirect: &k8s.IngressRedirect{Scheme: "https", PrefixReplace: "/v2", StatusCode: 301},
+				},
+			},
+		},
+	}
+	envoyVhost, err := makeVirtualHost(vhost, -1, "5xx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := envoyVhost.Routes[0]
+	if len(api.Match.Headers) != 1 || api.Match.Headers[0].Name != "x-canary" {
+		t.Errorf("expected x-canary header match, got %v", api.Match.Headers)
+	}
+	if api.GetRoute().PrefixRewrite != "/" {
+		t.Errorf("expected prefix rewrite to /, got %q", api.GetRoute().PrefixRewrite)
+	}
+	if len(api.RequestHeadersToAdd) != 1 || api.RequestHeadersToAdd[0].Header.Key != "x-team" {
+		t.Errorf("expected x-team request header, got %v", api.RequestHeadersToAdd)
+	}
+
+	redirect := envoyVhost.Routes[1].GetRedirect()
+	if redirect == nil || redirect.GetSchemeRedirect() != "https" || redirect.GetPrefixRewrite() != "/v2" {
+		t.Errorf("expected https redirect replacing the prefix with /v2, got %v", envoyVhost.Routes[1])
+	}
+}
+
+func TestMakeLoadAssignmentLocalities(t *testing.T) {
+	primary := k8s.Locality{Region: "eu-west-1", Zone: "eu-west-1a", Priority: 10}
+	secondary := k8s.Locality{Region: "eu-central-1", Priority: 20}
+	hosts := []LBHost{
+		{Host: "secondary.lb.com", Weight: 1, Locality: secondary},
+		{Host: "primary.lb.com", Weight: 2, Locality: primary},
+		{Host: "other-primary.lb.com", Weight: 1, Locality: primary},
+	}
+
+	assignment := makeLoadAssignment("app_com", hosts, 443)
+
+	if len(assignment.Endpoints) != 2 {
+		t.Fatalf("expected 2 localities, got %d", len(assignment.Endpoints))
+	}
+	first, second := assignment.Endpoints[0], assignment.Endpoints[1]
+	if first.Priority != 0 || first.Locality.GetZone() != "eu-west-1a" || len(first.LbEndpoints) != 2 {
+		t.Errorf("expected the primary locality first with priority 0, got %v", first)
+	}
+	if second.Priority != 1 || second.Locality.GetRegion() != "eu-central-1" || len(second.LbEndpoints) != 1 {
+		t.Errorf("expected the secondary locality with priority 1, got %v", second)
+	}
+}
+
+func TestMakeLoadAssignmentWithoutLocality(t *testing.T) {
+	assignment := makeLoadAssignment("app_com", []LBHost{{Host: "lb.com", Weight: 1}}, 443)
+
+	if len(assignment.Endpoints) != 1 || assignment.Endpoints[0].Locality != nil || assignment.Endpoints[0].Priority != 0 {
+		t.Errorf("expected a single locality without region or zone, got %v", assignment.Endpoints)
+	}
+}
+
 type accessLoggerTestCase struct {
 	name   string
 	format map[string]interface{}
@@ -6,21 +6,34 @@ import (
 )
 
 type EnvoySnapshot struct {
+	Version   string
+	Versions  map[string]string
 	Listeners map[string]types.Resource
 	Clusters  map[string]types.Resource
+	Routes    map[string]types.Resource
 }
 
-func (s *Snapshotter) ConfigDump() (EnvoySnapshot, error) {
-	snapshot, err := s.CurrentSnapshot()
+// ConfigDump returns the current snapshot of a node group, or of the default nodes when empty
+func (s *Snapshotter) ConfigDump(nodeID string) (EnvoySnapshot, error) {
+	snapshot, err := s.NodeSnapshot(nodeID)
 	if err != nil {
 		return EnvoySnapshot{}, err
 	}
 
 	listeners := snapshot.GetResources(resource.ListenerType)
 	clusters := snapshot.GetResources(resource.ClusterType)
+	routes := snapshot.GetResources(resource.RouteType)
+
+	versions := map[string]string{}
+	for _, typeURL := range []string{resource.ListenerType, resource.ClusterType, resource.RouteType, resource.EndpointType, resource.SecretType} {
+		versions[typeURL] = snapshot.GetVersion(typeURL)
+	}
 
 	return EnvoySnapshot{
+		Version:   snapshotVersion(snapshot),
+		Versions:  versions,
 		Listeners: listeners,
 		Clusters:  clusters,
+		Routes:    routes,
 	}, nil
 }
@@ -2,18 +2,24 @@ package envoy
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	v3cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
 	tcache "github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"github.com/uswitch/yggdrasil/pkg/k8s"
-	"google.golang.org/protobuf/types/known/anypb"
 	v1 "k8s.io/api/core/v1"
 )
 
@@ -51,9 +57,20 @@ type AccessLogger struct {
 	Format map[string]interface{} `json:"format"`
 }
 
+// SourceOptions overrides the upstream settings for the ingresses of a source cluster
+type SourceOptions struct {
+	// WeightMultiplier multiplies the weight of the upstreams, when set
+	WeightMultiplier uint32
+	// UpstreamPort replaces the upstream port, when set
+	UpstreamPort uint32
+	// TrustCA replaces the CA used to verify the upstreams, when set
+	TrustCA string
+}
+
 // KubernetesConfigurator takes a given Ingress Class and lister to find only ingresses of that class
 type KubernetesConfigurator struct {
 	ingressClasses             []string
+	gatewayClasses             []string
 	internalCidrRanges         []string
 	nodeID                     string
 	syncSecrets                bool
@@ -71,16 +88,27 @@ type KubernetesConfigurator struct {
 	accessLogger               AccessLogger
 	defaultRetryOn             string
 	tracingProvider            string
-
-	previousConfig  *envoyConfiguration
-	listenerVersion string
-	clusterVersion  string
+	endpointDiscovery          bool
+	resolver                   Resolver
+	sourceOptions              map[string]SourceOptions
+	upstreamGracePeriod        time.Duration
+
+	// upstreams are the upstreams of the last published snapshot, pendingUpstreams the ones of the snapshot
+	// of version pendingVersion, committed once it is published
+	upstreams        upstreamState
+	pendingUpstreams *upstreamState
+	pendingVersion   string
+	resolvedHosts    map[string][]string
+	versions         map[tcache.ResponseType]string
+	ingressErrors    []IngressError
+	ingressSources   map[string]int
 	sync.Mutex
 }
 
 // NewKubernetesConfigurator returns a Kubernetes configurator given a lister and ingress class
 func NewKubernetesConfigurator(nodeID string, certificates []Certificate, ca string, ingressClasses []string, internalCidrRanges []string, options ...option) *KubernetesConfigurator {
-	c := &KubernetesConfigurator{ingressClasses: ingressClasses, nodeID: nodeID, certificates: certificates, trustCA: ca, internalCidrRanges: internalCidrRanges}
+	c := &KubernetesConfigurator{ingressClasses: ingressClasses, nodeID: nodeID, certificates: certificates, trustCA: ca, internalCidrRanges: internalCidrRanges, resolver: net.DefaultResolver, versions: map[tcache.ResponseType]string{},
+		upstreams: upstreamState{active: map[string]upstreamRef{}, draining: map[string]drainingUpstream{}}}
 	for _, opt := range options {
 		opt(c)
 	}
@@ -92,40 +120,148 @@ func (c *KubernetesConfigurator) Generate(ingresses []*k8s.Ingress, secrets []*v
 	c.Lock()
 	defer c.Unlock()
 
-	validIngresses := validIngressFilter(classFilter(ingresses, c.ingressClasses))
-	config := translateIngresses(validIngresses, c.syncSecrets, secrets)
-
-	vmatch, cmatch := config.equals(c.previousConfig)
-
-	clusters := c.generateClusters(config)
-	listeners, err := c.generateListeners(config)
+	matchedIngresses := append(classFilter(ingresses, c.ingressClasses), gatewayClassFilter(ingresses, c.gatewayClasses)...)
+	matchingIngresses.WithLabelValues(c.nodeID).Set(float64(len(matchedIngresses)))
+	c.setSourceIngresses(matchedIngresses)
+	c.pendingVersion = ""
+	validIngresses := c.drainRemovedUpstreams(validIngressFilter(matchedIngresses), time.Now())
+	config, listeners, routes, err := c.generateWithoutRejected(validIngresses, secrets)
 	if err != nil {
 		return cache.Snapshot{}, err
 	}
+	numVhosts.WithLabelValues(c.nodeID).Set(float64(len(config.VirtualHosts)))
+	numClusters.WithLabelValues(c.nodeID).Set(float64(len(config.Clusters)))
 
-	if !vmatch {
-		c.listenerVersion = time.Now().String()
-		listenerUpdates.Inc()
-	}
+	clusters := c.generateClusters(config)
+	tlsSecrets := c.generateSecrets(config)
+	c.setIngressErrors(config.IngressErrors)
 
-	if !cmatch {
-		c.clusterVersion = time.Now().String()
-		clusterUpdates.Inc()
+	var endpoints []tcache.Resource
+	if c.endpointDiscovery {
+		endpoints = c.generateEndpoints(config)
 	}
-	c.previousConfig = config
 
 	snap := cache.Snapshot{}
-	snap.Resources[tcache.Cluster] = cache.NewResources(c.clusterVersion, []tcache.Resource(clusters))
-	snap.Resources[tcache.Listener] = cache.NewResources(c.listenerVersion, []tcache.Resource(listeners))
+	for _, r := range []struct {
+		responseType tcache.ResponseType
+		resources    []tcache.Resource
+		updates      *prometheus.CounterVec
+	}{
+		{tcache.Cluster, clusters, clusterUpdates},
+		{tcache.Endpoint, endpoints, endpointUpdates},
+		{tcache.Listener, listeners, listenerUpdates},
+		{tcache.Route, routes, routeUpdates},
+		{tcache.Secret, tlsSecrets, secretUpdates},
+	} {
+		version, err := resourcesVersion(r.resources)
+		if err != nil {
+			return cache.Snapshot{}, fmt.Errorf("failed to hash resources: %s", err)
+		}
+		if version != c.versions[r.responseType] {
+			r.updates.WithLabelValues(c.nodeID).Inc()
+		}
+		c.versions[r.responseType] = version
+		snap.Resources[r.responseType] = cache.NewResources(version, r.resources)
+	}
+	c.pendingVersion = snapshotVersion(&snap)
 	return snap, nil
 }
 
+// Published commits the state of the last generated snapshot once the snapshot of the given version is published
+func (c *KubernetesConfigurator) Published(version string) {
+	c.Lock()
+	defer c.Unlock()
+	if version == c.pendingVersion {
+		c.publishedUpstreams()
+	}
+}
+
+// generateWithoutRejected translates the ingresses and generates the listeners, translating them again without
+// the ingresses a virtual host failed to be generated with, so that the rest of the host is kept
+func (c *KubernetesConfigurator) generateWithoutRejected(ingresses []*k8s.Ingress, secrets []*v1.Secret) (*envoyConfiguration, []tcache.Resource, []tcache.Resource, error) {
+	excluded := map[string]map[*k8s.Ingress]bool{}
+	rejectionErrors := []IngressError{}
+	for {
+		config := translateIngressesExcluding(ingresses, c.syncSecrets, secrets, excluded)
+		listeners, routes, err := c.generateListeners(config)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		// every rejected ingress is excluded from its host, so that the hosts run out of ingresses to reject
+		if len(config.rejected) == 0 {
+			config.IngressErrors = append(config.IngressErrors, rejectionErrors...)
+			return config, listeners, routes, nil
+		}
+		for _, rejection := range config.rejected {
+			if excluded[rejection.host] == nil {
+				excluded[rejection.host] = map[*k8s.Ingress]bool{}
+			}
+			excluded[rejection.host][rejection.ingress] = true
+			rejectionErrors = append(rejectionErrors, newIngressError(rejection.ingress, rejection.host, rejection.err))
+		}
+	}
+}
+
+// IngressErrors returns the ingresses left out of the last generated snapshot and why
+func (c *KubernetesConfigurator) IngressErrors() []IngressError {
+	c.Lock()
+	defer c.Unlock()
+	return append([]IngressError{}, c.ingressErrors...)
+}
+
+// setSourceIngresses reports the number of matching ingresses of each source cluster
+func (c *KubernetesConfigurator) setSourceIngresses(ingresses []*k8s.Ingress) {
+	counts := map[string]int{}
+	for _, ingress := range ingresses {
+		counts[ingress.Source]++
+	}
+	// the metric is shared with the configurators of the other node groups, only the series of this one are replaced
+	for source := range c.ingressSources {
+		if _, ok := counts[source]; !ok {
+			sourceIngresses.DeleteLabelValues(c.nodeID, source)
+		}
+	}
+	c.ingressSources = counts
+	for source, count := range counts {
+		sourceIngresses.WithLabelValues(c.nodeID, source).Set(float64(count))
+	}
+}
+
+func (c *KubernetesConfigurator) setIngressErrors(ingressErrors []IngressError) {
+	sort.SliceStable(ingressErrors, func(i, j int) bool {
+		if ingressErrors[i].Namespace != ingressErrors[j].Namespace {
+			return ingressErrors[i].Namespace < ingressErrors[j].Namespace
+		}
+		if ingressErrors[i].Name != ingressErrors[j].Name {
+			return ingressErrors[i].Name < ingressErrors[j].Name
+		}
+		return ingressErrors[i].Host < ingressErrors[j].Host
+	})
+	// the metric is shared with the configurators of the other node groups, only the series of this one are replaced
+	for _, ingressError := range c.ingressErrors {
+		rejectedIngresses.DeleteLabelValues(c.nodeID, ingressError.Namespace, ingressError.Name, ingressError.Source)
+	}
+	c.ingressErrors = ingressErrors
+	for _, ingressError := range ingressErrors {
+		rejectedIngresses.WithLabelValues(c.nodeID, ingressError.Namespace, ingressError.Name, ingressError.Source).Set(1)
+	}
+}
+
 // NodeID returns the NodeID
 func (c *KubernetesConfigurator) NodeID() string {
 	return c.nodeID
 
 }
 
+// defaultRouteName is the route configuration of the filter chain serving the virtual hosts without
+// a certificate of their own
+const defaultRouteName = "local_route"
+
+// certificateSecretName is the SDS secret name of a configured certificate
+func certificateSecretName(idx int) string {
+	return fmt.Sprintf("certificate_%d", idx)
+}
+
 var errNoCertificateMatch = errors.New("no certificate match")
 
 func compareHosts(pattern, host string) bool {
@@ -163,34 +299,36 @@ func (c *KubernetesConfigurator) matchCertificateIndices(virtualHost *virtualHos
 	return []int{}, errNoCertificateMatch
 }
 
-func (c *KubernetesConfigurator) generateListeners(config *envoyConfiguration) ([]tcache.Resource, error) {
+func (c *KubernetesConfigurator) generateListeners(config *envoyConfiguration) ([]tcache.Resource, []tcache.Resource, error) {
 	var filterChains []*listener.FilterChain
+	var routes []tcache.Resource
 	var err error
 	if c.syncSecrets {
-		filterChains, err = c.generateDynamicTLSFilterChains(config)
+		filterChains, routes, err = c.generateDynamicTLSFilterChains(config)
 	} else if len(c.certificates) > 0 {
-		filterChains, err = c.generateTLSFilterChains(config)
+		filterChains, routes, err = c.generateTLSFilterChains(config)
 	} else {
-		filterChains, err = c.generateHTTPFilterChain(config)
+		filterChains, routes, err = c.generateHTTPFilterChain(config)
 	}
 	if err != nil {
-		return []tcache.Resource{}, err
+		return []tcache.Resource{}, []tcache.Resource{}, err
 	}
 	listener, err := makeListener(filterChains, c.envoyListenerIpv4Address, c.envoyListenPort)
-	return []tcache.Resource{listener}, err
+	return []tcache.Resource{listener}, routes, err
 }
 
-func (c *KubernetesConfigurator) generateDynamicTLSFilterChains(config *envoyConfiguration) ([]*listener.FilterChain, error) {
+func (c *KubernetesConfigurator) generateDynamicTLSFilterChains(config *envoyConfiguration) ([]*listener.FilterChain, []tcache.Resource, error) {
 	filterChains := []*listener.FilterChain{}
+	routes := []tcache.Resource{}
 
 	allVhosts := []*route.VirtualHost{}
 
 	for _, virtualHost := range config.VirtualHosts {
 		envoyVhost, err := makeVirtualHost(virtualHost, c.hostSelectionRetryAttempts, c.defaultRetryOn)
 		if err != nil {
-			return nil, err
+			config.rejectIngresses(virtualHost, offendingIngresses(virtualHost, c.hostSelectionRetryAttempts, c.defaultRetryOn), err)
+			continue
 		}
-		allVhosts = append(allVhosts, envoyVhost)
 
 		if virtualHost.TlsCert == "" || virtualHost.TlsKey == "" {
 			if len(c.certificates) == 0 {
@@ -198,51 +336,48 @@ func (c *KubernetesConfigurator) generateDynamicTLSFilterChains(config *envoyCon
 			} else {
 				logrus.Infof("using default certificate for %s", virtualHost.Host)
 			}
+			allVhosts = append(allVhosts, envoyVhost)
 			continue
 		}
-		certificate := Certificate{
-			Hosts: []string{virtualHost.Host},
-			Cert:  virtualHost.TlsCert,
-			Key:   virtualHost.TlsKey,
-		}
-		filterChain, err := c.makeFilterChain(certificate, []*route.VirtualHost{envoyVhost})
+		// a host with its own certificate is only served by its filter chain and route configuration, so that
+		// changing it does not change the route configuration of the other hosts
+		filterChain, err := c.makeFilterChain([]string{virtualHost.Host}, virtualHost.TlsSecret, virtualHost.Host)
 		if err != nil {
-			logrus.Warnf("error making filter chain: %v", err)
+			config.rejectIngresses(virtualHost, []*k8s.Ingress{virtualHost.tlsIngress}, fmt.Errorf("error making filter chain: %s", err))
+			continue
 		}
 		filterChains = append(filterChains, &filterChain)
+		routes = append(routes, makeRouteConfiguration(virtualHost.Host, []*route.VirtualHost{envoyVhost}))
 	}
 
 	if len(c.certificates) == 1 {
-		defaultCert := Certificate{
-			Hosts: []string{"*"},
-			Cert:  c.certificates[0].Cert,
-			Key:   c.certificates[0].Key,
-		}
-		if defaultFC, err := c.makeFilterChain(defaultCert, allVhosts); err != nil {
+		if defaultFC, err := c.makeFilterChain([]string{"*"}, certificateSecretName(0), defaultRouteName); err != nil {
 			logrus.Warnf("error making default filter chain: %v", err)
 		} else {
 			filterChains = append(filterChains, &defaultFC)
+			routes = append(routes, makeRouteConfiguration(defaultRouteName, allVhosts))
 		}
 	}
 
-	return filterChains, nil
+	return filterChains, routes, nil
 }
 
-func (c *KubernetesConfigurator) generateHTTPFilterChain(config *envoyConfiguration) ([]*listener.FilterChain, error) {
+func (c *KubernetesConfigurator) generateHTTPFilterChain(config *envoyConfiguration) ([]*listener.FilterChain, []tcache.Resource, error) {
 	virtualHosts := []*route.VirtualHost{}
 	for _, virtualHost := range config.VirtualHosts {
 		vhost, err := makeVirtualHost(virtualHost, c.hostSelectionRetryAttempts, c.defaultRetryOn)
 		if err != nil {
-			return nil, err
+			config.rejectIngresses(virtualHost, offendingIngresses(virtualHost, c.hostSelectionRetryAttempts, c.defaultRetryOn), err)
+			continue
 		}
 		virtualHosts = append(virtualHosts, vhost)
 	}
 
-	httpConnectionManager, err := c.makeConnectionManager(virtualHosts)
+	httpConnectionManager, err := c.makeConnectionManager(defaultRouteName)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	anyHttpConfig, err := anypb.New(httpConnectionManager)
+	anyHttpConfig, err := newAny(httpConnectionManager)
 	if err != nil {
 		log.Fatalf("failed to marshal HTTP config struct to typed struct: %s", err)
 	}
@@ -255,28 +390,30 @@ func (c *KubernetesConfigurator) generateHTTPFilterChain(config *envoyConfigurat
 				},
 			},
 		},
-	}, nil
+	}, []tcache.Resource{makeRouteConfiguration(defaultRouteName, virtualHosts)}, nil
 }
 
-func (c *KubernetesConfigurator) generateTLSFilterChains(config *envoyConfiguration) ([]*listener.FilterChain, error) {
+func (c *KubernetesConfigurator) generateTLSFilterChains(config *envoyConfiguration) ([]*listener.FilterChain, []tcache.Resource, error) {
 	virtualHostsForCertificates := make([][]*route.VirtualHost, len(c.certificates))
 
 	for _, virtualHost := range config.VirtualHosts {
 		certificateIndicies, err := c.matchCertificateIndices(virtualHost)
 		if err != nil {
 			log.Printf("error matching certificate for '%s': %v", virtualHost.Host, err)
-		} else {
-			for _, idx := range certificateIndicies {
-				vhost, err := makeVirtualHost(virtualHost, c.hostSelectionRetryAttempts, c.defaultRetryOn)
-				if err != nil {
-					return nil, err
-				}
-				virtualHostsForCertificates[idx] = append(virtualHostsForCertificates[idx], vhost)
-			}
+			continue
+		}
+		vhost, err := makeVirtualHost(virtualHost, c.hostSelectionRetryAttempts, c.defaultRetryOn)
+		if err != nil {
+			config.rejectIngresses(virtualHost, offendingIngresses(virtualHost, c.hostSelectionRetryAttempts, c.defaultRetryOn), err)
+			continue
+		}
+		for _, idx := range certificateIndicies {
+			virtualHostsForCertificates[idx] = append(virtualHostsForCertificates[idx], vhost)
 		}
 	}
 
 	filterChains := []*listener.FilterChain{}
+	routes := []tcache.Resource{}
 	for idx, certificate := range c.certificates {
 		virtualHosts := virtualHostsForCertificates[idx]
 
@@ -284,24 +421,137 @@ func (c *KubernetesConfigurator) generateTLSFilterChains(config *envoyConfigurat
 			continue
 		}
 
-		filterChain, err := c.makeFilterChain(certificate, virtualHosts)
+		filterChain, err := c.makeFilterChain(certificate.Hosts, certificateSecretName(idx), certificateSecretName(idx))
 		if err != nil {
-			log.Printf("error making filter chain: %v", err)
+			log.Printf("error making filter chain of certificate %d, leaving out its hosts: %v", idx, err)
+			continue
 		}
 
 		filterChains = append(filterChains, &filterChain)
+		routes = append(routes, makeRouteConfiguration(certificateSecretName(idx), virtualHosts))
 	}
-	return filterChains, nil
+	return filterChains, routes, nil
 }
 
 func (c *KubernetesConfigurator) generateClusters(config *envoyConfiguration) []tcache.Resource {
 	clusters := []tcache.Resource{}
 
 	for _, cluster := range config.Clusters {
-		addresses := makeAddresses(cluster.Hosts, c.upstreamPort)
-		cluster := makeCluster(*cluster, c.trustCA, c.upstreamHealthCheck, c.outlierPercentage, addresses)
-		clusters = append(clusters, cluster)
+		var loadAssignment *endpoint.ClusterLoadAssignment
+		if !c.endpointDiscovery {
+			loadAssignment = makeLoadAssignment(cluster.Name, c.sourceHosts(cluster.Hosts), c.upstreamPort)
+		}
+		envoyCluster := makeCluster(*cluster, c.trustCA, c.upstreamHealthCheck, c.outlierPercentage, loadAssignment)
+		envoyCluster.TransportSocketMatches = c.sourceTransportSocketMatches(cluster.Hosts)
+		clusters = append(clusters, envoyCluster)
 	}
 
 	return clusters
 }
+
+// sourceHosts applies the weight multiplier and upstream port of their source cluster to the hosts
+func (c *KubernetesConfigurator) sourceHosts(hosts []LBHost) []LBHost {
+	if len(c.sourceOptions) == 0 {
+		return hosts
+	}
+	sourced := make([]LBHost, 0, len(hosts))
+	for _, host := range hosts {
+		options := c.sourceOptions[host.Source]
+		if options.WeightMultiplier > 0 {
+			host.Weight *= options.WeightMultiplier
+		}
+		if options.UpstreamPort > 0 {
+			host.Port = options.UpstreamPort
+		}
+		sourced = append(sourced, host)
+	}
+	return sourced
+}
+
+// sourceTransportSocketMatches returns a transport socket for each source cluster of the hosts with its own CA,
+// the endpoints select them through their envoy.transport_socket_match metadata
+func (c *KubernetesConfigurator) sourceTransportSocketMatches(hosts []LBHost) []*v3cluster.Cluster_TransportSocketMatch {
+	sources := []string{}
+	seen := map[string]bool{}
+	for _, host := range hosts {
+		if seen[host.Source] || c.sourceOptions[host.Source].TrustCA == "" {
+			continue
+		}
+		seen[host.Source] = true
+		sources = append(sources, host.Source)
+	}
+	sort.Strings(sources)
+
+	var matches []*v3cluster.Cluster_TransportSocketMatch
+	for _, source := range sources {
+		match, err := makeSourceTransportSocketMatch(source, c.sourceOptions[source].TrustCA)
+		if err != nil {
+			logrus.Warnf("error making transport socket of cluster %s: %v", source, err)
+			continue
+		}
+		matches = append(matches, match)
+	}
+	return matches
+}
+
+// generateEndpoints resolves the upstream hostnames of every cluster into its load assignment
+func (c *KubernetesConfigurator) generateEndpoints(config *envoyConfiguration) []tcache.Resource {
+	hostnames := []string{}
+	for _, cluster := range config.Clusters {
+		for _, host := range cluster.Hosts {
+			hostnames = append(hostnames, host.Host)
+		}
+	}
+	addresses := c.resolveHosts(hostnames)
+
+	endpoints := []tcache.Resource{}
+	for _, cluster := range config.Clusters {
+		hosts := []LBHost{}
+		for _, host := range cluster.Hosts {
+			for _, address := range addresses[host.Host] {
+				hosts = append(hosts, LBHost{Host: address, Weight: host.Weight, Locality: host.Locality, Source: host.Source, Draining: host.Draining})
+			}
+		}
+		sort.Slice(hosts, func(i, j int) bool {
+			return hosts[i].Host < hosts[j].Host
+		})
+		endpoints = append(endpoints, makeLoadAssignment(cluster.Name, c.sourceHosts(hosts), c.upstreamPort))
+	}
+
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return endpoints[i].(*endpoint.ClusterLoadAssignment).ClusterName < endpoints[j].(*endpoint.ClusterLoadAssignment).ClusterName
+	})
+
+	return endpoints
+}
+
+// generateSecrets returns the configured certificates and the synced tls secrets
+// referenced by the filter chains, sorted by name
+func (c *KubernetesConfigurator) generateSecrets(config *envoyConfiguration) []tcache.Resource {
+	secrets := []tcache.Resource{}
+	seen := map[string]bool{}
+
+	for idx, certificate := range c.certificates {
+		secrets = append(secrets, makeSecret(certificateSecretName(idx), certificate.Cert, certificate.Key))
+	}
+
+	if c.syncSecrets {
+		for _, virtualHost := range config.VirtualHosts {
+			if virtualHost.TlsSecret == "" {
+				continue
+			}
+			// the secrets are named after their source cluster, the hosts sharing one share its content
+			if seen[virtualHost.TlsSecret] {
+				continue
+			}
+			seen[virtualHost.TlsSecret] = true
+			secrets = append(secrets, makeSecret(virtualHost.TlsSecret, virtualHost.TlsCert, virtualHost.TlsKey))
+		}
+	}
+
+	sort.SliceStable(secrets, func(i, j int) bool {
+		return secrets[i].(*auth.Secret).Name < secrets[j].(*auth.Secret).Name
+	})
+
+	return secrets
+}
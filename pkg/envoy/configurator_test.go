@@ -4,14 +4,20 @@ import (
 	"testing"
 	"time"
 
+	v3cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
 	tcache "github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/uswitch/yggdrasil/pkg/k8s"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func assertNumberOfVirtualHosts(t *testing.T, filterChain *listener.FilterChain, expected int) {
+func assertNumberOfVirtualHosts(t *testing.T, filterChain *listener.FilterChain, routes map[string]tcache.ResourceWithTTL, expected int) {
 	filter, err := filterChain.Filters[0].GetTypedConfig().UnmarshalNew()
 	if err != nil {
 		t.Fatal(err)
@@ -22,8 +28,12 @@ func assertNumberOfVirtualHosts(t *testing.T, filterChain *listener.FilterChain,
 		t.Fatal(err)
 	}
 
-	routeSpecifier := connManager.RouteSpecifier.(*hcm.HttpConnectionManager_RouteConfig)
-	virtualHosts := routeSpecifier.RouteConfig.VirtualHosts
+	routeSpecifier := connManager.RouteSpecifier.(*hcm.HttpConnectionManager_Rds)
+	routeConfig, ok := routes[routeSpecifier.Rds.RouteConfigName]
+	if !ok {
+		t.Fatalf("route configuration %s not found", routeSpecifier.Rds.RouteConfigName)
+	}
+	virtualHosts := routeConfig.Resource.(*route.RouteConfiguration).VirtualHosts
 
 	if len(virtualHosts) != expected {
 		t.Fatalf("Num virtual hosts: %d expected %d", len(virtualHosts), expected)
@@ -86,8 +96,8 @@ func TestGenerateMultipleCerts(t *testing.T) {
 		t.Fatalf("Num filter chains: %d expected %d", len(listener.FilterChains), 2)
 	}
 
-	assertNumberOfVirtualHosts(t, listener.FilterChains[0], 1)
-	assertNumberOfVirtualHosts(t, listener.FilterChains[1], 1)
+	assertNumberOfVirtualHosts(t, listener.FilterChains[0], snapshot.Resources[tcache.Route].Items, 1)
+	assertNumberOfVirtualHosts(t, listener.FilterChains[1], snapshot.Resources[tcache.Route].Items, 1)
 }
 
 func TestGenerateMultipleHosts(t *testing.T) {
@@ -112,7 +122,7 @@ func TestGenerateMultipleHosts(t *testing.T) {
 	}
 
 	// there should be two virtual hosts on the filter chain
-	assertNumberOfVirtualHosts(t, listener.FilterChains[0], 2)
+	assertNumberOfVirtualHosts(t, listener.FilterChains[0], snapshot.Resources[tcache.Route].Items, 2)
 }
 
 func TestGenerateNoMatchingCert(t *testing.T) {
@@ -158,10 +168,10 @@ func TestGenerateIntoTwoCerts(t *testing.T) {
 		t.Fatalf("Num filter chains: %d expected %d", len(listener.FilterChains), 2)
 	}
 
-	assertNumberOfVirtualHosts(t, listener.FilterChains[0], 1)
+	assertNumberOfVirtualHosts(t, listener.FilterChains[0], snapshot.Resources[tcache.Route].Items, 1)
 	assertServerNames(t, listener.FilterChains[0], []string{"*.internal.api.com"})
 
-	assertNumberOfVirtualHosts(t, listener.FilterChains[1], 1)
+	assertNumberOfVirtualHosts(t, listener.FilterChains[1], snapshot.Resources[tcache.Route].Items, 1)
 	assertServerNames(t, listener.FilterChains[1], nil)
 }
 
@@ -219,7 +229,7 @@ func TestGenerateListeners(t *testing.T) {
 	for _, tc := range testcases {
 		t.Run(tc.name, func(t *testing.T) {
 			configurator := NewKubernetesConfigurator("a", tc.certs, "", nil, []string{})
-			ret, err := configurator.generateListeners(&envoyConfiguration{VirtualHosts: tc.virtualHost})
+			ret, routes, err := configurator.generateListeners(&envoyConfiguration{VirtualHosts: tc.virtualHost})
 			if err != nil {
 				t.Fatalf("Error generating listeners %v", err)
 			}
@@ -227,7 +237,7 @@ func TestGenerateListeners(t *testing.T) {
 			if len(listener.FilterChains) != 1 {
 				t.Fatalf("filterchain number missmatch")
 			}
-			assertNumberOfVirtualHosts(t, listener.FilterChains[0], 2)
+			assertNumberOfVirtualHosts(t, listener.FilterChains[0], cache.NewResources("", routes).Items, 2)
 			if len(tc.certs) > 0 {
 				if listener.FilterChains[0].FilterChainMatch == nil {
 					t.Fatalf("Expected filter chain")
@@ -236,3 +246,345 @@ func TestGenerateListeners(t *testing.T) {
 		})
 	}
 }
+
+func assertSdsSecretName(t *testing.T, filterChain *listener.FilterChain, expected string) {
+	transportSocket, err := filterChain.TransportSocket.GetTypedConfig().UnmarshalNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tls := transportSocket.(*auth.DownstreamTlsContext)
+	if len(tls.CommonTlsContext.TlsCertificates) != 0 {
+		t.Errorf("expected no inlined certificate")
+	}
+	sdsConfigs := tls.CommonTlsContext.TlsCertificateSdsSecretConfigs
+	if len(sdsConfigs) != 1 || sdsConfigs[0].Name != expected {
+		t.Errorf("expected filter chain to reference secret %s, got %v", expected, sdsConfigs)
+	}
+}
+
+func TestGenerateCertificateSecrets(t *testing.T) {
+	ingresses := []*k8s.Ingress{
+		newGenericIngress("foo.internal.api.com", "bibble"),
+	}
+
+	configurator := NewKubernetesConfigurator("a", []Certificate{
+		{Hosts: []string{"*.internal.api.com"}, Cert: "com", Key: "com"},
+		{Hosts: []string{"*"}, Cert: "all", Key: "all"},
+	}, "d", []string{"bar"}, []string{"192.168.0.0/16"})
+
+	snapshot, err := configurator.Generate(ingresses, []*v1.Secret{})
+	if err != nil {
+		t.Fatalf("Error generating snapshot %v", err)
+	}
+
+	secrets := snapshot.Resources[tcache.Secret].Items
+	if len(secrets) != 2 {
+		t.Fatalf("Num secrets: %d expected %d", len(secrets), 2)
+	}
+	secret := secrets["certificate_1"].Resource.(*auth.Secret)
+	if secret.GetTlsCertificate().GetPrivateKey().GetInlineString() != "all" {
+		t.Errorf("expected certificate_1 to hold the key of the second certificate")
+	}
+
+	listener := snapshot.Resources[tcache.Listener].Items["listener_0"].Resource.(*listener.Listener)
+	assertSdsSecretName(t, listener.FilterChains[0], "certificate_0")
+	assertSdsSecretName(t, listener.FilterChains[1], "certificate_1")
+}
+
+func TestGenerateSyncedSecretRotation(t *testing.T) {
+	ingress := newGenericIngress("foo.app.com", "bibble")
+	ingress.Namespace = "ns"
+	ingress.TLS = map[string]*k8s.IngressTLS{
+		"foo.app.com": {Host: "foo.app.com", SecretName: "foo-tls"},
+	}
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "foo-tls"},
+		Data:       map[string][]byte{"tls.crt": []byte(p256crt), "tls.key": []byte(p256key)},
+	}
+
+	configurator := NewKubernetesConfigurator("a", nil, "d", []string{"bar"}, []string{"192.168.0.0/16"}, WithSyncSecrets(true))
+
+	snapshot, err := configurator.Generate([]*k8s.Ingress{ingress}, []*v1.Secret{secret})
+	if err != nil {
+		t.Fatalf("Error generating snapshot %v", err)
+	}
+
+	listener := snapshot.Resources[tcache.Listener].Items["listener_0"].Resource.(*listener.Listener)
+	assertSdsSecretName(t, listener.FilterChains[0], "ns/foo-tls")
+	if _, ok := snapshot.Resources[tcache.Secret].Items["ns/foo-tls"]; !ok {
+		t.Fatalf("expected secret ns/foo-tls in snapshot")
+	}
+
+	rotated := secret.DeepCopy()
+	rotated.Data = map[string][]byte{"tls.crt": []byte(rsa2048crt), "tls.key": []byte(rsa2048key)}
+
+	rotatedSnapshot, err := configurator.Generate([]*k8s.Ingress{ingress}, []*v1.Secret{rotated})
+	if err != nil {
+		t.Fatalf("Error generating snapshot %v", err)
+	}
+
+	if rotatedSnapshot.Resources[tcache.Listener].Version != snapshot.Resources[tcache.Listener].Version {
+		t.Errorf("expected certificate rotation not to update the listener")
+	}
+	if rotatedSnapshot.Resources[tcache.Secret].Version == snapshot.Resources[tcache.Secret].Version {
+		t.Errorf("expected certificate rotation to update the secrets")
+	}
+}
+
+func TestTranslateIngressesExcludingKeepsTheRestOfTheHost(t *testing.T) {
+	api := newGenericIngress("foo.app.com", "api.cluster.com")
+	api.Name = "api"
+	api.RulesPaths = map[string][]*k8s.IngressPath{"foo.app.com": {{Path: "/api", PathType: k8s.PathTypePrefix}}}
+	web := newGenericIngress("foo.app.com", "web.cluster.com")
+	web.Name = "web"
+	web.RulesHosts = []string{"foo.app.com", "bar.app.com"}
+
+	config := translateIngressesExcluding([]*k8s.Ingress{api, web}, false, nil, map[string]map[*k8s.Ingress]bool{"foo.app.com": {web: true}})
+	if len(config.VirtualHosts) != 2 {
+		t.Fatalf("expected both hosts to be kept, got %d", len(config.VirtualHosts))
+	}
+	for _, vhost := range config.VirtualHosts {
+		switch vhost.Host {
+		case "foo.app.com":
+			if len(vhost.Routes) != 1 || vhost.Routes[0].Path != "/api" || len(vhost.ingresses) != 1 || vhost.ingresses[0] != api {
+				t.Errorf("expected only the rules of the api ingress on foo.app.com, got %+v", vhost.Routes)
+			}
+		case "bar.app.com":
+			if len(vhost.ingresses) != 1 || vhost.ingresses[0] != web {
+				t.Errorf("expected the excluded ingress to keep its other hosts, got %+v", vhost.ingresses)
+			}
+		}
+	}
+}
+
+func TestGenerateSyncedSecretsOfSources(t *testing.T) {
+	ingress := func(host, source string) *k8s.Ingress {
+		i := newGenericIngress(host, "bibble")
+		i.Namespace, i.Source = "default", source
+		i.TLS = map[string]*k8s.IngressTLS{host: {Host: host, SecretName: "wildcard-tls"}}
+		return i
+	}
+	secret := func(source, cert, key string) *v1.Secret {
+		return &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "wildcard-tls", Annotations: map[string]string{k8s.SourceAnnotation: source}},
+			Data:       map[string][]byte{"tls.crt": []byte(cert), "tls.key": []byte(key)},
+		}
+	}
+
+	configurator := NewKubernetesConfigurator("a", nil, "d", []string{"bar"}, []string{"192.168.0.0/16"}, WithSyncSecrets(true))
+	snapshot, err := configurator.Generate(
+		[]*k8s.Ingress{ingress("foo.app.com", "a"), ingress("bar.app.com", "b")},
+		[]*v1.Secret{secret("a", p256crt, p256key), secret("b", rsa2048crt, rsa2048key)},
+	)
+	if err != nil {
+		t.Fatalf("Error generating snapshot %v", err)
+	}
+
+	listener := snapshot.Resources[tcache.Listener].Items["listener_0"].Resource.(*listener.Listener)
+	for _, filterChain := range listener.FilterChains {
+		switch filterChain.FilterChainMatch.ServerNames[0] {
+		case "foo.app.com":
+			assertSdsSecretName(t, filterChain, "a/default/wildcard-tls")
+		case "bar.app.com":
+			assertSdsSecretName(t, filterChain, "b/default/wildcard-tls")
+		}
+	}
+
+	for name, cert := range map[string]string{"a/default/wildcard-tls": p256crt, "b/default/wildcard-tls": rsa2048crt} {
+		item, ok := snapshot.Resources[tcache.Secret].Items[name]
+		if !ok {
+			t.Fatalf("expected secret %s in snapshot", name)
+		}
+		if inlined := item.Resource.(*auth.Secret).GetTlsCertificate().CertificateChain.GetInlineString(); inlined != cert {
+			t.Errorf("expected secret %s to keep the certificate of its cluster", name)
+		}
+	}
+}
+
+func TestGenerateRouteChangeKeepsListener(t *testing.T) {
+	ingress := newGenericIngress("foo.app.com", "bibble")
+	configurator := NewKubernetesConfigurator("a", nil, "d", []string{"bar"}, []string{"192.168.0.0/16"})
+
+	snapshot, err := configurator.Generate([]*k8s.Ingress{ingress}, []*v1.Secret{})
+	if err != nil {
+		t.Fatalf("Error generating snapshot %v", err)
+	}
+	if _, ok := snapshot.Resources[tcache.Route].Items["local_route"]; !ok {
+		t.Fatalf("expected route configuration local_route in snapshot")
+	}
+
+	updated := newGenericIngress("foo.app.com", "bibble")
+	updated.Annotations["yggdrasil.uswitch.com/retry-on"] = "gateway-error"
+
+	updatedSnapshot, err := configurator.Generate([]*k8s.Ingress{updated}, []*v1.Secret{})
+	if err != nil {
+		t.Fatalf("Error generating snapshot %v", err)
+	}
+
+	if updatedSnapshot.Resources[tcache.Listener].Version != snapshot.Resources[tcache.Listener].Version {
+		t.Errorf("expected a route change not to update the listener")
+	}
+	if updatedSnapshot.Resources[tcache.Route].Version == snapshot.Resources[tcache.Route].Version {
+		t.Errorf("expected a route change to update the routes")
+	}
+}
+
+func TestGenerateContentVersions(t *testing.T) {
+	fooIngress := newGenericIngress("foo.app.com", "foo.com")
+	fooIngress.Name = "foo"
+	barIngress := newGenericIngress("bar.app.com", "bar.com")
+	barIngress.Name = "bar"
+
+	certificates := []Certificate{{Hosts: []string{"*"}, Cert: "cert", Key: "key"}}
+	replica := NewKubernetesConfigurator("a", certificates, "d", []string{"bar"}, []string{"192.168.0.0/16"})
+	otherReplica := NewKubernetesConfigurator("a", certificates, "d", []string{"bar"}, []string{"192.168.0.0/16"})
+
+	snapshot, err := replica.Generate([]*k8s.Ingress{fooIngress, barIngress}, []*v1.Secret{})
+	if err != nil {
+		t.Fatalf("Error generating snapshot %v", err)
+	}
+	otherSnapshot, err := otherReplica.Generate([]*k8s.Ingress{barIngress, fooIngress}, []*v1.Secret{})
+	if err != nil {
+		t.Fatalf("Error generating snapshot %v", err)
+	}
+
+	for _, responseType := range []tcache.ResponseType{tcache.Cluster, tcache.Listener, tcache.Route, tcache.Secret} {
+		if snapshot.Resources[responseType].Version != otherSnapshot.Resources[responseType].Version {
+			t.Errorf("expected replicas to agree on the version of %v resources", responseType)
+		}
+	}
+
+	barIngress.Annotations["yggdrasil.uswitch.com/timeout"] = "10s"
+	updated, err := replica.Generate([]*k8s.Ingress{fooIngress, barIngress}, []*v1.Secret{})
+	if err != nil {
+		t.Fatalf("Error generating snapshot %v", err)
+	}
+	if updated.Resources[tcache.Route].Version == snapshot.Resources[tcache.Route].Version {
+		t.Errorf("expected a timeout change to update the routes version")
+	}
+	if updated.Resources[tcache.Listener].Version != snapshot.Resources[tcache.Listener].Version {
+		t.Errorf("expected a timeout change not to update the listener version")
+	}
+}
+
+func TestGenerateSourceOptions(t *testing.T) {
+	configurator := NewKubernetesConfigurator("a", nil, "", []string{"bar"}, []string{"192.168.0.0/16"},
+		WithUpstreamPort(443),
+		WithSourceOptions(map[string]SourceOptions{
+			"secondary": {WeightMultiplier: 3, UpstreamPort: 8443, TrustCA: "/secondary/ca.crt"},
+		}))
+
+	primary := newGenericIngress("foo.app.com", "primary.lb.com")
+	primary.Source = "primary"
+	secondary := newGenericIngress("foo.app.com", "secondary.lb.com")
+	secondary.Name = "bar"
+	secondary.Source = "secondary"
+
+	snapshot, err := configurator.Generate([]*k8s.Ingress{primary, secondary}, []*v1.Secret{})
+	if err != nil {
+		t.Fatalf("Error generating snapshot %v", err)
+	}
+
+	cluster := snapshot.Resources[tcache.Cluster].Items["foo_app_com"].Resource.(*v3cluster.Cluster)
+	if len(cluster.TransportSocketMatches) != 1 || cluster.TransportSocketMatches[0].Match.Fields["source"].GetStringValue() != "secondary" {
+		t.Errorf("expected a transport socket for the secondary source, got %v", cluster.TransportSocketMatches)
+	}
+
+	for _, lbEndpoint := range cluster.LoadAssignment.Endpoints[0].LbEndpoints {
+		address := lbEndpoint.GetEndpoint().Address.GetSocketAddress()
+		source := lbEndpoint.Metadata.FilterMetadata["yggdrasil"].Fields["source"].GetStringValue()
+		switch address.Address {
+		case "primary.lb.com":
+			if source != "primary" || address.GetPortValue() != 443 || lbEndpoint.LoadBalancingWeight.Value != 1 {
+				t.Errorf("expected the primary endpoint to keep the defaults, got %v", lbEndpoint)
+			}
+		case "secondary.lb.com":
+			if source != "secondary" || address.GetPortValue() != 8443 || lbEndpoint.LoadBalancingWeight.Value != 3 {
+				t.Errorf("expected the secondary endpoint to use its source options, got %v", lbEndpoint)
+			}
+		default:
+			t.Errorf("unexpected endpoint %v", lbEndpoint)
+		}
+	}
+}
+
+func TestGenerateLeavesOutInvalidIngresses(t *testing.T) {
+	invalidPath := newGenericIngress("bar.app.com", "bibble")
+	invalidPath.Namespace, invalidPath.Name = "ns", "invalid-path"
+	invalidPath.RulesPaths = map[string][]*k8s.IngressPath{
+		"bar.app.com": {{Path: "/api/(", PathType: k8s.PathTypeRegularExpression}},
+	}
+	invalidHost := newGenericIngress("Baz_app.com", "bibble")
+	invalidHost.Namespace, invalidHost.Name = "ns", "invalid-host"
+
+	configurator := NewKubernetesConfigurator("a", nil, "", []string{"bar"}, []string{"192.168.0.0/16"})
+	snapshot, err := configurator.Generate([]*k8s.Ingress{newGenericIngress("foo.app.com", "bibble"), invalidPath, invalidHost}, []*v1.Secret{})
+	if err != nil {
+		t.Fatalf("Error generating snapshot %v", err)
+	}
+
+	listener := snapshot.Resources[tcache.Listener].Items["listener_0"].Resource.(*listener.Listener)
+	assertNumberOfVirtualHosts(t, listener.FilterChains[0], snapshot.Resources[tcache.Route].Items, 1)
+
+	ingressErrors := configurator.IngressErrors()
+	if len(ingressErrors) != 2 {
+		t.Fatalf("expected 2 ingress errors, got %+v", ingressErrors)
+	}
+	if ingressErrors[0].Name != "invalid-host" || ingressErrors[1].Name != "invalid-path" {
+		t.Errorf("expected the invalid ingresses to be reported, got %+v", ingressErrors)
+	}
+
+	if _, err := configurator.Generate([]*k8s.Ingress{newGenericIngress("foo.app.com", "bibble")}, []*v1.Secret{}); err != nil {
+		t.Fatalf("Error generating snapshot %v", err)
+	}
+	if ingressErrors := configurator.IngressErrors(); len(ingressErrors) != 0 {
+		t.Errorf("expected the errors to be cleared once the ingresses are fixed, got %+v", ingressErrors)
+	}
+}
+
+func TestGenerateMetricsOfNodeGroups(t *testing.T) {
+	ingress := func(host, class, source string) *k8s.Ingress {
+		i := newGenericIngress(host, "bibble")
+		i.Annotations["kubernetes.io/ingress.class"] = class
+		i.Source = source
+		return i
+	}
+	ingresses := []*k8s.Ingress{
+		ingress("foo.app.com", "public", "a"),
+		ingress("bar.app.com", "public", "b"),
+		ingress("baz.app.com", "internal", "a"),
+	}
+	public := NewKubernetesConfigurator("metrics-public", nil, "", []string{"public"}, nil)
+	internal := NewKubernetesConfigurator("metrics-internal", nil, "", []string{"internal"}, nil)
+	for _, configurator := range []*KubernetesConfigurator{public, internal} {
+		if _, err := configurator.Generate(ingresses, nil); err != nil {
+			t.Fatalf("error generating snapshot %v", err)
+		}
+	}
+
+	for node, expected := range map[string]float64{"metrics-public": 2, "metrics-internal": 1} {
+		if count := testutil.ToFloat64(matchingIngresses.WithLabelValues(node)); count != expected {
+			t.Errorf("expected %v matching ingresses for %s, got %v", expected, node, count)
+		}
+		if count := testutil.ToFloat64(numVhosts.WithLabelValues(node)); count != expected {
+			t.Errorf("expected %v virtual hosts for %s, got %v", expected, node, count)
+		}
+	}
+	for _, series := range [][]string{{"metrics-public", "a"}, {"metrics-public", "b"}, {"metrics-internal", "a"}} {
+		if count := testutil.ToFloat64(sourceIngresses.WithLabelValues(series...)); count != 1 {
+			t.Errorf("expected a matching ingress for %v, got %v", series, count)
+		}
+	}
+
+	// generating a node group again only replaces its own series
+	if _, err := public.Generate(ingresses[:1], nil); err != nil {
+		t.Fatalf("error generating snapshot %v", err)
+	}
+	if sourceIngresses.DeleteLabelValues("metrics-public", "b") {
+		t.Errorf("expected the series of source b to be removed from the public nodes")
+	}
+	if count := testutil.ToFloat64(sourceIngresses.WithLabelValues("metrics-internal", "a")); count != 1 {
+		t.Errorf("expected the internal nodes to keep their series, got %v", count)
+	}
+}
@@ -0,0 +1,49 @@
+package envoy
+
+import (
+	"testing"
+
+	"github.com/uswitch/yggdrasil/pkg/k8s"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHostChangeOnlyChangesItsResources(t *testing.T) {
+	ingress := func(host, upstream string) *k8s.Ingress {
+		i := newGenericIngress(host, upstream)
+		i.Namespace = "ns"
+		i.TLS = map[string]*k8s.IngressTLS{host: {Host: host, SecretName: "tls"}}
+		return i
+	}
+	secrets := []*v1.Secret{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "tls"},
+		Data:       map[string][]byte{"tls.crt": []byte(p256crt), "tls.key": []byte(p256key)},
+	}}
+	certificates := []Certificate{{Hosts: []string{"*"}, Cert: "b", Key: "c"}}
+	configurator := NewKubernetesConfigurator("a", certificates, "", []string{"bar"}, nil, WithSyncSecrets(true))
+	render := func(ingresses []*k8s.Ingress) RenderedSnapshot {
+		t.Helper()
+		snapshot, err := configurator.Generate(ingresses, secrets)
+		if err != nil {
+			t.Fatalf("error generating snapshot %v", err)
+		}
+		rendered, err := Render(&snapshot)
+		if err != nil {
+			t.Fatalf("error rendering snapshot %v", err)
+		}
+		return rendered
+	}
+
+	before := render([]*k8s.Ingress{ingress("foo.app.com", "foo.cluster.com"), ingress("bar.app.com", "bar.cluster.com"), newGenericIngress("baz.app.com", "baz.cluster.com")})
+	foo := ingress("foo.app.com", "foo2.cluster.com")
+	foo.Annotations["yggdrasil.uswitch.com/retry-on"] = "gateway-error"
+	after := render([]*k8s.Ingress{foo, ingress("bar.app.com", "bar.cluster.com"), newGenericIngress("baz.app.com", "baz.cluster.com")})
+
+	diffs, err := Diff(before, after)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(diffs) != 2 || diffs[0].Type != "cluster" || diffs[0].Name != "foo_app_com" || diffs[1].Type != "route" || diffs[1].Name != "foo.app.com" {
+		t.Errorf("expected only the cluster and route configuration of foo.app.com to change, got %+v", diffs)
+	}
+}
@@ -0,0 +1,226 @@
+package envoy
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Changes of a resource between two configurations
+const (
+	ResourceAdded   = "added"
+	ResourceRemoved = "removed"
+	ResourceChanged = "changed"
+)
+
+// ResourceDiff is how a resource differs between two configurations
+type ResourceDiff struct {
+	Type   string      `json:"type"`
+	Name   string      `json:"name"`
+	Change string      `json:"change"`
+	Fields []FieldDiff `json:"fields,omitempty"`
+}
+
+// FieldDiff is a field of a changed resource, Before or After being nil when the field is added or removed
+type FieldDiff struct {
+	Path   string      `json:"path"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// Diff compares two rendered configurations resource by resource, matching the resources of each type by name.
+// Lists of named elements, such as virtual hosts, routes, filter chains or filters, are compared element by
+// element matched by their name, domains or match rather than by their position
+func Diff(before, after RenderedSnapshot) ([]ResourceDiff, error) {
+	diffs := []ResourceDiff{}
+	for _, resources := range []struct {
+		typeName      string
+		before, after []json.RawMessage
+	}{
+		{"listener", before.Listeners, after.Listeners},
+		{"cluster", before.Clusters, after.Clusters},
+		{"route", before.Routes, after.Routes},
+		{"endpoint", before.Endpoints, after.Endpoints},
+	} {
+		typeDiffs, err := diffResources(resources.typeName, resources.before, resources.after)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, typeDiffs...)
+	}
+	return diffs, nil
+}
+
+func diffResources(typeName string, before, after []json.RawMessage) ([]ResourceDiff, error) {
+	beforeByName, err := resourcesByName(before)
+	if err != nil {
+		return nil, err
+	}
+	afterByName, err := resourcesByName(after)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := []ResourceDiff{}
+	for _, name := range sortedKeys(beforeByName, afterByName) {
+		beforeResource, existed := beforeByName[name]
+		afterResource, exists := afterByName[name]
+		switch {
+		case !existed:
+			diffs = append(diffs, ResourceDiff{Type: typeName, Name: name, Change: ResourceAdded})
+		case !exists:
+			diffs = append(diffs, ResourceDiff{Type: typeName, Name: name, Change: ResourceRemoved})
+		default:
+			fields := []FieldDiff{}
+			diffValues("", beforeResource, afterResource, &fields)
+			if len(fields) > 0 {
+				diffs = append(diffs, ResourceDiff{Type: typeName, Name: name, Change: ResourceChanged, Fields: fields})
+			}
+		}
+	}
+	return diffs, nil
+}
+
+func resourcesByName(resources []json.RawMessage) (map[string]interface{}, error) {
+	byName := map[string]interface{}{}
+	for _, raw := range resources {
+		var resource map[string]interface{}
+		if err := json.Unmarshal(raw, &resource); err != nil {
+			return nil, err
+		}
+		name, ok := resource["name"].(string)
+		if !ok {
+			// endpoints are named after their cluster
+			name, _ = resource["cluster_name"].(string)
+		}
+		byName[name] = resource
+	}
+	return byName, nil
+}
+
+func diffValues(path string, before, after interface{}, fields *[]FieldDiff) {
+	switch b := before.(type) {
+	case map[string]interface{}:
+		if a, ok := after.(map[string]interface{}); ok {
+			for _, key := range sortedKeys(b, a) {
+				diffValues(joinPath(path, key), b[key], a[key], fields)
+			}
+			return
+		}
+	case []interface{}:
+		if a, ok := after.([]interface{}); ok {
+			diffLists(path, b, a, fields)
+			return
+		}
+	}
+
+	if !reflect.DeepEqual(before, after) {
+		*fields = append(*fields, FieldDiff{Path: path, Before: before, After: after})
+	}
+}
+
+func diffLists(path string, before, after []interface{}, fields *[]FieldDiff) {
+	beforeByKey, beforeKeyed := elementsByKey(before)
+	afterByKey, afterKeyed := elementsByKey(after)
+	if !beforeKeyed || !afterKeyed {
+		for i := 0; i < len(before) || i < len(after); i++ {
+			var b, a interface{}
+			if i < len(before) {
+				b = before[i]
+			}
+			if i < len(after) {
+				a = after[i]
+			}
+			diffValues(fmt.Sprintf("%s[%d]", path, i), b, a, fields)
+		}
+		return
+	}
+
+	for _, key := range sortedKeys(beforeByKey, afterByKey) {
+		diffValues(fmt.Sprintf("%s[%s]", path, key), beforeByKey[key], afterByKey[key], fields)
+	}
+}
+
+// elementsByKey identifies the elements of a list by their name, domains or match, and returns
+// whether they all have a distinct identity
+func elementsByKey(elements []interface{}) (map[string]interface{}, bool) {
+	byKey := map[string]interface{}{}
+	for _, element := range elements {
+		key, ok := elementKey(element)
+		if !ok {
+			return nil, false
+		}
+		if _, duplicate := byKey[key]; duplicate {
+			return nil, false
+		}
+		byKey[key] = element
+	}
+	return byKey, true
+}
+
+func elementKey(element interface{}) (string, bool) {
+	object, ok := element.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	if name, ok := object["name"].(string); ok && name != "" {
+		if domains, ok := object["domains"].([]interface{}); ok {
+			// virtual hosts all share the same name
+			keys := []string{}
+			for _, domain := range domains {
+				keys = append(keys, fmt.Sprint(domain))
+			}
+			return strings.Join(keys, ","), true
+		}
+		return name, true
+	}
+	for _, field := range []string{"domains", "filter_chain_match", "match"} {
+		if value, ok := object[field]; ok {
+			key, _ := json.Marshal(value)
+			return string(key), true
+		}
+	}
+	return "", false
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func sortedKeys(maps ...map[string]interface{}) []string {
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, m := range maps {
+		for key := range m {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// String describes the change of a resource and of its fields, one per line
+func (d ResourceDiff) String() string {
+	symbols := map[string]string{ResourceAdded: "+", ResourceRemoved: "-", ResourceChanged: "~"}
+	lines := []string{fmt.Sprintf("%s %s %s", symbols[d.Change], d.Type, d.Name)}
+	for _, field := range d.Fields {
+		lines = append(lines, fmt.Sprintf("    %s: %s -> %s", field.Path, describeValue(field.Before), describeValue(field.After)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func describeValue(value interface{}) string {
+	if value == nil {
+		return "<none>"
+	}
+	bytes, _ := json.Marshal(value)
+	return string(bytes)
+}
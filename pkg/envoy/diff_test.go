@@ -0,0 +1,97 @@
+package envoy
+
+import (
+	"errors"
+	"testing"
+
+	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/uswitch/yggdrasil/pkg/k8s"
+)
+
+func renderIngresses(t *testing.T, configurator *KubernetesConfigurator, ingresses []*k8s.Ingress) RenderedSnapshot {
+	t.Helper()
+	snapshot, err := configurator.Generate(ingresses, nil)
+	if err != nil {
+		t.Fatalf("error generating snapshot %v", err)
+	}
+	rendered, err := Render(&snapshot)
+	if err != nil {
+		t.Fatalf("error rendering snapshot %v", err)
+	}
+	return rendered
+}
+
+func TestDiff(t *testing.T) {
+	configurator := NewKubernetesConfigurator("a", nil, "", []string{"bar"}, nil)
+	before := renderIngresses(t, configurator, []*k8s.Ingress{
+		newGenericIngress("foo.app.com", "foo.cluster.com"),
+		newGenericIngress("bar.app.com", "bar.cluster.com"),
+	})
+	after := renderIngresses(t, configurator, []*k8s.Ingress{
+		newGenericIngress("foo.app.com", "foo2.cluster.com"),
+		newGenericIngress("baz.app.com", "baz.cluster.com"),
+	})
+
+	diffs, err := Diff(before, after)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expected := []struct {
+		typeName, name, change string
+	}{
+		{"cluster", "bar_app_com", ResourceRemoved},
+		{"cluster", "baz_app_com", ResourceAdded},
+		{"cluster", "foo_app_com", ResourceChanged},
+		{"route", "local_route", ResourceChanged},
+	}
+	if len(diffs) != len(expected) {
+		t.Fatalf("expected %d differences, got %+v", len(expected), diffs)
+	}
+	for i, e := range expected {
+		if diffs[i].Type != e.typeName || diffs[i].Name != e.name || diffs[i].Change != e.change {
+			t.Errorf("expected %s %s to be %s, got %+v", e.typeName, e.name, e.change, diffs[i])
+		}
+	}
+
+	address := diffs[2].Fields
+	if len(address) != 1 || address[0].Before != "foo.cluster.com" || address[0].After != "foo2.cluster.com" {
+		t.Errorf("expected the upstream address change, got %+v", address)
+	}
+
+	// virtual hosts are matched by their domains rather than their position
+	routes := diffs[3].Fields
+	if len(routes) != 2 || routes[0].Path != "virtual_hosts[bar.app.com]" || routes[0].After != nil ||
+		routes[1].Path != "virtual_hosts[baz.app.com]" || routes[1].Before != nil {
+		t.Errorf("expected bar.app.com removed and baz.app.com added, got %+v", routes)
+	}
+
+	if diffs, _ := Diff(before, before); len(diffs) != 0 {
+		t.Errorf("expected no difference with itself, got %+v", diffs)
+	}
+}
+
+func TestSnapshotterDiffSince(t *testing.T) {
+	configurator := NewKubernetesConfigurator("a", nil, "", []string{"bar"}, nil)
+	snapshotter := NewSnapshotter(cache.NewSnapshotCache(true, cache.IDHash{}, nil), configurator, nil)
+
+	if err := snapshotter.publish(configurator, []*k8s.Ingress{newGenericIngress("foo.app.com", "foo.cluster.com")}, nil, nil); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	previous, _ := snapshotter.ConfigDump("")
+	if err := snapshotter.publish(configurator, []*k8s.Ingress{newGenericIngress("foo.app.com", "foo2.cluster.com")}, nil, nil); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	diffs, err := snapshotter.DiffSince("", previous.Version)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(diffs) != 1 || diffs[0].Name != "foo_app_com" || diffs[0].Change != ResourceChanged {
+		t.Errorf("expected the foo_app_com cluster to change, got %+v", diffs)
+	}
+
+	if _, err := snapshotter.DiffSince("", "unknown"); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("expected an unknown version error, got %v", err)
+	}
+}
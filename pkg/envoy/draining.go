@@ -0,0 +1,102 @@
+package envoy
+
+import (
+	"sort"
+	"time"
+
+	"github.com/uswitch/yggdrasil/pkg/k8s"
+)
+
+// upstreamRef is an upstream of an ingress
+type upstreamRef struct {
+	ingress  *k8s.Ingress
+	upstream string
+}
+
+// upstreamState are the upstreams of a snapshot and the ones removed since, draining
+type upstreamState struct {
+	active   map[string]upstreamRef
+	draining map[string]drainingUpstream
+}
+
+// drainingUpstream is an upstream removed from its ingress, or of an ingress being deleted, since the given time
+type drainingUpstream struct {
+	ingress *k8s.Ingress
+	since   time.Time
+}
+
+func upstreamKey(ingress *k8s.Ingress, upstream string) string {
+	return ingress.Source + "/" + ingress.Namespace + "/" + ingress.Name + "/" + upstream
+}
+
+// drainingCopy returns a copy of the ingress with only the given upstream, marked as draining
+func drainingCopy(ingress *k8s.Ingress, upstream string) *k8s.Ingress {
+	draining := *ingress
+	draining.Upstreams = []string{upstream}
+	draining.Draining = true
+	return &draining
+}
+
+// drainRemovedUpstreams leaves out the ingresses being deleted and adds draining copies of the ingresses
+// for the upstreams removed since the published snapshots, until the grace period expires.
+// The new upstreams are only committed once the snapshot is published, see publishedUpstreams
+func (c *KubernetesConfigurator) drainRemovedUpstreams(ingresses []*k8s.Ingress, now time.Time) []*k8s.Ingress {
+	if c.upstreamGracePeriod <= 0 {
+		return ingresses
+	}
+
+	served := []*k8s.Ingress{}
+	active := map[string]upstreamRef{}
+	draining := make(map[string]drainingUpstream, len(c.upstreams.draining))
+	for key, upstream := range c.upstreams.draining {
+		draining[key] = upstream
+	}
+	for _, ingress := range ingresses {
+		for _, upstream := range ingress.Upstreams {
+			key := upstreamKey(ingress, upstream)
+			if !ingress.Deleting {
+				active[key] = upstreamRef{ingress: ingress, upstream: upstream}
+				delete(draining, key)
+			} else if _, ok := draining[key]; !ok {
+				draining[key] = drainingUpstream{ingress: drainingCopy(ingress, upstream), since: now}
+			}
+		}
+		if !ingress.Deleting {
+			served = append(served, ingress)
+		}
+	}
+	for key, ref := range c.upstreams.active {
+		if _, ok := active[key]; ok {
+			continue
+		}
+		if _, ok := draining[key]; !ok {
+			draining[key] = drainingUpstream{ingress: drainingCopy(ref.ingress, ref.upstream), since: now}
+		}
+	}
+
+	keys := make([]string, 0, len(draining))
+	for key, upstream := range draining {
+		if now.Sub(upstream.since) >= c.upstreamGracePeriod {
+			delete(draining, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	// the draining ingresses are added in a stable order to keep the snapshot version
+	sort.Strings(keys)
+	for _, key := range keys {
+		served = append(served, draining[key].ingress)
+	}
+	c.pendingUpstreams = &upstreamState{active: active, draining: draining}
+	return served
+}
+
+// publishedUpstreams commits the upstreams of the last generated snapshot once it is published
+func (c *KubernetesConfigurator) publishedUpstreams() {
+	if c.pendingUpstreams == nil {
+		return
+	}
+	c.upstreams = *c.pendingUpstreams
+	c.pendingUpstreams = nil
+	numDrainingUpstreams.WithLabelValues(c.nodeID).Set(float64(len(c.upstreams.draining)))
+}
@@ -0,0 +1,152 @@
+package envoy
+
+import (
+	"testing"
+	"time"
+
+	v3cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	tcache "github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/uswitch/yggdrasil/pkg/k8s"
+)
+
+func upstreamHealth(t *testing.T, ingresses []*k8s.Ingress) map[string]core.HealthStatus {
+	t.Helper()
+	config := translateIngresses(ingresses, false, nil)
+	if len(config.Clusters) != 1 {
+		t.Fatalf("expected a single cluster, got %d", len(config.Clusters))
+	}
+	health := map[string]core.HealthStatus{}
+	assignment := makeLoadAssignment(config.Clusters[0].Name, config.Clusters[0].Hosts, 443)
+	for _, lbEndpoints := range assignment.Endpoints {
+		for _, lbEndpoint := range lbEndpoints.LbEndpoints {
+			address := lbEndpoint.HostIdentifier.(*endpoint.LbEndpoint_Endpoint).Endpoint.Address.GetSocketAddress().Address
+			if _, ok := health[address]; ok {
+				t.Fatalf("expected a single endpoint for %s", address)
+			}
+			health[address] = lbEndpoint.HealthStatus
+		}
+	}
+	return health
+}
+
+// drainPublished drains the removed upstreams and commits them as if their snapshot was published
+func drainPublished(c *KubernetesConfigurator, ingresses []*k8s.Ingress, now time.Time) []*k8s.Ingress {
+	served := c.drainRemovedUpstreams(ingresses, now)
+	c.publishedUpstreams()
+	return served
+}
+
+func TestDrainRemovedUpstreams(t *testing.T) {
+	c := NewKubernetesConfigurator("a", nil, "", []string{"bar"}, nil, WithUpstreamGracePeriod(time.Minute))
+	now := time.Now()
+
+	foo := newGenericIngress("foo.app.com", "foo.cluster.com")
+	foo.Upstreams = []string{"foo.cluster.com", "foo2.cluster.com"}
+	drainPublished(c, []*k8s.Ingress{foo}, now)
+
+	// the load balancer of foo2 is replaced
+	replaced := newGenericIngress("foo.app.com", "foo.cluster.com")
+	health := upstreamHealth(t, drainPublished(c, []*k8s.Ingress{replaced}, now.Add(time.Second)))
+	if len(health) != 2 || health["foo.cluster.com"] != core.HealthStatus_UNKNOWN || health["foo2.cluster.com"] != core.HealthStatus_DRAINING {
+		t.Errorf("expected foo2 to be draining, got %v", health)
+	}
+
+	// the ingress is being deleted
+	deleting := newGenericIngress("foo.app.com", "foo.cluster.com")
+	deleting.Deleting = true
+	health = upstreamHealth(t, drainPublished(c, []*k8s.Ingress{deleting}, now.Add(30*time.Second)))
+	if len(health) != 2 || health["foo.cluster.com"] != core.HealthStatus_DRAINING || health["foo2.cluster.com"] != core.HealthStatus_DRAINING {
+		t.Errorf("expected both upstreams to be draining, got %v", health)
+	}
+
+	// foo2 is removed once its grace period expired, foo is still draining
+	health = upstreamHealth(t, drainPublished(c, nil, now.Add(time.Minute+time.Second)))
+	if len(health) != 1 || health["foo.cluster.com"] != core.HealthStatus_DRAINING {
+		t.Errorf("expected only foo to be draining, got %v", health)
+	}
+
+	if ingresses := drainPublished(c, nil, now.Add(2*time.Minute)); len(ingresses) != 0 {
+		t.Errorf("expected every upstream to be removed after the grace period, got %+v", ingresses)
+	}
+}
+
+func TestDrainingUpstreamServedAgain(t *testing.T) {
+	c := NewKubernetesConfigurator("a", nil, "", []string{"bar"}, nil, WithUpstreamGracePeriod(time.Minute))
+	now := time.Now()
+
+	drainPublished(c, []*k8s.Ingress{newGenericIngress("foo.app.com", "foo.cluster.com")}, now)
+	drainPublished(c, nil, now.Add(time.Second))
+
+	// another ingress serving the same host and upstream is not drained
+	other := newGenericIngress("foo.app.com", "foo.cluster.com")
+	other.Name = "other"
+	health := upstreamHealth(t, drainPublished(c, []*k8s.Ingress{other}, now.Add(2*time.Second)))
+	if len(health) != 1 || health["foo.cluster.com"] != core.HealthStatus_UNKNOWN {
+		t.Errorf("expected the upstream to be served, got %v", health)
+	}
+}
+
+func TestDrainingStateOfHeldSnapshots(t *testing.T) {
+	configurator := NewKubernetesConfigurator("a", nil, "", []string{"bar"}, nil, WithUpstreamGracePeriod(time.Minute))
+	snapshotter := NewSnapshotter(cache.NewSnapshotCache(true, cache.IDHash{}, nil), configurator, nil)
+	foo := newGenericIngress("foo.app.com", "foo.cluster.com")
+	foo.Upstreams = []string{"foo.cluster.com", "foo2.cluster.com"}
+	if err := snapshotter.publish(configurator, []*k8s.Ingress{foo}, nil, nil); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// foo2 is still served while the snapshot removing it is held
+	snapshotter.Freeze()
+	if err := snapshotter.publish(configurator, []*k8s.Ingress{newGenericIngress("foo.app.com", "foo.cluster.com")}, nil, nil); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, ok := configurator.upstreams.active[upstreamKey(foo, "foo2.cluster.com")]; !ok || len(configurator.upstreams.draining) != 0 {
+		t.Errorf("expected foo2 to be active until the snapshot is published, got %+v", configurator.upstreams)
+	}
+
+	if err := snapshotter.Unfreeze(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, ok := configurator.upstreams.draining[upstreamKey(foo, "foo2.cluster.com")]; !ok || len(configurator.upstreams.active) != 1 {
+		t.Errorf("expected foo2 to be draining once the snapshot is published, got %+v", configurator.upstreams)
+	}
+}
+
+func TestDrainingClusterDisablesPanicMode(t *testing.T) {
+	configurator := NewKubernetesConfigurator("a", nil, "", []string{"bar"}, nil, WithUpstreamGracePeriod(time.Minute))
+	generate := func(ingresses []*k8s.Ingress) *v3cluster.Cluster {
+		t.Helper()
+		snapshot, err := configurator.Generate(ingresses, nil)
+		if err != nil {
+			t.Fatalf("error generating snapshot %v", err)
+		}
+		configurator.Published(snapshotVersion(&snapshot))
+		item, ok := snapshot.Resources[tcache.Cluster].Items["foo_app_com"]
+		if !ok {
+			t.Fatalf("expected the cluster of foo.app.com, got %v", snapshot.Resources[tcache.Cluster].Items)
+		}
+		return item.Resource.(*v3cluster.Cluster)
+	}
+
+	if cluster := generate([]*k8s.Ingress{newGenericIngress("foo.app.com", "foo.cluster.com")}); cluster.CommonLbConfig != nil {
+		t.Errorf("expected the default panic threshold without draining upstreams, got %v", cluster.CommonLbConfig)
+	}
+
+	// every upstream of the cluster drains once its ingress is being deleted
+	deleting := newGenericIngress("foo.app.com", "foo.cluster.com")
+	deleting.Deleting = true
+	cluster := generate([]*k8s.Ingress{deleting})
+	if threshold := cluster.GetCommonLbConfig().GetHealthyPanicThreshold(); threshold == nil || threshold.Value != 0 {
+		t.Errorf("expected the panic mode to be disabled, got %v", cluster.CommonLbConfig)
+	}
+	for _, lbEndpoints := range cluster.LoadAssignment.Endpoints {
+		for _, lbEndpoint := range lbEndpoints.LbEndpoints {
+			if lbEndpoint.HealthStatus != core.HealthStatus_DRAINING {
+				t.Errorf("expected every endpoint to be draining, got %v", lbEndpoint)
+			}
+		}
+	}
+}
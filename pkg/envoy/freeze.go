@@ -0,0 +1,66 @@
+package envoy
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// Freeze stops publishing snapshots to every node: they keep being generated and validated,
+// but the nodes are served the snapshots they were served when frozen until unfrozen
+func (s *Snapshotter) Freeze() {
+	s.publishLock.Lock()
+	defer s.publishLock.Unlock()
+	if !s.frozen {
+		log.Warnf("froze the publication of snapshots")
+	}
+	s.frozen = true
+	frozenSnapshots.Set(1)
+}
+
+// Unfreeze publishes the last generated snapshots, except to the pinned nodes, and the next ones again
+func (s *Snapshotter) Unfreeze() error {
+	s.publishLock.Lock()
+	defer s.publishLock.Unlock()
+	if !s.frozen {
+		return nil
+	}
+	s.frozen = false
+	frozenSnapshots.Set(0)
+	log.Infof("unfroze the publication of snapshots")
+
+	for nodeID := range s.latest {
+		if held, _ := s.held(nodeID); held {
+			continue
+		}
+		if err := s.publishLatest(nodeID, "unfreeze"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PendingDiff compares the snapshot served to a node group, or to the default nodes when empty,
+// with the last one generated for it, which differ while it is frozen or pinned
+func (s *Snapshotter) PendingDiff(nodeID string) ([]ResourceDiff, error) {
+	nodeID = s.nodeID(nodeID)
+	current, err := s.NodeSnapshot(nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.publishLock.Lock()
+	latest, ok := s.latest[nodeID]
+	s.publishLock.Unlock()
+	if !ok {
+		return []ResourceDiff{}, nil
+	}
+
+	before, err := Render(current)
+	if err != nil {
+		return nil, err
+	}
+	after, err := Render(latest)
+	if err != nil {
+		return nil, err
+	}
+	return Diff(before, after)
+}
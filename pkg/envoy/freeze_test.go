@@ -0,0 +1,66 @@
+package envoy
+
+import (
+	"testing"
+
+	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/uswitch/yggdrasil/pkg/k8s"
+)
+
+func TestSnapshotterFreeze(t *testing.T) {
+	configurator := NewKubernetesConfigurator("a", nil, "", []string{"bar"}, nil)
+	snapshotter := NewSnapshotter(cache.NewSnapshotCache(true, cache.IDHash{}, nil), configurator, nil)
+	publish := func(upstream string) {
+		t.Helper()
+		if err := snapshotter.publish(configurator, []*k8s.Ingress{newGenericIngress("foo.app.com", upstream)}, nil, []string{"ingress default/foo"}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	publish("foo.cluster.com")
+	frozen := currentVersion(t, snapshotter)
+
+	snapshotter.Freeze()
+	publish("foo2.cluster.com")
+	if version := currentVersion(t, snapshotter); version != frozen {
+		t.Errorf("expected the frozen snapshot to be kept, got %s", version)
+	}
+	if status := snapshotter.Status(); !status.Frozen {
+		t.Errorf("expected the status to be frozen, got %+v", status)
+	}
+
+	diffs, err := snapshotter.PendingDiff("")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(diffs) != 1 || diffs[0].Type != "cluster" || diffs[0].Change != ResourceChanged {
+		t.Errorf("expected the pending cluster change, got %+v", diffs)
+	}
+
+	if err := snapshotter.Unfreeze(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if version := currentVersion(t, snapshotter); version == frozen {
+		t.Errorf("expected the last generated snapshot to be served once unfrozen, got %s", version)
+	}
+	if diffs, err := snapshotter.PendingDiff(""); err != nil || len(diffs) != 0 {
+		t.Errorf("expected no pending change once unfrozen, got %+v %v", diffs, err)
+	}
+	if records := snapshotter.History(""); len(records) != 2 || records[0].Changes[0] != "unfreeze" {
+		t.Errorf("expected the unfreeze in the history, got %+v", records)
+	}
+}
+
+func TestSnapshotterStartFrozen(t *testing.T) {
+	configurator := NewKubernetesConfigurator("a", nil, "", []string{"bar"}, nil)
+	snapshotter := NewSnapshotter(cache.NewSnapshotCache(true, cache.IDHash{}, nil), configurator, nil)
+	snapshotter.Freeze()
+
+	// without any previous snapshot, the first generated one is served
+	if err := snapshotter.publish(configurator, []*k8s.Ingress{newGenericIngress("foo.app.com", "foo.cluster.com")}, nil, nil); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := snapshotter.ConfigDump(""); err != nil {
+		t.Errorf("expected a snapshot to be served, got %v", err)
+	}
+}
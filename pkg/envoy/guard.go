@@ -0,0 +1,134 @@
+package envoy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	v3cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkDeletions returns an error when a snapshot removes more than the maximum percentage of the virtual hosts
+// or clusters of the previous one, or all the upstreams of one of its clusters, as happens when a source
+// cluster wrongly returns no ingresses
+func checkDeletions(before, after cache.ResourceSnapshot, maxPercentage int) error {
+	beforeHosts, afterHosts := virtualHostDomains(before), virtualHostDomains(after)
+	if err := checkRemovedPercentage("virtual hosts", beforeHosts, afterHosts, maxPercentage); err != nil {
+		return err
+	}
+
+	beforeUpstreams, afterUpstreams := clusterUpstreams(before), clusterUpstreams(after)
+	if err := checkRemovedPercentage("clusters", beforeUpstreams, afterUpstreams, maxPercentage); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(afterUpstreams))
+	for name := range afterUpstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if beforeUpstreams[name] > 0 && afterUpstreams[name] == 0 {
+			return fmt.Errorf("the snapshot removes all the %d upstreams of cluster %s", beforeUpstreams[name], name)
+		}
+	}
+	return nil
+}
+
+func checkRemovedPercentage(kind string, before, after map[string]int, maxPercentage int) error {
+	if len(before) == 0 {
+		return nil
+	}
+	removed := 0
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			removed++
+		}
+	}
+	if removed*100 > maxPercentage*len(before) {
+		return fmt.Errorf("the snapshot removes %d of the %d %s, more than %d%%", removed, len(before), kind, maxPercentage)
+	}
+	return nil
+}
+
+// virtualHostDomains returns the number of routes of the virtual hosts of every route configuration, keyed by their domains
+func virtualHostDomains(snapshot cache.ResourceSnapshot) map[string]int {
+	hosts := map[string]int{}
+	for name, res := range snapshot.GetResources(resource.RouteType) {
+		routeConfiguration, ok := res.(*route.RouteConfiguration)
+		if !ok {
+			continue
+		}
+		for _, virtualHost := range routeConfiguration.VirtualHosts {
+			hosts[name+"/"+strings.Join(virtualHost.Domains, ",")] = len(virtualHost.Routes)
+		}
+	}
+	return hosts
+}
+
+// clusterUpstreams returns the number of upstreams of each cluster, from its load assignment or its endpoints
+func clusterUpstreams(snapshot cache.ResourceSnapshot) map[string]int {
+	endpoints := snapshot.GetResources(resource.EndpointType)
+	upstreams := map[string]int{}
+	for name, res := range snapshot.GetResources(resource.ClusterType) {
+		c, ok := res.(*v3cluster.Cluster)
+		if !ok {
+			continue
+		}
+		loadAssignment := c.LoadAssignment
+		if loadAssignment == nil {
+			loadAssignment, _ = endpoints[name].(*endpoint.ClusterLoadAssignment)
+		}
+		upstreams[name] = 0
+		if loadAssignment != nil {
+			for _, localityEndpoints := range loadAssignment.Endpoints {
+				upstreams[name] += len(localityEndpoints.LbEndpoints)
+			}
+		}
+	}
+	return upstreams
+}
+
+// guard tells whether a snapshot may replace the one served to a node ID, refusing the mass deletions
+// until overridden. It must be called with the publish lock held
+func (s *Snapshotter) guard(nodeID string, snapshot cache.ResourceSnapshot) bool {
+	if s.maxDeletionPercentage <= 0 {
+		return true
+	}
+	current, err := s.snapshotCache.GetSnapshot(nodeID)
+	if err != nil {
+		return true
+	}
+	if err := checkDeletions(current, snapshot, s.maxDeletionPercentage); err != nil {
+		log.Warnf("refused to publish the snapshot of %s: %s", nodeID, err)
+		refusedSnapshots.WithLabelValues(nodeID).Inc()
+		heldSnapshots.WithLabelValues(nodeID).Set(1)
+		s.refused[nodeID] = err.Error()
+		return false
+	}
+	delete(s.refused, nodeID)
+	return true
+}
+
+// OverrideGuard publishes the last snapshot generated for a node group, or the default nodes when empty,
+// which was refused for removing too many resources
+func (s *Snapshotter) OverrideGuard(nodeID string) error {
+	nodeID = s.nodeID(nodeID)
+
+	s.publishLock.Lock()
+	defer s.publishLock.Unlock()
+	if _, ok := s.refused[nodeID]; !ok {
+		return nil
+	}
+	if held, reason := s.held(nodeID); held {
+		return fmt.Errorf("the snapshots of %s are not published %s", nodeID, reason)
+	}
+	delete(s.refused, nodeID)
+	log.Infof("overrode the deletion guard of %s", nodeID)
+	return s.setLatest(nodeID, "override")
+}
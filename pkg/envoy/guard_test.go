@@ -0,0 +1,78 @@
+package envoy
+
+import (
+	"testing"
+
+	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/uswitch/yggdrasil/pkg/k8s"
+)
+
+func TestSnapshotterDeletionGuard(t *testing.T) {
+	configurator := NewKubernetesConfigurator("a", nil, "", []string{"bar"}, nil)
+	snapshotter := NewSnapshotter(cache.NewSnapshotCache(true, cache.IDHash{}, nil), configurator, nil, WithDeletionGuard(50))
+	publish := func(ingresses ...*k8s.Ingress) {
+		t.Helper()
+		if err := snapshotter.publish(configurator, ingresses, nil, nil); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	publish(
+		newGenericIngress("foo.app.com", "foo.cluster.com"),
+		newGenericIngress("bar.app.com", "bar.cluster.com"),
+		newGenericIngress("baz.app.com", "baz.cluster.com"),
+		newGenericIngress("qux.app.com", "qux.cluster.com"),
+	)
+	all := currentVersion(t, snapshotter)
+
+	// removing half of the hosts is allowed
+	publish(
+		newGenericIngress("foo.app.com", "foo.cluster.com"),
+		newGenericIngress("bar.app.com", "bar.cluster.com"),
+	)
+	half := currentVersion(t, snapshotter)
+	if half == all {
+		t.Fatalf("expected the snapshot removing half of the hosts to be published")
+	}
+
+	publish()
+	if version := currentVersion(t, snapshotter); version != half {
+		t.Errorf("expected the snapshot removing every host to be refused, got %s", version)
+	}
+	if status := snapshotter.Status(); status.Refused["a"] == "" {
+		t.Errorf("expected the refusal in the status, got %+v", status)
+	}
+
+	if err := snapshotter.OverrideGuard(""); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if version := currentVersion(t, snapshotter); version == half {
+		t.Errorf("expected the refused snapshot to be published once overridden")
+	}
+	if status := snapshotter.Status(); status.Refused != nil {
+		t.Errorf("expected no refusal once overridden, got %+v", status)
+	}
+}
+
+func TestCheckDeletionsUpstreams(t *testing.T) {
+	configurator := NewKubernetesConfigurator("a", nil, "", []string{"bar"}, nil)
+	generate := func(ingresses ...*k8s.Ingress) cache.ResourceSnapshot {
+		t.Helper()
+		snapshot, err := configurator.Generate(ingresses, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return &snapshot
+	}
+
+	before := generate(newGenericIngress("foo.app.com", "foo.cluster.com"), newGenericIngress("foo.app.com", "foo2.cluster.com"))
+	if err := checkDeletions(before, generate(newGenericIngress("foo.app.com", "foo.cluster.com")), 50); err != nil {
+		t.Errorf("expected removing one of the upstreams to be allowed, got %v", err)
+	}
+
+	drained := newGenericIngress("foo.app.com", "foo.cluster.com")
+	drained.Annotations["yggdrasil.uswitch.com/weight"] = "0"
+	if err := checkDeletions(before, generate(drained), 100); err == nil {
+		t.Errorf("expected removing all the upstreams of a host to be refused")
+	}
+}
@@ -0,0 +1,458 @@
+package envoy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	tcache "github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	defaultHistorySize = 10
+	// maxRecordedChanges is how many of the changes triggering a snapshot are recorded in its history
+	maxRecordedChanges = 20
+)
+
+// ErrUnknownVersion is returned for snapshot versions not in the history
+var ErrUnknownVersion = errors.New("unknown snapshot version")
+
+// SnapshotRecord describes a snapshot published to envoy
+type SnapshotRecord struct {
+	Version string    `json:"version"`
+	NodeID  string    `json:"nodeId"`
+	Time    time.Time `json:"time"`
+	// Changes are the Kubernetes changes, resyncs, refreshes or rollbacks which triggered the snapshot
+	Changes []string `json:"changes,omitempty"`
+}
+
+type historyEntry struct {
+	record   SnapshotRecord
+	snapshot cache.ResourceSnapshot
+	// withoutSecrets is set for the snapshots loaded from the history directory, which does not store the secrets
+	withoutSecrets bool
+}
+
+// servable returns the snapshot of the entry, with the secrets of the given snapshot when they were not stored
+func (e historyEntry) servable(secrets cache.ResourceSnapshot) (cache.ResourceSnapshot, error) {
+	if !e.withoutSecrets {
+		return e.snapshot, nil
+	}
+	if secrets == nil {
+		return nil, fmt.Errorf("the secrets of snapshot %s are not stored, it can only be served once a snapshot is generated", e.record.Version)
+	}
+	servable := &cache.Snapshot{}
+	for i := 0; i < int(tcache.UnknownType); i++ {
+		typeURL, _ := cache.GetResponseTypeURL(tcache.ResponseType(i))
+		from := e.snapshot
+		if typeURL == resource.SecretType {
+			from = secrets
+		}
+		resources := []tcache.Resource{}
+		for _, r := range from.GetResources(typeURL) {
+			resources = append(resources, r)
+		}
+		servable.Resources[i] = cache.NewResources(from.GetVersion(typeURL), resources)
+	}
+	return servable, nil
+}
+
+// snapshotHistory keeps the last snapshots published for each node ID, oldest first,
+// and writes them to a directory when it is set
+type snapshotHistory struct {
+	size    int
+	dir     string
+	entries map[string][]historyEntry
+	sync.RWMutex
+}
+
+func newSnapshotHistory(size int, dir string) *snapshotHistory {
+	return &snapshotHistory{size: size, dir: dir, entries: map[string][]historyEntry{}}
+}
+
+// record adds a published snapshot unless it is the same version as the last one
+func (h *snapshotHistory) record(nodeID string, snapshot cache.ResourceSnapshot, changes []string) {
+	h.Lock()
+	defer h.Unlock()
+
+	entries := h.entries[nodeID]
+	version := snapshotVersion(snapshot)
+	if len(entries) > 0 && entries[len(entries)-1].record.Version == version {
+		return
+	}
+	entry := historyEntry{
+		record:   SnapshotRecord{Version: version, NodeID: nodeID, Time: time.Now(), Changes: changes},
+		snapshot: snapshot,
+	}
+	entries = append(entries, entry)
+	if len(entries) > h.size {
+		entries = entries[len(entries)-h.size:]
+	}
+	h.entries[nodeID] = entries
+
+	if h.dir != "" {
+		if err := h.write(entry); err != nil {
+			log.Errorf("failed to write snapshot %s of %s to the history directory: %s", version, nodeID, err)
+		}
+	}
+}
+
+func (h *snapshotHistory) get(nodeID string, version string) (historyEntry, error) {
+	h.RLock()
+	defer h.RUnlock()
+
+	for _, entry := range h.entries[nodeID] {
+		if entry.record.Version == version {
+			return entry, nil
+		}
+	}
+	return historyEntry{}, fmt.Errorf("%w %s for node %s", ErrUnknownVersion, version, nodeID)
+}
+
+// last returns the last snapshot published to a node ID
+func (h *snapshotHistory) last(nodeID string) (historyEntry, bool) {
+	h.RLock()
+	defer h.RUnlock()
+
+	entries := h.entries[nodeID]
+	if len(entries) == 0 {
+		return historyEntry{}, false
+	}
+	return entries[len(entries)-1], true
+}
+
+// records returns the records of a node ID, newest first
+func (h *snapshotHistory) records(nodeID string) []SnapshotRecord {
+	h.RLock()
+	defer h.RUnlock()
+
+	records := []SnapshotRecord{}
+	entries := h.entries[nodeID]
+	for i := len(entries) - 1; i >= 0; i-- {
+		records = append(records, entries[i].record)
+	}
+	return records
+}
+
+// storedSnapshot is how a snapshot and its record are written to the history directory
+type storedSnapshot struct {
+	Record    SnapshotRecord      `json:"record"`
+	Versions  map[string]string   `json:"versions"`
+	Resources map[string][]string `json:"resources"`
+}
+
+func (h *snapshotHistory) nodeDir(nodeID string) string {
+	return filepath.Join(h.dir, url.PathEscape(nodeID))
+}
+
+// write stores a snapshot, without its secrets so that the directory does not contain private keys, and removes the files of the snapshots no longer in the history
+func (h *snapshotHistory) write(entry historyEntry) error {
+	stored := storedSnapshot{Record: entry.record, Versions: map[string]string{}, Resources: map[string][]string{}}
+	for i := 0; i < int(tcache.UnknownType); i++ {
+		typeURL, _ := cache.GetResponseTypeURL(tcache.ResponseType(i))
+		stored.Versions[typeURL] = entry.snapshot.GetVersion(typeURL)
+		if typeURL == resource.SecretType {
+			continue
+		}
+		for _, resource := range entry.snapshot.GetResources(typeURL) {
+			resourceAny, err := anypb.New(resource)
+			if err != nil {
+				return err
+			}
+			bytes, err := protojson.Marshal(resourceAny)
+			if err != nil {
+				return err
+			}
+			stored.Resources[typeURL] = append(stored.Resources[typeURL], string(bytes))
+		}
+	}
+	bytes, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	dir := h.nodeDir(entry.record.NodeID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.json", entry.record.Time.UnixNano(), entry.record.Version)
+	if err := ioutil.WriteFile(filepath.Join(dir, name), bytes, 0600); err != nil {
+		return err
+	}
+
+	files, err := historyFiles(dir)
+	if err != nil {
+		return err
+	}
+	for len(files) > h.size {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// load reads the snapshots written to the history directory by a previous run
+func (h *snapshotHistory) load() error {
+	nodeDirs, err := ioutil.ReadDir(h.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	for _, nodeDir := range nodeDirs {
+		if !nodeDir.IsDir() {
+			continue
+		}
+		files, err := historyFiles(filepath.Join(h.dir, nodeDir.Name()))
+		if err != nil {
+			return err
+		}
+		if len(files) > h.size {
+			files = files[len(files)-h.size:]
+		}
+		for _, file := range files {
+			entry, err := readStoredSnapshot(file)
+			if err != nil {
+				return fmt.Errorf("error reading %s: %s", file, err)
+			}
+			h.entries[entry.record.NodeID] = append(h.entries[entry.record.NodeID], entry)
+		}
+	}
+	return nil
+}
+
+func readStoredSnapshot(file string) (historyEntry, error) {
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return historyEntry{}, err
+	}
+	stored := storedSnapshot{}
+	if err := json.Unmarshal(bytes, &stored); err != nil {
+		return historyEntry{}, err
+	}
+
+	snapshot := &cache.Snapshot{}
+	for typeURL, version := range stored.Versions {
+		resources := []tcache.Resource{}
+		for _, resource := range stored.Resources[typeURL] {
+			resourceAny := &anypb.Any{}
+			if err := protojson.Unmarshal([]byte(resource), resourceAny); err != nil {
+				return historyEntry{}, err
+			}
+			message, err := resourceAny.UnmarshalNew()
+			if err != nil {
+				return historyEntry{}, err
+			}
+			resources = append(resources, message)
+		}
+		snapshot.Resources[cache.GetResponseType(typeURL)] = cache.NewResources(version, resources)
+	}
+	return historyEntry{record: stored.Record, snapshot: snapshot, withoutSecrets: true}, nil
+}
+
+// historyFiles returns the snapshot files of a node directory, oldest first
+func historyFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), ".json") {
+			files = append(files, filepath.Join(dir, info.Name()))
+		}
+	}
+	// the file names start with the time of the snapshot
+	sort.Slice(files, func(i, j int) bool {
+		return historyFileTime(files[i]) < historyFileTime(files[j])
+	})
+	return files, nil
+}
+
+func historyFileTime(file string) int64 {
+	var nanos int64
+	fmt.Sscanf(filepath.Base(file), "%d-", &nanos)
+	return nanos
+}
+
+// changeSet collects the distinct changes triggering a snapshot
+type changeSet struct {
+	changes []string
+	seen    map[string]bool
+	dropped int
+}
+
+func (c *changeSet) add(change string) {
+	if c.seen == nil {
+		c.seen = map[string]bool{}
+	}
+	if c.seen[change] {
+		return
+	}
+	c.seen[change] = true
+	if len(c.changes) >= maxRecordedChanges {
+		c.dropped++
+		return
+	}
+	c.changes = append(c.changes, change)
+}
+
+func (c *changeSet) list() []string {
+	if c.dropped == 0 {
+		return c.changes
+	}
+	return append(append([]string{}, c.changes...), fmt.Sprintf("and %d more", c.dropped))
+}
+
+// LoadHistory reads the snapshots written to the history directory by a previous run, when there is one
+func (s *Snapshotter) LoadHistory() error {
+	if s.history.dir == "" {
+		return nil
+	}
+	return s.history.load()
+}
+
+// History returns the records of the snapshots published to a node group, or to the default nodes when empty,
+// newest first
+func (s *Snapshotter) History(nodeID string) []SnapshotRecord {
+	return s.history.records(s.nodeID(nodeID))
+}
+
+// Rollback publishes a previous snapshot of a node group, or of the default nodes when empty, and pins it:
+// the snapshots generated afterwards are not published until the node group is released
+func (s *Snapshotter) Rollback(nodeID string, version string) error {
+	nodeID = s.nodeID(nodeID)
+	entry, err := s.history.get(nodeID, version)
+	if err != nil {
+		return err
+	}
+
+	s.publishLock.Lock()
+	defer s.publishLock.Unlock()
+	var secrets cache.ResourceSnapshot
+	if latest, ok := s.latest[nodeID]; ok {
+		secrets = latest
+	}
+	snapshot, err := entry.servable(secrets)
+	if err != nil {
+		return err
+	}
+	if err := s.snapshotCache.SetSnapshot(context.Background(), nodeID, snapshot); err != nil {
+		return fmt.Errorf("failed to set snapshot: %s", err)
+	}
+	s.published(nodeID, snapshot)
+	s.pinned[nodeID] = version
+	pinnedSnapshots.WithLabelValues(nodeID).Set(1)
+	s.history.record(nodeID, snapshot, []string{fmt.Sprintf("rollback to %s", version)})
+	log.Warnf("rolled back %s to snapshot %s, pinned until released", nodeID, version)
+	return nil
+}
+
+// Release unpins a node group, or the default nodes when empty, and publishes its last generated snapshot
+// unless the publication is frozen
+func (s *Snapshotter) Release(nodeID string) error {
+	nodeID = s.nodeID(nodeID)
+
+	s.publishLock.Lock()
+	defer s.publishLock.Unlock()
+	if _, ok := s.pinned[nodeID]; !ok {
+		return nil
+	}
+	delete(s.pinned, nodeID)
+	pinnedSnapshots.WithLabelValues(nodeID).Set(0)
+	log.Infof("released %s", nodeID)
+
+	if held, _ := s.held(nodeID); held {
+		return nil
+	}
+	return s.publishLatest(nodeID, "release")
+}
+
+// publishLatest publishes the last generated snapshot of a node ID unless refused by the deletion guard,
+// it must be called with the publish lock held
+func (s *Snapshotter) publishLatest(nodeID string, change string) error {
+	latest, ok := s.latest[nodeID]
+	if !ok || !s.guard(nodeID, latest) {
+		return nil
+	}
+	return s.setLatest(nodeID, change)
+}
+
+// setLatest publishes the last generated snapshot of a node ID, it must be called with the publish lock held
+func (s *Snapshotter) setLatest(nodeID string, change string) error {
+	latest, ok := s.latest[nodeID]
+	if !ok {
+		return nil
+	}
+	if err := s.snapshotCache.SetSnapshot(context.Background(), nodeID, latest); err != nil {
+		return fmt.Errorf("failed to set snapshot: %s", err)
+	}
+	s.published(nodeID, latest)
+	heldSnapshots.WithLabelValues(nodeID).Set(0)
+	s.history.record(nodeID, latest, []string{change})
+	return nil
+}
+
+// held returns whether the snapshots of a node ID are not published and why,
+// it must be called with the publish lock held
+func (s *Snapshotter) held(nodeID string) (bool, string) {
+	if version, ok := s.pinned[nodeID]; ok {
+		return true, fmt.Sprintf("pinned to %s", version)
+	}
+	if s.frozen {
+		return true, "while frozen"
+	}
+	return false, ""
+}
+
+// DiffSince compares a previous version of the snapshot of a node group, or of the default nodes when empty,
+// with its current snapshot
+func (s *Snapshotter) DiffSince(nodeID string, version string) ([]ResourceDiff, error) {
+	nodeID = s.nodeID(nodeID)
+	previous, err := s.history.get(nodeID, version)
+	if err != nil {
+		return nil, err
+	}
+	current, err := s.NodeSnapshot(nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	before, err := Render(previous.snapshot)
+	if err != nil {
+		return nil, err
+	}
+	after, err := Render(current)
+	if err != nil {
+		return nil, err
+	}
+	return Diff(before, after)
+}
+
+// nodeID returns the node ID of the default nodes for an empty one
+func (s *Snapshotter) nodeID(nodeID string) string {
+	if nodeID == "" {
+		return s.configurator.NodeID()
+	}
+	return nodeID
+}
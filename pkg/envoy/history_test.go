@@ -0,0 +1,140 @@
+package envoy
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/uswitch/yggdrasil/pkg/k8s"
+)
+
+func currentVersion(t *testing.T, snapshotter *Snapshotter) string {
+	t.Helper()
+	dump, err := snapshotter.ConfigDump("")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return dump.Version
+}
+
+func TestSnapshotterRollback(t *testing.T) {
+	configurator := NewKubernetesConfigurator("a", nil, "", []string{"bar"}, nil)
+	snapshotter := NewSnapshotter(cache.NewSnapshotCache(true, cache.IDHash{}, nil), configurator, nil)
+	publish := func(upstream string) {
+		t.Helper()
+		if err := snapshotter.publish(configurator, []*k8s.Ingress{newGenericIngress("foo.app.com", upstream)}, nil, []string{"ingress default/foo"}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	publish("foo.cluster.com")
+	first := currentVersion(t, snapshotter)
+	publish("foo2.cluster.com")
+	second := currentVersion(t, snapshotter)
+
+	records := snapshotter.History("")
+	if len(records) != 2 || records[0].Version != second || records[1].Version != first || !reflect.DeepEqual(records[0].Changes, []string{"ingress default/foo"}) {
+		t.Fatalf("expected both snapshots in the history, newest first, got %+v", records)
+	}
+
+	if err := snapshotter.Rollback("", "unknown"); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("expected an unknown version error, got %v", err)
+	}
+	if err := snapshotter.Rollback("", first); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if version := currentVersion(t, snapshotter); version != first {
+		t.Errorf("expected the first snapshot to be served after the rollback, got %s", version)
+	}
+
+	// the pinned snapshot is kept while new ones are generated
+	publish("foo3.cluster.com")
+	if version := currentVersion(t, snapshotter); version != first {
+		t.Errorf("expected the pinned snapshot to be kept, got %s", version)
+	}
+	if status := snapshotter.Status(); status.Pinned["a"] != first {
+		t.Errorf("expected the pinned version in the status, got %+v", status)
+	}
+
+	if err := snapshotter.Release(""); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if version := currentVersion(t, snapshotter); version == first || version == second {
+		t.Errorf("expected the last generated snapshot to be served once released, got %s", version)
+	}
+	if status := snapshotter.Status(); status.Pinned != nil {
+		t.Errorf("expected no pinned version once released, got %+v", status)
+	}
+}
+
+func TestSnapshotHistoryDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configurator := NewKubernetesConfigurator("a", []Certificate{{Hosts: []string{"*"}, Cert: "b", Key: "c"}}, "", []string{"bar"}, nil)
+	history := newSnapshotHistory(2, dir)
+	for _, upstream := range []string{"foo.cluster.com", "foo2.cluster.com", "foo3.cluster.com"} {
+		snapshot, err := configurator.Generate([]*k8s.Ingress{newGenericIngress("foo.app.com", upstream)}, nil)
+		if err != nil {
+			t.Fatalf("error generating snapshot %v", err)
+		}
+		history.record("a", &snapshot, []string{upstream})
+	}
+
+	loaded := newSnapshotHistory(2, dir)
+	if err := loaded.load(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	records := loaded.records("a")
+	if len(records) != 2 || records[0].Changes[0] != "foo3.cluster.com" || records[1].Changes[0] != "foo2.cluster.com" {
+		t.Fatalf("expected the last two snapshots to be loaded, got %+v", records)
+	}
+
+	for _, record := range records {
+		stored, _ := history.get("a", record.Version)
+		entry, err := loaded.get("a", record.Version)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if snapshotVersion(entry.snapshot) != record.Version {
+			t.Errorf("expected the loaded snapshot to keep its versions")
+		}
+		before, _ := Render(stored.snapshot)
+		after, _ := Render(entry.snapshot)
+		if diffs, _ := Diff(before, after); len(diffs) != 0 {
+			t.Errorf("expected the loaded snapshot to be the recorded one, got %+v", diffs)
+		}
+		if len(entry.snapshot.GetResources(resource.SecretType)) != 0 {
+			t.Errorf("expected the secrets not to be stored")
+		}
+		if _, err := entry.servable(nil); err == nil {
+			t.Errorf("expected the snapshot not to be servable without secrets")
+		}
+		servable, err := entry.servable(stored.snapshot)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(servable.GetResources(resource.SecretType)) != 1 || snapshotVersion(servable) != record.Version {
+			t.Errorf("expected the loaded snapshot to be served with the given secrets")
+		}
+	}
+
+	files, _ := historyFiles(loaded.nodeDir("a"))
+	for _, file := range files {
+		bytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(bytes), "privateKey") {
+			t.Errorf("expected no private key in %s", file)
+		}
+	}
+}
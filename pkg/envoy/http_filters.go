@@ -5,7 +5,6 @@ import (
 
 	router "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
 	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
-	"google.golang.org/protobuf/types/known/anypb"
 )
 
 type httpFilterBuilder struct {
@@ -18,7 +17,7 @@ func (b *httpFilterBuilder) Add(filter *hcm.HttpFilter) *httpFilterBuilder {
 }
 
 func (b *httpFilterBuilder) Filters() ([]*hcm.HttpFilter, error) {
-	httpFilterConfig, err := anypb.New(&router.Router{})
+	httpFilterConfig, err := newAny(&router.Router{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal router config struct to typed struct: %s", err)
 	}
@@ -5,6 +5,8 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"hash/fnv"
+	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
@@ -14,6 +16,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/uswitch/yggdrasil/pkg/k8s"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 func sortCluster(clusters []*cluster) {
@@ -39,6 +42,20 @@ func ClustersEquals(a, b []*cluster) bool {
 	return true
 }
 
+// sortedIngresses orders the ingresses by namespace and name, whichever order they are listed in,
+// ingresses of the same name in different clusters keep the order of the clusters
+func sortedIngresses(ingresses []*k8s.Ingress) []*k8s.Ingress {
+	sorted := make([]*k8s.Ingress, len(ingresses))
+	copy(sorted, ingresses)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Namespace != sorted[j].Namespace {
+			return sorted[i].Namespace < sorted[j].Namespace
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
 func sortVirtualHosts(hosts []*virtualHost) {
 	sort.Slice(hosts, func(i int, j int) bool {
 		return hosts[i].Host < hosts[j].Host
@@ -65,16 +82,84 @@ func VirtualHostsEquals(a, b []*virtualHost) bool {
 type envoyConfiguration struct {
 	VirtualHosts []*virtualHost
 	Clusters     []*cluster
+	// IngressErrors are the ingresses left out of the configuration
+	IngressErrors []IngressError
+	// rejected are the ingresses of the virtual hosts which failed to be generated with them
+	rejected []hostRejection
+}
+
+// IngressError is why an ingress was left out of the generated configuration
+type IngressError struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Source    string `json:"source,omitempty"`
+	Host      string `json:"host,omitempty"`
+	Error     string `json:"error"`
+}
+
+func newIngressError(ingress *k8s.Ingress, host string, err error) IngressError {
+	return IngressError{Namespace: ingress.Namespace, Name: ingress.Name, Source: ingress.Source, Host: host, Error: err.Error()}
+}
+
+// hostRejection is an ingress left out of a virtual host because the host failed to be generated with it
+type hostRejection struct {
+	host    string
+	ingress *k8s.Ingress
+	err     error
+}
+
+// rejectIngresses leaves the rules of the given ingresses out of a virtual host, the configuration has to be
+// translated again without them
+func (cfg *envoyConfiguration) rejectIngresses(vhost *virtualHost, ingresses []*k8s.Ingress, err error) {
+	for _, ingress := range ingresses {
+		logrus.Warnf("leaving out ingress %s/%s of cluster %s from virtual host %s: %s", ingress.Namespace, ingress.Name, ingress.Source, vhost.Host, err)
+		cfg.rejected = append(cfg.rejected, hostRejection{host: vhost.Host, ingress: ingress, err: err})
+	}
+}
+
+// offendingIngresses returns the ingresses of a virtual host failing to be generated on their own,
+// or all of them when the host only fails with their rules together
+func offendingIngresses(vhost *virtualHost, reselectionAttempts int64, defaultRetryOn string) []*k8s.Ingress {
+	offending := []*k8s.Ingress{}
+	for _, ingress := range vhost.ingresses {
+		for _, single := range translateIngresses([]*k8s.Ingress{ingress}, false, nil).VirtualHosts {
+			if single.Host != vhost.Host {
+				continue
+			}
+			if _, err := makeVirtualHost(single, reselectionAttempts, defaultRetryOn); err != nil {
+				offending = append(offending, ingress)
+			}
+		}
+	}
+	if len(offending) == 0 {
+		return vhost.ingresses
+	}
+	return offending
 }
 
 type virtualHost struct {
 	Host            string
 	UpstreamCluster string
+	Routes          []*httpRoute
 	Timeout         time.Duration
 	PerTryTimeout   time.Duration
 	TlsKey          string
 	TlsCert         string
+	TlsSecret       string
 	RetryOn         string
+
+	// ingresses are the ingresses the virtual host is made of, tlsIngress the one its TLS secret comes from
+	ingresses  []*k8s.Ingress
+	tlsIngress *k8s.Ingress
+}
+
+func (v *virtualHost) addIngress(ingress *k8s.Ingress) {
+	for _, i := range v.ingresses {
+		if i == ingress {
+			return
+		}
+	}
+	v.ingresses = append(v.ingresses, ingress)
 }
 
 func (v *virtualHost) Equals(other *virtualHost) bool {
@@ -86,16 +171,136 @@ func (v *virtualHost) Equals(other *virtualHost) bool {
 		v.Timeout == other.Timeout &&
 		v.UpstreamCluster == other.UpstreamCluster &&
 		v.PerTryTimeout == other.PerTryTimeout &&
-		v.TlsKey == other.TlsKey &&
-		v.TlsCert == other.TlsCert &&
-		v.RetryOn == other.RetryOn
+		v.TlsSecret == other.TlsSecret &&
+		v.RetryOn == other.RetryOn &&
+		routesEquals(v.Routes, other.Routes)
 }
 
-type LBHost struct {
-	Host   string
+// httpRoute sends the requests matching a path of a virtual host to a cluster
+type httpRoute struct {
+	Path            string
+	PathType        string
+	Headers         []k8s.HeaderMatch
+	UpstreamCluster string
+	Filters         *k8s.IngressPathFilters
+	// WeightedClusters split the requests of the route between clusters instead of the upstream cluster when set
+	WeightedClusters []weightedCluster
+	// Mirror is the cluster a share of the requests is copied to, when set
+	Mirror *routeMirror
+
+	// mirrors are the mirror ingresses of the route and served is set once another ingress serves it
+	served  bool
+	mirrors []*k8s.Ingress
+}
+
+// routeMirror copies a percentage of the requests of a route to a cluster, discarding its responses
+type routeMirror struct {
+	Cluster    string
+	Percentage uint32
+}
+
+// weightedCluster receives a share of the requests of a route proportional to its weight
+type weightedCluster struct {
+	Name   string
 	Weight uint32
 }
 
+// clusters returns the names of the clusters the route sends requests to
+func (r *httpRoute) clusters() []string {
+	names := []string{}
+	if len(r.WeightedClusters) == 0 {
+		names = append(names, r.UpstreamCluster)
+	}
+	for _, weighted := range r.WeightedClusters {
+		names = append(names, weighted.Name)
+	}
+	if r.Mirror != nil {
+		names = append(names, r.Mirror.Cluster)
+	}
+	return names
+}
+
+func (r *httpRoute) identity() string {
+	identity := r.PathType + ":" + r.Path
+	for _, header := range r.Headers {
+		if header.Regex {
+			identity += "|" + header.Name + "~" + header.Value
+		} else {
+			identity += "|" + header.Name + "=" + header.Value
+		}
+	}
+	return identity
+}
+
+func (r *httpRoute) Equals(other *httpRoute) bool {
+	if other == nil {
+		return false
+	}
+
+	return r.Path == other.Path &&
+		r.PathType == other.PathType &&
+		r.UpstreamCluster == other.UpstreamCluster &&
+		reflect.DeepEqual(r.Headers, other.Headers) &&
+		reflect.DeepEqual(r.Filters, other.Filters) &&
+		reflect.DeepEqual(r.WeightedClusters, other.WeightedClusters) &&
+		reflect.DeepEqual(r.Mirror, other.Mirror)
+}
+
+func (r *httpRoute) isRedirect() bool {
+	return r.Filters != nil && r.Filters.Redirect != nil
+}
+
+var pathTypeOrder = map[string]int{
+	k8s.PathTypeExact:                  0,
+	k8s.PathTypePrefix:                 1,
+	k8s.PathTypeImplementationSpecific: 2,
+	k8s.PathTypeRegularExpression:      3,
+}
+
+// sortRoutes orders routes so that the most specific path is matched first:
+// longer paths come first, exact matches win over prefixes of the same path
+// and routes matching on more headers win over the ones matching on fewer
+func sortRoutes(routes []*httpRoute) {
+	sort.SliceStable(routes, func(i int, j int) bool {
+		if len(routes[i].Path) != len(routes[j].Path) {
+			return len(routes[i].Path) > len(routes[j].Path)
+		}
+		if routes[i].PathType != routes[j].PathType {
+			return pathTypeOrder[routes[i].PathType] < pathTypeOrder[routes[j].PathType]
+		}
+		if len(routes[i].Headers) != len(routes[j].Headers) {
+			return len(routes[i].Headers) > len(routes[j].Headers)
+		}
+		return routes[i].identity() < routes[j].identity()
+	})
+}
+
+func routesEquals(a, b []*httpRoute) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for idx, route := range a {
+		if !route.Equals(b[idx]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+type LBHost struct {
+	Host     string
+	Weight   uint32
+	Locality k8s.Locality
+	// Source is the name of the cluster the upstream was read from
+	Source string
+	// Port overrides the upstream port when set
+	Port uint32
+	// Draining is whether the upstream was removed and is kept for the grace period
+	Draining bool
+}
+
 type cluster struct {
 	Name            string
 	VirtualHost     string
@@ -104,28 +309,42 @@ type cluster struct {
 	Hosts           []LBHost
 }
 
+// addHost adds an upstream to the cluster, a draining upstream is left out when another ingress still serves it
+func (c *cluster) addHost(host LBHost) {
+	hosts := c.Hosts[:0]
+	for _, other := range c.Hosts {
+		if other.Host != host.Host || other.Source != host.Source {
+			hosts = append(hosts, other)
+			continue
+		}
+		if host.Draining && !other.Draining {
+			return
+		}
+		if !other.Draining || host.Draining {
+			hosts = append(hosts, other)
+		}
+	}
+	c.Hosts = append(hosts, host)
+}
+
 func (c *cluster) identity() string {
 	return c.Name
 }
 
-func (c *cluster) Equals(other *cluster) bool {
+// settingsEquals compares everything but the upstream hosts of the clusters
+func (c *cluster) settingsEquals(other *cluster) bool {
 	if other == nil {
 		return false
 	}
 
-	if c.Name != other.Name {
-		return false
-	}
-
-	if c.Timeout != other.Timeout {
-		return false
-	}
-
-	if c.VirtualHost != other.VirtualHost {
-		return false
-	}
+	return c.Name == other.Name &&
+		c.Timeout == other.Timeout &&
+		c.VirtualHost == other.VirtualHost &&
+		c.HealthCheckPath == other.HealthCheckPath
+}
 
-	if c.HealthCheckPath != other.HealthCheckPath {
+func (c *cluster) Equals(other *cluster) bool {
+	if !c.settingsEquals(other) {
 		return false
 	}
 
@@ -158,6 +377,9 @@ func (cfg *envoyConfiguration) equals(oldCfg *envoyConfiguration) (vmatch bool,
 
 func classFilter(ingresses []*k8s.Ingress, ingressClass []string) (is []*k8s.Ingress) {
 	for _, i := range ingresses {
+		if i.GatewayClass != "" {
+			continue
+		}
 		for _, class := range ingressClass {
 			if i.Annotations["kubernetes.io/ingress.class"] == class ||
 				(i.Class != nil && *i.Class == class) {
@@ -165,7 +387,18 @@ func classFilter(ingresses []*k8s.Ingress, ingressClass []string) (is []*k8s.Ing
 			}
 		}
 	}
-	matchingIngresses.Set(float64(len(is)))
+	return is
+}
+
+// gatewayClassFilter keeps the ingresses derived from HTTPRoutes attached to a gateway of the given classes
+func gatewayClassFilter(ingresses []*k8s.Ingress, gatewayClasses []string) (is []*k8s.Ingress) {
+	for _, i := range ingresses {
+		for _, class := range gatewayClasses {
+			if i.GatewayClass != "" && i.GatewayClass == class {
+				is = append(is, i)
+			}
+		}
+	}
 	return is
 }
 
@@ -180,54 +413,359 @@ Ingress:
 						continue Ingress
 					}
 				}
-				logrus.Debugf("no host found in ingress config for: %+v in namespace: %+v", i.Name, i.Namespace)
+				logrus.Debugf("no host found in ingress config for: %+v in namespace: %+v of cluster %s", i.Name, i.Namespace, i.Source)
 				continue Ingress
 			}
 		}
-		logrus.Debugf("no hostname or ip for loadbalancer found in ingress config for: %+v in namespace: %+v", i.Name, i.Namespace)
+		logrus.Debugf("no hostname or ip for loadbalancer found in ingress config for: %+v in namespace: %+v of cluster %s", i.Name, i.Namespace, i.Source)
 	}
 
 	return vi
 }
 
+// validateIngress checks the ingress for mistakes which would make envoy reject the whole configuration
+func validateIngress(ingress *k8s.Ingress) error {
+	if err := validateCanary(ingress); err != nil {
+		return err
+	}
+	if err := validateMirror(ingress); err != nil {
+		return err
+	}
+	if split := ingress.Annotations["yggdrasil.uswitch.com/traffic-split"]; split != "" && split != splitByIngress && split != splitBySource {
+		return fmt.Errorf("invalid traffic split %s, expected %s or %s", split, splitByIngress, splitBySource)
+	}
+	for _, host := range ingress.RulesHosts {
+		if host == "" {
+			continue
+		}
+		if errs := validation.IsDNS1123Subdomain(strings.TrimPrefix(host, "*.")); len(errs) > 0 {
+			return fmt.Errorf("invalid host %s: %s", host, strings.Join(errs, ", "))
+		}
+		for _, path := range ingressPaths(ingress, host) {
+			if path.PathType == k8s.PathTypeRegularExpression {
+				if _, err := regexp.Compile(path.Path); err != nil {
+					return fmt.Errorf("invalid path regular expression %s: %s", path.Path, err)
+				}
+			}
+			for _, header := range path.Headers {
+				if header.Regex {
+					if _, err := regexp.Compile(header.Value); err != nil {
+						return fmt.Errorf("invalid header %s regular expression %s: %s", header.Name, header.Value, err)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
 type envoyIngress struct {
-	vhost   *virtualHost
-	cluster *cluster
+	vhost    *virtualHost
+	clusters map[string]*cluster
+	routes   map[string]*httpRoute
 }
 
 func newEnvoyIngress(host string) *envoyIngress {
-	clusterName := strings.Replace(host, ".", "_", -1)
 	return &envoyIngress{
 		vhost: &virtualHost{
-			Host:            host,
-			UpstreamCluster: clusterName,
-			Timeout:         (15 * time.Second),
-			PerTryTimeout:   (5 * time.Second),
+			Host:          host,
+			Timeout:       (15 * time.Second),
+			PerTryTimeout: (5 * time.Second),
 		},
-		cluster: &cluster{
-			Name:            clusterName,
-			VirtualHost:     host,
+		clusters: map[string]*cluster{},
+		routes:   map[string]*httpRoute{},
+	}
+}
+
+// clusterName returns the name of the cluster serving a path of the virtual host.
+// The catch-all path keeps the historical name derived from the host only.
+func (ing *envoyIngress) clusterName(path *k8s.IngressPath) string {
+	name := strings.Replace(ing.vhost.Host, ".", "_", -1)
+	if path.PathType == k8s.PathTypePrefix && path.Path == "/" && len(path.Headers) == 0 {
+		return name
+	}
+	// the flattened path is readable but not unique, /api/v1 and /api-v1 would share it without the hash
+	h := fnv.New32a()
+	h.Write([]byte(path.PathType + ":" + path.Path))
+	name = fmt.Sprintf("%s_%s%s_%08x", name, strings.ToLower(path.PathType), nonAlphanumeric.ReplaceAllString(path.Path, "_"), h.Sum32())
+	if len(path.Headers) > 0 {
+		// header matches are hashed to keep cluster names short
+		h := fnv.New32a()
+		h.Write([]byte((&httpRoute{Headers: path.Headers}).identity()))
+		name = fmt.Sprintf("%s_%08x", name, h.Sum32())
+	}
+	return name
+}
+
+var nonAlphanumeric = regexp.MustCompile("[^a-zA-Z0-9]")
+
+// routeCluster returns the cluster backing the given path, creating the route and cluster when needed
+func (ing *envoyIngress) routeCluster(ingressPath *k8s.IngressPath) *cluster {
+	path := normalizedPath(ingressPath)
+	route, cluster := ing.addRoute(path, ingressPath.Filters, ing.clusterName(path))
+	route.served = true
+	return cluster
+}
+
+// Ways the requests of a host can be split by the traffic-split annotation
+const (
+	splitByIngress = "ingress"
+	splitBySource  = "source"
+)
+
+// pathCluster returns the cluster backing the given path for an ingress: its mirror cluster when it is a mirror,
+// its canary cluster when it is a canary,
+// its own cluster when the requests of the host are split between its ingresses or source clusters,
+// or else the cluster of the path
+func (ing *envoyIngress) pathCluster(path *k8s.IngressPath, ingress *k8s.Ingress, split string, weight uint32) *cluster {
+	if percentage, ok := mirrorPercentage(ingress); ok {
+		return ing.mirrorCluster(path, ingress, percentage)
+	}
+	if canary := canaryMatches(ingress); len(canary) > 0 {
+		return ing.canaryCluster(path, canary)
+	}
+	switch split {
+	case splitByIngress:
+		group := []string{}
+		for _, part := range []string{ingress.Source, ingress.Namespace, ingress.Name} {
+			if part != "" {
+				group = append(group, part)
+			}
+		}
+		return ing.splitCluster(path, strings.Join(group, "_"), weight)
+	case splitBySource:
+		return ing.splitCluster(path, ingress.Source, weight)
+	}
+	return ing.routeCluster(path)
+}
+
+// pathClusters returns the clusters backing the given path for an ingress: a weighted cluster for each backend
+// of a path split between backends, unless the ingress is a mirror or a canary, or else the cluster of the path
+func (ing *envoyIngress) pathClusters(path *k8s.IngressPath, ingress *k8s.Ingress, split string, weight uint32) []*cluster {
+	_, mirror := mirrorPercentage(ingress)
+	if len(path.Backends) == 0 || mirror || len(canaryMatches(ingress)) > 0 {
+		return []*cluster{ing.pathCluster(path, ingress, split, weight)}
+	}
+	clusters := []*cluster{}
+	for _, backend := range path.Backends {
+		clusters = append(clusters, ing.splitCluster(path, backend.Name, backend.Weight))
+	}
+	return clusters
+}
+
+// splitCluster returns the cluster of a group of ingresses sharing the requests of the given path, a group
+// being weighted by the highest weight of its ingresses
+func (ing *envoyIngress) splitCluster(ingressPath *k8s.IngressPath, group string, weight uint32) *cluster {
+	path := normalizedPath(ingressPath)
+	route, _ := ing.addRoute(path, ingressPath.Filters, ing.clusterName(path))
+	route.served = true
+	name := route.UpstreamCluster
+	if group != "" {
+		name = name + "_" + nonAlphanumeric.ReplaceAllString(strings.ToLower(group), "_")
+	}
+	split := ing.cluster(name)
+	if weight == 0 {
+		return split
+	}
+	for idx, weighted := range route.WeightedClusters {
+		if weighted.Name == name {
+			if weight > weighted.Weight {
+				route.WeightedClusters[idx].Weight = weight
+			}
+			return split
+		}
+	}
+	route.WeightedClusters = append(route.WeightedClusters, weightedCluster{Name: name, Weight: weight})
+	return split
+}
+
+// mirrorCluster returns the cluster the requests of the given path are mirrored to, mirroring the highest
+// percentage of the mirror ingresses
+func (ing *envoyIngress) mirrorCluster(ingressPath *k8s.IngressPath, ingress *k8s.Ingress, percentage uint32) *cluster {
+	path := normalizedPath(ingressPath)
+	route, _ := ing.addRoute(path, ingressPath.Filters, ing.clusterName(path))
+	if len(route.mirrors) == 0 || route.mirrors[len(route.mirrors)-1] != ingress {
+		route.mirrors = append(route.mirrors, ingress)
+	}
+	name := route.UpstreamCluster + "_mirror"
+	if route.Mirror == nil {
+		route.Mirror = &routeMirror{Cluster: name}
+	}
+	if percentage > route.Mirror.Percentage {
+		route.Mirror.Percentage = percentage
+	}
+	return ing.cluster(name)
+}
+
+// canaryCluster returns the cluster backing the canary of the given path, creating a route ahead of the path
+// for each of the canary matches
+func (ing *envoyIngress) canaryCluster(ingressPath *k8s.IngressPath, matches []k8s.HeaderMatch) *cluster {
+	path := normalizedPath(ingressPath)
+	name := ing.clusterName(path) + "_canary"
+	var canary *cluster
+	for _, match := range matches {
+		canaryPath := *path
+		canaryPath.Headers = append(append([]k8s.HeaderMatch{}, path.Headers...), match)
+		_, canary = ing.addRoute(&canaryPath, ingressPath.Filters, name)
+	}
+	return canary
+}
+
+// addRoute returns the route of the path and the named cluster, creating them when needed
+func (ing *envoyIngress) addRoute(path *k8s.IngressPath, filters *k8s.IngressPathFilters, clusterName string) (*httpRoute, *cluster) {
+	route := &httpRoute{
+		Path:            path.Path,
+		PathType:        path.PathType,
+		Headers:         path.Headers,
+		UpstreamCluster: clusterName,
+		Filters:         filters,
+	}
+	if _, ok := ing.routes[route.identity()]; !ok {
+		ing.routes[route.identity()] = route
+	}
+	return ing.routes[route.identity()], ing.cluster(clusterName)
+}
+
+// cluster returns the named cluster of the virtual host, creating it when needed
+func (ing *envoyIngress) cluster(name string) *cluster {
+	if _, ok := ing.clusters[name]; !ok {
+		ing.clusters[name] = &cluster{
+			Name:            name,
+			VirtualHost:     ing.vhost.Host,
 			Hosts:           []LBHost{},
 			Timeout:         (30 * time.Second),
 			HealthCheckPath: "",
-		},
+		}
 	}
+	return ing.clusters[name]
 }
 
-func (ing *envoyIngress) addUpstream(host string, weight uint32) {
-	ing.cluster.Hosts = append(ing.cluster.Hosts, LBHost{host, weight})
+// normalizedPath returns the path without its filters. Prefix paths match by path element and ignore their
+// trailing slash, ImplementationSpecific paths are treated as string prefixes like most ingress controllers do,
+// both matching every request with the / path
+func normalizedPath(ingressPath *k8s.IngressPath) *k8s.IngressPath {
+	path := &k8s.IngressPath{Path: ingressPath.Path, PathType: ingressPath.PathType, Headers: ingressPath.Headers}
+	switch path.PathType {
+	case k8s.PathTypeExact, k8s.PathTypeRegularExpression:
+	case k8s.PathTypeImplementationSpecific:
+		if path.Path == "/" {
+			path.PathType = k8s.PathTypePrefix
+		}
+	default:
+		path.PathType = k8s.PathTypePrefix
+		if trimmed := strings.TrimRight(path.Path, "/"); trimmed != "" {
+			path.Path = trimmed
+		}
+	}
+	return path
 }
 
-func (ing *envoyIngress) addHealthCheckPath(path string) {
-	ing.cluster.HealthCheckPath = path
+// canaryMatches returns the header matches sending the requests to the upstreams of a canary ingress,
+// none when the ingress is not a canary. Without a value, the canary header and cookie have to be set to always
+func canaryMatches(ingress *k8s.Ingress) []k8s.HeaderMatch {
+	matches := []k8s.HeaderMatch{}
+	if header := ingress.Annotations["yggdrasil.uswitch.com/canary-header"]; header != "" {
+		value := ingress.Annotations["yggdrasil.uswitch.com/canary-header-value"]
+		if value == "" {
+			value = canaryAlways
+		}
+		matches = append(matches, k8s.HeaderMatch{Name: strings.ToLower(header), Value: value})
+	}
+	if cookie := ingress.Annotations["yggdrasil.uswitch.com/canary-cookie"]; cookie != "" {
+		// the regular expression has to match the whole cookie header
+		matches = append(matches, k8s.HeaderMatch{Name: "cookie", Value: `(.*;\s*)?` + regexp.QuoteMeta(cookie) + "=" + canaryAlways + "(;.*)?", Regex: true})
+	}
+	return matches
 }
 
-func (ing *envoyIngress) addTimeout(timeout time.Duration) {
-	ing.cluster.Timeout = timeout
+const canaryAlways = "always"
+
+// mirrorPercentage returns the percentage of the requests of its hosts mirrored to an ingress, all of them by default,
+// and whether the ingress is a mirror
+func mirrorPercentage(ingress *k8s.Ingress) (uint32, bool) {
+	if mirror, _ := strconv.ParseBool(ingress.Annotations["yggdrasil.uswitch.com/mirror"]); !mirror {
+		return 0, false
+	}
+	percentage, err := strconv.ParseUint(ingress.Annotations["yggdrasil.uswitch.com/mirror-percentage"], 10, 32)
+	if err != nil {
+		return 100, true
+	}
+	return uint32(percentage), true
+}
+
+// validateMirror checks the mirror annotations of an ingress
+func validateMirror(ingress *k8s.Ingress) error {
+	if mirror := ingress.Annotations["yggdrasil.uswitch.com/mirror"]; mirror != "" {
+		if _, err := strconv.ParseBool(mirror); err != nil {
+			return fmt.Errorf("invalid mirror %s: %s", mirror, err)
+		}
+	}
+	if percentage := ingress.Annotations["yggdrasil.uswitch.com/mirror-percentage"]; percentage != "" {
+		if value, err := strconv.ParseUint(percentage, 10, 32); err != nil || value > 100 {
+			return fmt.Errorf("invalid mirror percentage %s, expected an integer between 0 and 100", percentage)
+		}
+	}
+	return nil
+}
+
+var headerName = regexp.MustCompile("^[a-zA-Z0-9!#$%&'*+.^_`|~-]+$")
+
+// validateCanary checks the canary annotations of an ingress
+func validateCanary(ingress *k8s.Ingress) error {
+	header := ingress.Annotations["yggdrasil.uswitch.com/canary-header"]
+	if header != "" && !headerName.MatchString(header) {
+		return fmt.Errorf("invalid canary header %s", header)
+	}
+	if header == "" && ingress.Annotations["yggdrasil.uswitch.com/canary-header-value"] != "" {
+		return fmt.Errorf("canary header value without a canary header")
+	}
+	if cookie := ingress.Annotations["yggdrasil.uswitch.com/canary-cookie"]; cookie != "" && !headerName.MatchString(cookie) {
+		return fmt.Errorf("invalid canary cookie %s", cookie)
+	}
+	return nil
+}
+
+// servedRoutes returns the sorted routes of a virtual host, leaving out the paths only served by mirrors
+func (cfg *envoyConfiguration) servedRoutes(ing *envoyIngress) []*httpRoute {
+	routes := []*httpRoute{}
+	for _, route := range ing.sortedRoutes() {
+		if len(route.mirrors) > 0 && !route.served && !route.isRedirect() {
+			err := fmt.Errorf("path %s is only served by mirrors", route.Path)
+			for _, mirror := range route.mirrors {
+				logrus.Warnf("leaving out the mirror of ingress %s/%s of cluster %s from virtual host %s: %s", mirror.Namespace, mirror.Name, mirror.Source, ing.vhost.Host, err)
+				cfg.IngressErrors = append(cfg.IngressErrors, newIngressError(mirror, ing.vhost.Host, err))
+			}
+			continue
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// sortedRoutes returns the routes of the virtual host in matching order
+func (ing *envoyIngress) sortedRoutes() []*httpRoute {
+	routes := []*httpRoute{}
+	for _, route := range ing.routes {
+		routes = append(routes, route)
+	}
+	sortRoutes(routes)
+	return routes
+}
+
+func (ing *envoyIngress) addTimeout(cluster *cluster, timeout time.Duration) {
+	cluster.Timeout = timeout
 	ing.vhost.Timeout = timeout
 	ing.vhost.PerTryTimeout = timeout
 }
 
+// ingressPaths returns the paths of a rule host, defaulting to the whole host
+func ingressPaths(ingress *k8s.Ingress, host string) []*k8s.IngressPath {
+	if paths := ingress.RulesPaths[host]; len(paths) > 0 {
+		return paths
+	}
+	return []*k8s.IngressPath{{Path: "/", PathType: k8s.PathTypePrefix}}
+}
+
 // hostMatch returns true if tlsHost and ruleHost match, with wildcard support
 //
 // *.a.b ruleHost accepts tlsHost *.a.b but not a.a.b or a.b or a.a.a.b
@@ -243,16 +781,26 @@ func hostMatch(ruleHost, tlsHost string) bool {
 	return matched
 }
 
-// getHostTlsSecret returns the tls secret configured for a given ingress host
+// getHostTlsSecret returns the tls secret configured for a given ingress host, preferring the secret
+// of the source cluster of the ingress to the same-named secrets of the other clusters
 func getHostTlsSecret(ingress *k8s.Ingress, host string, secrets []*v1.Secret) (*v1.Secret, error) {
 	for _, tls := range ingress.TLS {
 		// TODO prefer a.a.b tls secret over *.a.b for host a.a.b when both are configured
 		if hostMatch(host, tls.Host) {
+			var found *v1.Secret
 			for _, secret := range secrets {
-				if secret.Namespace == ingress.Namespace &&
-					secret.Name == tls.SecretName {
+				if secret.Namespace != ingress.Namespace || secret.Name != tls.SecretName {
+					continue
+				}
+				if k8s.SecretSource(secret) == ingress.Source {
 					return secret, nil
 				}
+				if found == nil {
+					found = secret
+				}
+			}
+			if found != nil {
+				return found, nil
 			}
 			return nil, fmt.Errorf("secret %s/%s not found for host '%s'", ingress.Namespace, tls.SecretName, host)
 		}
@@ -260,6 +808,16 @@ func getHostTlsSecret(ingress *k8s.Ingress, host string, secrets []*v1.Secret) (
 	return nil, fmt.Errorf("ingress %s/%s - %s has no tls secret configured", ingress.Namespace, ingress.Name, host)
 }
 
+// tlsSecretName is the SDS name of a synced secret, same-named secrets of different source clusters
+// holding different certificates
+func tlsSecretName(secret *v1.Secret) string {
+	name := secret.Namespace + "/" + secret.Name
+	if source := k8s.SecretSource(secret); source != "" {
+		name = source + "/" + name
+	}
+	return name
+}
+
 // validateTlsSecret checks that the given secret holds valid tls certificate and key
 func validateTlsSecret(secret *v1.Secret) (bool, error) {
 	tlsCert, certOk := secret.Data["tls.crt"]
@@ -308,36 +866,80 @@ func (envoyIng *envoyIngress) addRetryOn(ingress *k8s.Ingress) {
 	}
 }
 
+// hostSplits returns how the requests of the hosts are split between their ingresses or source clusters,
+// as set by the traffic-split annotation of the first of their ingresses having it
+func hostSplits(ingresses []*k8s.Ingress) map[string]string {
+	splits := map[string]string{}
+	for _, ingress := range ingresses {
+		split := ingress.Annotations["yggdrasil.uswitch.com/traffic-split"]
+		if split != splitByIngress && split != splitBySource {
+			continue
+		}
+		for _, host := range ingress.RulesHosts {
+			if _, ok := splits[host]; !ok {
+				splits[host] = split
+			}
+		}
+	}
+	return splits
+}
+
 func translateIngresses(ingresses []*k8s.Ingress, syncSecrets bool, secrets []*v1.Secret) *envoyConfiguration {
+	return translateIngressesExcluding(ingresses, syncSecrets, secrets, nil)
+}
+
+// translateIngressesExcluding translates the ingresses, leaving the rules of the excluded ingresses of each host out
+func translateIngressesExcluding(ingresses []*k8s.Ingress, syncSecrets bool, secrets []*v1.Secret, excluded map[string]map[*k8s.Ingress]bool) *envoyConfiguration {
 	cfg := &envoyConfiguration{}
 	envoyIngresses := map[string]*envoyIngress{}
 
+	ingresses = sortedIngresses(ingresses)
+	splits := hostSplits(ingresses)
+
 	for _, i := range ingresses {
+		if err := validateIngress(i); err != nil {
+			logrus.Warnf("leaving out ingress %s/%s of cluster %s: %s", i.Namespace, i.Name, i.Source, err)
+			cfg.IngressErrors = append(cfg.IngressErrors, newIngressError(i, "", err))
+			continue
+		}
+
 		for _, j := range i.Upstreams {
 			for _, ruleHost := range i.RulesHosts {
+				if excluded[ruleHost][i] {
+					continue
+				}
 				_, ok := envoyIngresses[ruleHost]
 				if !ok {
 					envoyIngresses[ruleHost] = newEnvoyIngress(ruleHost)
 				}
 
 				envoyIngress := envoyIngresses[ruleHost]
+				envoyIngress.vhost.addIngress(i)
 
-				if weight64, err := strconv.ParseUint(i.Annotations["yggdrasil.uswitch.com/weight"], 10, 32); err == nil {
-					if weight64 != 0 {
-						envoyIngress.addUpstream(j, uint32(weight64))
+				for _, path := range ingressPaths(i, ruleHost) {
+					weight := uint32(1)
+					if weight64, err := strconv.ParseUint(i.Annotations["yggdrasil.uswitch.com/weight"], 10, 32); err == nil {
+						weight = uint32(weight64)
+					}
+					if path.Weight != nil {
+						weight = *path.Weight
 					}
-				} else {
-					envoyIngress.addUpstream(j, 1)
-				}
 
-				if i.Annotations["yggdrasil.uswitch.com/healthcheck-path"] != "" {
-					envoyIngress.addHealthCheckPath(i.Annotations["yggdrasil.uswitch.com/healthcheck-path"])
-				}
+					for _, cluster := range envoyIngress.pathClusters(path, i, splits[ruleHost], weight) {
+						if weight != 0 {
+							cluster.addHost(LBHost{Host: j, Weight: weight, Locality: i.Locality, Source: i.Source, Draining: i.Draining})
+						}
 
-				if i.Annotations["yggdrasil.uswitch.com/timeout"] != "" {
-					timeout, err := time.ParseDuration(i.Annotations["yggdrasil.uswitch.com/timeout"])
-					if err == nil {
-						envoyIngress.addTimeout(timeout)
+						if i.Annotations["yggdrasil.uswitch.com/healthcheck-path"] != "" {
+							cluster.HealthCheckPath = i.Annotations["yggdrasil.uswitch.com/healthcheck-path"]
+						}
+
+						if i.Annotations["yggdrasil.uswitch.com/timeout"] != "" {
+							timeout, err := time.ParseDuration(i.Annotations["yggdrasil.uswitch.com/timeout"])
+							if err == nil {
+								envoyIngress.addTimeout(cluster, timeout)
+							}
+						}
 					}
 				}
 
@@ -353,6 +955,8 @@ func translateIngresses(ingresses []*k8s.Ingress, syncSecrets bool, secrets []*v
 						} else if valid {
 							envoyIngress.vhost.TlsKey = string(hostTlsSecret.Data["tls.key"])
 							envoyIngress.vhost.TlsCert = string(hostTlsSecret.Data["tls.crt"])
+							envoyIngress.vhost.TlsSecret = tlsSecretName(hostTlsSecret)
+							envoyIngress.vhost.tlsIngress = i
 						}
 					}
 				}
@@ -361,12 +965,38 @@ func translateIngresses(ingresses []*k8s.Ingress, syncSecrets bool, secrets []*v
 	}
 
 	for _, ingress := range envoyIngresses {
-		cfg.Clusters = append(cfg.Clusters, ingress.cluster)
+		clusterAdded := map[string]bool{}
+		ingress.vhost.Routes = cfg.servedRoutes(ingress)
+		if len(ingress.vhost.Routes) == 0 {
+			// a host only served by mirrors would be routed to a cluster without endpoints
+			continue
+		}
+		for _, route := range ingress.vhost.Routes {
+			if route.isRedirect() {
+				// redirections are answered by envoy and need no upstream
+				route.UpstreamCluster = ""
+				continue
+			}
+			if route.PathType == k8s.PathTypePrefix && route.Path == "/" && len(route.Headers) == 0 && len(route.WeightedClusters) == 0 {
+				ingress.vhost.UpstreamCluster = route.UpstreamCluster
+			}
+			sort.Slice(route.WeightedClusters, func(i, j int) bool {
+				return route.WeightedClusters[i].Name < route.WeightedClusters[j].Name
+			})
+			// the routes of a canary share its cluster, as the routes of a split or mirrored path share theirs
+			for _, name := range route.clusters() {
+				if !clusterAdded[name] {
+					clusterAdded[name] = true
+					cfg.Clusters = append(cfg.Clusters, ingress.clusters[name])
+				}
+			}
+		}
 		cfg.VirtualHosts = append(cfg.VirtualHosts, ingress.vhost)
 	}
 
-	numVhosts.Set(float64(len(cfg.VirtualHosts)))
-	numClusters.Set(float64(len(cfg.Clusters)))
+	// keep the generated resources in a stable order so that their versions only depend on their content
+	sortVirtualHosts(cfg.VirtualHosts)
+	sortCluster(cfg.Clusters)
 
 	return cfg
 }
@@ -1,6 +1,8 @@
 package envoy
 
 import (
+	"reflect"
+	"regexp"
 	"testing"
 	"time"
 
@@ -131,8 +133,8 @@ func TestVirtualHostEquality(t *testing.T) {
 }
 
 func TestClusterEquality(t *testing.T) {
-	a := &cluster{Name: "foo", Hosts: []LBHost{{"host1", 1}, {"host2", 1}}}
-	b := &cluster{Name: "foo", Hosts: []LBHost{{"host1", 1}, {"host2", 1}}}
+	a := &cluster{Name: "foo", Hosts: []LBHost{{Host: "host1", Weight: 1}, {Host: "host2", Weight: 1}}}
+	b := &cluster{Name: "foo", Hosts: []LBHost{{Host: "host1", Weight: 1}, {Host: "host2", Weight: 1}}}
 
 	if !a.Equals(b) {
 		t.Error()
@@ -142,17 +144,17 @@ func TestClusterEquality(t *testing.T) {
 		t.Error("cluster is equals nil, expect not to be equal")
 	}
 
-	c := &cluster{Name: "bar", Hosts: []LBHost{{"host1", 1}, {"host2", 1}}}
+	c := &cluster{Name: "bar", Hosts: []LBHost{{Host: "host1", Weight: 1}, {Host: "host2", Weight: 1}}}
 	if a.Equals(c) {
 		t.Error("clusters have different names, expected not to be equal")
 	}
 
-	d := &cluster{Name: "foo", Hosts: []LBHost{{"host1", 1}}} // missing host2
+	d := &cluster{Name: "foo", Hosts: []LBHost{{Host: "host1", Weight: 1}}} // missing host2
 	if a.Equals(d) {
 		t.Error("clusters have different hosts, should be different")
 	}
 
-	e := &cluster{Name: "foo", Hosts: []LBHost{{"bad1", 1}, {"bad2", 1}}}
+	e := &cluster{Name: "foo", Hosts: []LBHost{{Host: "bad1", Weight: 1}, {Host: "bad2", Weight: 1}}}
 	if a.Equals(e) {
 		t.Error("cluster hosts are different, shouldn't be equal")
 	}
@@ -162,7 +164,7 @@ func TestClusterEquality(t *testing.T) {
 		t.Error("no hosts set")
 	}
 
-	g := &cluster{Name: "foo", Hosts: []LBHost{{"host1", 1}, {"host2", 1}}, Timeout: (5 * time.Second)}
+	g := &cluster{Name: "foo", Hosts: []LBHost{{Host: "host1", Weight: 1}, {Host: "host2", Weight: 1}}, Timeout: (5 * time.Second)}
 	if a.Equals(g) {
 		t.Error("clusters with different timeout values should not be equal")
 	}
@@ -320,6 +322,296 @@ func TestGeneratesForMultipleIngressSharingSpecHost(t *testing.T) {
 	}
 }
 
+func TestGeneratesPathRoutesForIngressesSharingSpecHost(t *testing.T) {
+	apiIngress := newGenericIngress("app.com", "api.cluster.com")
+	apiIngress.RulesPaths = map[string][]*k8s.IngressPath{
+		"app.com": {{Path: "/api", PathType: k8s.PathTypePrefix}},
+	}
+	webIngress := newGenericIngress("app.com", "web.cluster.com")
+	webIngress.RulesPaths = map[string][]*k8s.IngressPath{
+		"app.com": {
+			{Path: "/web", PathType: k8s.PathTypeImplementationSpecific},
+			{Path: "/web/login", PathType: k8s.PathTypeExact},
+		},
+	}
+	c := translateIngresses([]*k8s.Ingress{apiIngress, webIngress}, false, []*v1.Secret{})
+
+	if len(c.VirtualHosts) != 1 {
+		t.Fatalf("expected 1 virtual host, was %d", len(c.VirtualHosts))
+	}
+	if len(c.Clusters) != 3 {
+		t.Fatalf("expected 3 clusters, was %d", len(c.Clusters))
+	}
+
+	expected := []*httpRoute{
+		{Path: "/web/login", PathType: k8s.PathTypeExact, UpstreamCluster: "app_com_exact_web_login_5796516d"},
+		{Path: "/api", PathType: k8s.PathTypePrefix, UpstreamCluster: "app_com_prefix_api_ac40c736"},
+		{Path: "/web", PathType: k8s.PathTypeImplementationSpecific, UpstreamCluster: "app_com_implementationspecific_web_94c074f2"},
+	}
+	routes := c.VirtualHosts[0].Routes
+	if len(routes) != len(expected) {
+		t.Fatalf("expected %d routes, was %d", len(expected), len(routes))
+	}
+	for idx, route := range routes {
+		if !route.Equals(expected[idx]) {
+			t.Errorf("expected route %d to be %+v, was %+v", idx, *expected[idx], *route)
+		}
+	}
+
+	if c.VirtualHosts[0].UpstreamCluster != "" {
+		t.Errorf("expected no catch-all cluster, was %s", c.VirtualHosts[0].UpstreamCluster)
+	}
+
+	for _, cluster := range c.Clusters {
+		if len(cluster.Hosts) != 1 {
+			t.Fatalf("expected 1 host in cluster %s, was %d", cluster.Name, len(cluster.Hosts))
+		}
+		if cluster.Name == "app_com_prefix_api_ac40c736" && cluster.Hosts[0].Host != "api.cluster.com" {
+			t.Errorf("expected /api to be served by api.cluster.com, was %s", cluster.Hosts[0].Host)
+		}
+		if cluster.Name == "app_com_implementationspecific_web_94c074f2" && cluster.Hosts[0].Host != "web.cluster.com" {
+			t.Errorf("expected /web to be served by web.cluster.com, was %s", cluster.Hosts[0].Host)
+		}
+	}
+}
+
+func TestGeneratesDistinctClustersForSimilarPaths(t *testing.T) {
+	ingress := func(path, upstream string) *k8s.Ingress {
+		i := newGenericIngress("app.com", upstream)
+		i.Name = upstream
+		i.RulesPaths = map[string][]*k8s.IngressPath{"app.com": {{Path: path, PathType: k8s.PathTypePrefix}}}
+		return i
+	}
+	c := translateIngresses([]*k8s.Ingress{ingress("/api/v1", "slash.cluster.com"), ingress("/api-v1", "dash.cluster.com")}, false, []*v1.Secret{})
+
+	if len(c.Clusters) != 2 || c.Clusters[0].Name == c.Clusters[1].Name {
+		t.Fatalf("expected a cluster for each path, was %+v", c.Clusters)
+	}
+	for _, route := range c.VirtualHosts[0].Routes {
+		for _, cluster := range c.Clusters {
+			if cluster.Name == route.UpstreamCluster && (len(cluster.Hosts) != 1 || cluster.Hosts[0].Host != map[string]string{"/api/v1": "slash.cluster.com", "/api-v1": "dash.cluster.com"}[route.Path]) {
+				t.Errorf("expected %s to be served by its own ingress only, was %+v", route.Path, cluster.Hosts)
+			}
+		}
+	}
+}
+
+func TestRootPathSharesHostCluster(t *testing.T) {
+	rootIngress := newGenericIngress("app.com", "foo.com")
+	rootIngress.RulesPaths = map[string][]*k8s.IngressPath{
+		"app.com": {{Path: "/", PathType: k8s.PathTypeImplementationSpecific}},
+	}
+	c := translateIngresses([]*k8s.Ingress{rootIngress, newGenericIngress("app.com", "bar.com")}, false, []*v1.Secret{})
+
+	if len(c.Clusters) != 1 {
+		t.Fatalf("expected 1 cluster, was %d", len(c.Clusters))
+	}
+	if c.Clusters[0].Name != "app_com" || len(c.Clusters[0].Hosts) != 2 {
+		t.Errorf("expected both ingresses in cluster app_com, was %s with %d hosts", c.Clusters[0].Name, len(c.Clusters[0].Hosts))
+	}
+	if c.VirtualHosts[0].UpstreamCluster != "app_com" {
+		t.Errorf("expected catch-all cluster app_com, was %s", c.VirtualHosts[0].UpstreamCluster)
+	}
+}
+
+func TestGeneratesCanaryRoutes(t *testing.T) {
+	canaryIngress := newGenericIngress("app.com", "canary.cluster.com")
+	canaryIngress.Annotations["yggdrasil.uswitch.com/canary-header"] = "X-Canary"
+	canaryIngress.Annotations["yggdrasil.uswitch.com/canary-header-value"] = "yes"
+	canaryIngress.Annotations["yggdrasil.uswitch.com/canary-cookie"] = "canary"
+	c := translateIngresses([]*k8s.Ingress{newGenericIngress("app.com", "stable.cluster.com"), canaryIngress}, false, []*v1.Secret{})
+
+	if len(c.Clusters) != 2 {
+		t.Fatalf("expected the stable and canary clusters, was %d", len(c.Clusters))
+	}
+	for _, cluster := range c.Clusters {
+		if len(cluster.Hosts) != 1 {
+			t.Fatalf("expected 1 host in cluster %s, was %d", cluster.Name, len(cluster.Hosts))
+		}
+		if cluster.Name == "app_com_canary" && cluster.Hosts[0].Host != "canary.cluster.com" {
+			t.Errorf("expected the canary to be served by canary.cluster.com, was %s", cluster.Hosts[0].Host)
+		}
+		if cluster.Name == "app_com" && cluster.Hosts[0].Host != "stable.cluster.com" {
+			t.Errorf("expected the host to be served by stable.cluster.com, was %s", cluster.Hosts[0].Host)
+		}
+	}
+
+	routes := c.VirtualHosts[0].Routes
+	if len(routes) != 3 || routes[2].UpstreamCluster != "app_com" || len(routes[2].Headers) != 0 {
+		t.Fatalf("expected the canary routes ahead of the default one, was %+v", routes)
+	}
+	for _, route := range routes[:2] {
+		if route.UpstreamCluster != "app_com_canary" || len(route.Headers) != 1 {
+			t.Errorf("expected a canary route, was %+v", *route)
+		}
+	}
+	if c.VirtualHosts[0].UpstreamCluster != "app_com" {
+		t.Errorf("expected catch-all cluster app_com, was %s", c.VirtualHosts[0].UpstreamCluster)
+	}
+}
+
+func TestGeneratesTrafficSplitByIngress(t *testing.T) {
+	a := newGenericIngress("app.com", "a.cluster.com")
+	a.Source = "a"
+	a.Annotations["yggdrasil.uswitch.com/traffic-split"] = "ingress"
+	a.Annotations["yggdrasil.uswitch.com/weight"] = "90"
+	b := newGenericIngress("app.com", "b.cluster.com")
+	b.Source = "b"
+	b.Annotations["yggdrasil.uswitch.com/weight"] = "10"
+	b.Upstreams = []string{"b.cluster.com", "b2.cluster.com"}
+	a.Name, b.Name = "app", "app"
+	c := translateIngresses([]*k8s.Ingress{a, b}, false, []*v1.Secret{})
+
+	if len(c.Clusters) != 2 || c.Clusters[0].Name != "app_com_a_app" || c.Clusters[1].Name != "app_com_b_app" {
+		t.Fatalf("expected a cluster for each ingress, was %+v", c.Clusters)
+	}
+	if len(c.Clusters[1].Hosts) != 2 {
+		t.Errorf("expected both upstreams of b in its cluster, was %+v", c.Clusters[1].Hosts)
+	}
+	expected := []weightedCluster{{Name: "app_com_a_app", Weight: 90}, {Name: "app_com_b_app", Weight: 10}}
+	routes := c.VirtualHosts[0].Routes
+	if len(routes) != 1 || !reflect.DeepEqual(routes[0].WeightedClusters, expected) {
+		t.Errorf("expected the route to be split 90/10, was %+v", routes)
+	}
+}
+
+func TestGeneratesPathBackends(t *testing.T) {
+	route := newGenericIngress("app.com", "gateway.cluster.com")
+	route.RulesPaths = map[string][]*k8s.IngressPath{"app.com": {{
+		Path:     "/api",
+		PathType: k8s.PathTypePrefix,
+		Backends: []k8s.IngressBackend{{Name: "apps/api", Weight: 3}, {Name: "apps/api-next", Weight: 1}},
+	}}}
+	c := translateIngresses([]*k8s.Ingress{route}, false, []*v1.Secret{})
+
+	if len(c.Clusters) != 2 || c.Clusters[0].Name != "app_com_prefix_api_ac40c736_apps_api" || c.Clusters[1].Name != "app_com_prefix_api_ac40c736_apps_api_next" {
+		t.Fatalf("expected a cluster for each backend, was %+v", c.Clusters)
+	}
+	for _, cluster := range c.Clusters {
+		if len(cluster.Hosts) != 1 || cluster.Hosts[0].Host != "gateway.cluster.com" {
+			t.Errorf("expected the upstream in the cluster of each backend, was %+v", cluster.Hosts)
+		}
+	}
+	expected := []weightedCluster{{Name: "app_com_prefix_api_ac40c736_apps_api", Weight: 3}, {Name: "app_com_prefix_api_ac40c736_apps_api_next", Weight: 1}}
+	if routes := c.VirtualHosts[0].Routes; len(routes) != 1 || !reflect.DeepEqual(routes[0].WeightedClusters, expected) {
+		t.Errorf("expected the route to be split 3/1 between the backends, was %+v", routes)
+	}
+}
+
+func TestGeneratesTrafficSplitBySource(t *testing.T) {
+	ingress := func(name, source, weight string) *k8s.Ingress {
+		i := newGenericIngress("app.com", name+".cluster.com")
+		i.Name, i.Source = name, source
+		i.Annotations["yggdrasil.uswitch.com/traffic-split"] = "source"
+		i.Annotations["yggdrasil.uswitch.com/weight"] = weight
+		return i
+	}
+	c := translateIngresses([]*k8s.Ingress{ingress("a1", "a", "3"), ingress("a2", "a", "3"), ingress("b", "b", "1")}, false, []*v1.Secret{})
+
+	if len(c.Clusters) != 2 || len(c.Clusters[0].Hosts) != 2 || len(c.Clusters[1].Hosts) != 1 {
+		t.Fatalf("expected a cluster for each source, was %+v", c.Clusters)
+	}
+	expected := []weightedCluster{{Name: "app_com_a", Weight: 3}, {Name: "app_com_b", Weight: 1}}
+	if routes := c.VirtualHosts[0].Routes; !reflect.DeepEqual(routes[0].WeightedClusters, expected) {
+		t.Errorf("expected the route to be split 3/1 between the sources, was %+v", routes[0].WeightedClusters)
+	}
+
+	invalid := ingress("c", "c", "1")
+	invalid.Annotations["yggdrasil.uswitch.com/traffic-split"] = "namespace"
+	if err := validateIngress(invalid); err == nil {
+		t.Error("expected an invalid traffic split to be rejected")
+	}
+}
+
+func TestGeneratesMirror(t *testing.T) {
+	mirror := newGenericIngress("app.com", "new.cluster.com")
+	mirror.Annotations["yggdrasil.uswitch.com/mirror"] = "true"
+	mirror.Annotations["yggdrasil.uswitch.com/mirror-percentage"] = "25"
+	c := translateIngresses([]*k8s.Ingress{newGenericIngress("app.com", "old.cluster.com"), mirror}, false, []*v1.Secret{})
+
+	if len(c.Clusters) != 2 || c.Clusters[0].Name != "app_com" || c.Clusters[1].Name != "app_com_mirror" {
+		t.Fatalf("expected the host and mirror clusters, was %+v", c.Clusters)
+	}
+	if len(c.Clusters[0].Hosts) != 1 || c.Clusters[0].Hosts[0].Host != "old.cluster.com" || len(c.Clusters[1].Hosts) != 1 || c.Clusters[1].Hosts[0].Host != "new.cluster.com" {
+		t.Errorf("expected the mirror upstream in its own cluster only, was %+v", c.Clusters)
+	}
+	routes := c.VirtualHosts[0].Routes
+	if len(routes) != 1 || routes[0].UpstreamCluster != "app_com" || !reflect.DeepEqual(routes[0].Mirror, &routeMirror{Cluster: "app_com_mirror", Percentage: 25}) {
+		t.Errorf("expected 25%% of the requests to be mirrored, was %+v", routes)
+	}
+
+	mirror.Annotations["yggdrasil.uswitch.com/mirror-percentage"] = "150"
+	if err := validateIngress(mirror); err == nil {
+		t.Error("expected an invalid mirror percentage to be rejected")
+	}
+}
+
+func TestLeavesOutPathsOnlyServedByMirrors(t *testing.T) {
+	mirror := newGenericIngress("app.com", "new.cluster.com")
+	mirror.Name = "mirror"
+	mirror.Annotations["yggdrasil.uswitch.com/mirror"] = "true"
+	c := translateIngresses([]*k8s.Ingress{mirror}, false, []*v1.Secret{})
+	if len(c.VirtualHosts) != 0 || len(c.Clusters) != 0 {
+		t.Errorf("expected a host only served by a mirror to be left out, was %+v %+v", c.VirtualHosts, c.Clusters)
+	}
+	if len(c.IngressErrors) != 1 || c.IngressErrors[0].Name != mirror.Name || c.IngressErrors[0].Host != "app.com" {
+		t.Errorf("expected the mirror to be reported, was %+v", c.IngressErrors)
+	}
+
+	// the paths of the host served by another ingress are still mirrored
+	api := newGenericIngress("app.com", "new.cluster.com")
+	api.Name = "api"
+	api.Annotations["yggdrasil.uswitch.com/mirror"] = "true"
+	api.RulesPaths = map[string][]*k8s.IngressPath{
+		"app.com": {{Path: "/", PathType: k8s.PathTypePrefix}, {Path: "/api", PathType: k8s.PathTypePrefix}},
+	}
+	c = translateIngresses([]*k8s.Ingress{newGenericIngress("app.com", "old.cluster.com"), api}, false, []*v1.Secret{})
+	if len(c.VirtualHosts) != 1 || len(c.VirtualHosts[0].Routes) != 1 || c.VirtualHosts[0].Routes[0].Path != "/" || c.VirtualHosts[0].Routes[0].Mirror == nil {
+		t.Errorf("expected only the mirrored path served by another ingress, was %+v", c.VirtualHosts)
+	}
+	if len(c.IngressErrors) != 1 || c.IngressErrors[0].Name != "api" {
+		t.Errorf("expected the mirror of the path served by no other ingress to be reported, was %+v", c.IngressErrors)
+	}
+}
+
+func TestCanaryMatches(t *testing.T) {
+	ingress := newGenericIngress("app.com", "canary.cluster.com")
+	ingress.Annotations["yggdrasil.uswitch.com/canary-header"] = "X-Canary"
+	ingress.Annotations["yggdrasil.uswitch.com/canary-cookie"] = "canary"
+	matches := canaryMatches(ingress)
+	if len(matches) != 2 || matches[0] != (k8s.HeaderMatch{Name: "x-canary", Value: "always"}) || matches[1].Name != "cookie" || !matches[1].Regex {
+		t.Fatalf("expected a header and a cookie match, was %+v", matches)
+	}
+
+	cookie := regexp.MustCompile("^(?:" + matches[1].Value + ")$")
+	for header, expected := range map[string]bool{
+		"canary=always":                  true,
+		"session=abc; canary=always":     true,
+		"session=abc;canary=always; b=c": true,
+		"canary=never":                   false,
+		"notcanary=always":               false,
+		"canary=alwaysnot":               false,
+	} {
+		if cookie.MatchString(header) != expected {
+			t.Errorf("expected cookie header %q to match %v", header, expected)
+		}
+	}
+
+	ingress.Annotations["yggdrasil.uswitch.com/canary-header"] = "x canary"
+	if err := validateIngress(ingress); err == nil {
+		t.Error("expected an invalid canary header to be rejected")
+	}
+}
+
+func TestVirtualHostRoutesEquality(t *testing.T) {
+	a := &virtualHost{Host: "foo", Routes: []*httpRoute{{Path: "/api", PathType: k8s.PathTypePrefix, UpstreamCluster: "foo_prefix_api"}}}
+	b := &virtualHost{Host: "foo", Routes: []*httpRoute{{Path: "/api", PathType: k8s.PathTypeExact, UpstreamCluster: "foo_exact_api"}}}
+
+	if a.Equals(b) {
+		t.Error("virtual hosts with different routes should not be equal")
+	}
+}
+
 func TestFilterMatchingIngresses(t *testing.T) {
 	ingress := []*k8s.Ingress{
 		newGenericIngress("host", "balancer"),
@@ -341,6 +633,22 @@ func TestFilterNonMatchingIngresses(t *testing.T) {
 	}
 }
 
+func TestFilterGatewayClassIngresses(t *testing.T) {
+	ingress := newGenericIngress("foo.app.com", "bar.com")
+	ingress.GatewayClass = "multi-cluster"
+	ingresses := []*k8s.Ingress{ingress}
+
+	if len(classFilter(ingresses, []string{"multi-cluster"})) != 0 {
+		t.Errorf("expected gateway ingress to be ignored by ingress class filter")
+	}
+	if len(gatewayClassFilter(ingresses, []string{"multi-cluster"})) != 1 {
+		t.Errorf("expected gateway ingress to match its gateway class")
+	}
+	if len(gatewayClassFilter(ingresses, []string{"other"})) != 0 {
+		t.Errorf("expected gateway ingress not to match another gateway class")
+	}
+}
+
 func TestIngressWithIP(t *testing.T) {
 	ingress := newIngressIP("app.com", "127.0.0.1")
 	c := translateIngresses([]*k8s.Ingress{ingress}, false, []*v1.Secret{})
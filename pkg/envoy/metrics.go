@@ -3,47 +3,218 @@ package envoy
 import "github.com/prometheus/client_golang/prometheus"
 
 var (
-	matchingIngresses = prometheus.NewGauge(
+	matchingIngresses = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "yggdrasil",
 			Name:      "ingresses",
-			Help:      "Total number of matching ingress objects",
+			Help:      "Number of ingress objects matching the classes of a node ID",
 		},
+		[]string{"node"},
 	)
 
-	numClusters = prometheus.NewGauge(
+	sourceIngresses = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "yggdrasil",
+			Name:      "source_ingresses",
+			Help:      "Number of ingress objects matching the classes of a node ID per source cluster",
+		},
+		[]string{"node", "source"},
+	)
+
+	numDrainingUpstreams = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "yggdrasil",
+			Name:      "draining_upstreams",
+			Help:      "Number of removed upstreams kept draining for the grace period",
+		},
+		[]string{"node"},
+	)
+
+	snapshotLatency = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "yggdrasil",
+			Name:      "snapshot_latency_seconds",
+			Help:      "Time between a Kubernetes change and the snapshot including it",
+			Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		},
+	)
+
+	snapshotFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "yggdrasil",
+			Name:      "snapshot_failures",
+			Help:      "Number of snapshots which failed to be generated or validated and were not published",
+		},
+	)
+
+	consecutiveSnapshotFailures = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "yggdrasil",
+			Name:      "snapshot_consecutive_failures",
+			Help:      "Number of snapshots which failed in a row since the last published one, retried with an increasing delay",
+		},
+	)
+
+	pinnedSnapshots = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "yggdrasil",
+			Name:      "snapshot_pinned",
+			Help:      "Whether the snapshot of a node ID is pinned to a previous version by a rollback",
+		},
+		[]string{"node"},
+	)
+
+	frozenSnapshots = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "yggdrasil",
+			Name:      "snapshot_frozen",
+			Help:      "Whether the publication of the snapshots is frozen",
+		},
+	)
+
+	heldSnapshots = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "yggdrasil",
+			Name:      "snapshot_held",
+			Help:      "Whether the last snapshot generated for a node ID differs from the one served because it is frozen or pinned",
+		},
+		[]string{"node"},
+	)
+
+	refusedSnapshots = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "yggdrasil",
+			Name:      "refused_snapshots",
+			Help:      "Number of snapshots of a node ID refused by the deletion guard for removing too many resources",
+		},
+		[]string{"node"},
+	)
+
+	rejectedIngresses = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "yggdrasil",
+			Name:      "rejected_ingresses",
+			Help:      "Ingress objects left out of the configuration because of errors",
+		},
+		[]string{"node", "namespace", "name", "source"},
+	)
+
+	connectedNodes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "yggdrasil",
+			Name:      "connected_nodes",
+			Help:      "Number of envoy nodes connected over xDS",
+		},
+	)
+
+	xdsAcks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "yggdrasil",
+			Name:      "xds_acks",
+			Help:      "Number of xDS responses accepted by the envoy nodes",
+		},
+		[]string{"type"},
+	)
+
+	xdsNacks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "yggdrasil",
+			Name:      "xds_nacks",
+			Help:      "Number of xDS responses rejected by the envoy nodes",
+		},
+		[]string{"type"},
+	)
+
+	nodeNacked = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "yggdrasil",
+			Name:      "node_nacked",
+			Help:      "Whether the envoy node rejected the last response of the resource type",
+		},
+		[]string{"node", "type"},
+	)
+
+	nodeInSync = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "yggdrasil",
+			Name:      "node_in_sync",
+			Help:      "Whether the envoy node accepted the last version of the resource type sent to it",
+		},
+		[]string{"node", "type"},
+	)
+
+	numClusters = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "yggdrasil",
 			Name:      "clusters",
-			Help:      "Total number of clusters generated",
+			Help:      "Number of clusters generated for a node ID",
 		},
+		[]string{"node"},
 	)
 
-	numVhosts = prometheus.NewGauge(
+	numVhosts = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "yggdrasil",
 			Name:      "virtual_hosts",
-			Help:      "Total number of virtual hosts generated",
+			Help:      "Number of virtual hosts generated for a node ID",
 		},
+		[]string{"node"},
 	)
 
-	clusterUpdates = prometheus.NewCounter(
+	clusterUpdates = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "yggdrasil",
 			Name:      "cluster_updates",
-			Help:      "Number of times the clusters have been updated",
+			Help:      "Number of times the clusters of a node ID have been updated",
 		},
+		[]string{"node"},
 	)
 
-	listenerUpdates = prometheus.NewCounter(
+	listenerUpdates = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "yggdrasil",
 			Name:      "listener_updates",
-			Help:      "Number of times the listener has been updated",
+			Help:      "Number of times the listener of a node ID has been updated",
+		},
+		[]string{"node"},
+	)
+
+	endpointUpdates = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "yggdrasil",
+			Name:      "endpoint_updates",
+			Help:      "Number of times the endpoints of a node ID have been updated",
+		},
+		[]string{"node"},
+	)
+
+	resolveErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "yggdrasil",
+			Name:      "resolve_errors",
+			Help:      "Number of failed upstream host lookups",
+		},
+	)
+
+	routeUpdates = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "yggdrasil",
+			Name:      "route_updates",
+			Help:      "Number of times the routes of a node ID have been updated",
+		},
+		[]string{"node"},
+	)
+
+	secretUpdates = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "yggdrasil",
+			Name:      "secret_updates",
+			Help:      "Number of times the secrets of a node ID have been updated",
 		},
+		[]string{"node"},
 	)
 )
 
 func init() {
-	prometheus.MustRegister(matchingIngresses, numClusters, numVhosts, clusterUpdates, listenerUpdates)
+	prometheus.MustRegister(matchingIngresses, sourceIngresses, numDrainingUpstreams, snapshotLatency, snapshotFailures, consecutiveSnapshotFailures, pinnedSnapshots, frozenSnapshots, heldSnapshots, refusedSnapshots, rejectedIngresses, connectedNodes, xdsAcks, xdsNacks, nodeNacked, nodeInSync, numClusters, numVhosts, clusterUpdates, listenerUpdates, endpointUpdates, resolveErrors, routeUpdates, secretUpdates)
 }
@@ -0,0 +1,39 @@
+package envoy
+
+import (
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+// NodeGroup matches the envoy nodes served the configuration of a group rather than the default one
+type NodeGroup struct {
+	Name     string
+	Cluster  string
+	Metadata map[string]string
+}
+
+// Matches returns whether a node is part of the group, by its cluster and metadata when they are set
+func (g NodeGroup) Matches(node *core.Node) bool {
+	if g.Cluster == "" && len(g.Metadata) == 0 {
+		return false
+	}
+	if g.Cluster != "" && node.GetCluster() != g.Cluster {
+		return false
+	}
+	for key, value := range g.Metadata {
+		field, ok := node.GetMetadata().GetFields()[key]
+		if !ok || field.GetStringValue() != value {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchNodeGroup returns the name of the first group a node is part of
+func MatchNodeGroup(groups []NodeGroup, node *core.Node) (string, bool) {
+	for _, group := range groups {
+		if group.Matches(node) {
+			return group.Name, true
+		}
+	}
+	return "", false
+}
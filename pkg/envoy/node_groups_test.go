@@ -0,0 +1,34 @@
+package envoy
+
+import (
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestMatchNodeGroup(t *testing.T) {
+	groups := []NodeGroup{
+		{Name: "internal", Cluster: "edge", Metadata: map[string]string{"network": "internal"}},
+		{Name: "edge", Cluster: "edge"},
+		{Name: "unmatchable"},
+	}
+	metadata, _ := structpb.NewStruct(map[string]interface{}{"network": "internal"})
+
+	testCases := []struct {
+		node  *core.Node
+		group string
+	}{
+		{node: &core.Node{Id: "a", Cluster: "edge", Metadata: metadata}, group: "internal"},
+		{node: &core.Node{Id: "b", Cluster: "edge"}, group: "edge"},
+		{node: &core.Node{Id: "c", Cluster: "other", Metadata: metadata}, group: ""},
+		{node: &core.Node{Id: "d"}, group: ""},
+	}
+
+	for _, tc := range testCases {
+		group, ok := MatchNodeGroup(groups, tc.node)
+		if group != tc.group || ok != (tc.group != "") {
+			t.Errorf("node %s: expected group %q, got %q", tc.node.Id, tc.group, group)
+		}
+	}
+}
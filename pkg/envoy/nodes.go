@@ -0,0 +1,183 @@
+package envoy
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/status"
+)
+
+// NodeStatus is what a connected envoy node has been sent and has acknowledged
+type NodeStatus struct {
+	ID             string                 `json:"id"`
+	Cluster        string                 `json:"cluster,omitempty"`
+	Streams        int                    `json:"streams"`
+	ConnectedSince time.Time              `json:"connectedSince"`
+	Types          map[string]*TypeStatus `json:"types"`
+}
+
+// TypeStatus is the state of a resource type on a node
+type TypeStatus struct {
+	SentVersion  string      `json:"sentVersion,omitempty"`
+	AckedVersion string      `json:"ackedVersion,omitempty"`
+	LastNack     *NackStatus `json:"lastNack,omitempty"`
+
+	nonce string
+}
+
+// NackStatus is a version rejected by a node and why
+type NackStatus struct {
+	Version string    `json:"version"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+type streamKey struct {
+	id    int64
+	delta bool
+}
+
+// NodeTracker follows the xDS streams of the envoy nodes to tell which nodes are connected,
+// which versions they have been sent and which ones they have accepted or rejected
+type NodeTracker struct {
+	nodes   map[string]*NodeStatus
+	streams map[streamKey]string
+	sync.Mutex
+}
+
+// NewNodeTracker returns a NodeTracker without any node
+func NewNodeTracker() *NodeTracker {
+	return &NodeTracker{nodes: map[string]*NodeStatus{}, streams: map[streamKey]string{}}
+}
+
+// StreamRequest records a request of a node. A request answering the last response sent for its type
+// acknowledges the response version, unless it carries an error detail, in which case the version is rejected
+func (t *NodeTracker) StreamRequest(streamID int64, delta bool, node *core.Node, typeURL string, version string, nonce string, errorDetail *status.Status) {
+	t.Lock()
+	defer t.Unlock()
+
+	key := streamKey{id: streamID, delta: delta}
+	nodeID, ok := t.streams[key]
+	if !ok {
+		if node == nil {
+			return
+		}
+		nodeID = node.Id
+		t.streams[key] = nodeID
+		if _, ok := t.nodes[nodeID]; !ok {
+			t.nodes[nodeID] = &NodeStatus{ID: nodeID, Cluster: node.Cluster, ConnectedSince: time.Now(), Types: map[string]*TypeStatus{}}
+		}
+		t.nodes[nodeID].Streams++
+		connectedNodes.Set(float64(len(t.nodes)))
+	}
+
+	typeStatus := t.nodes[nodeID].typeStatus(typeURL)
+	if nonce == "" {
+		// a reconnecting node tells the version it last accepted
+		if version != "" {
+			typeStatus.AckedVersion = version
+		}
+		return
+	}
+	if nonce != typeStatus.nonce {
+		return
+	}
+
+	typeName := shortTypeName(typeURL)
+	if errorDetail != nil {
+		logrus.Warnf("node %s rejected %s version %s: %s", nodeID, typeName, typeStatus.SentVersion, errorDetail.Message)
+		typeStatus.LastNack = &NackStatus{Version: typeStatus.SentVersion, Message: errorDetail.Message, Time: time.Now()}
+		xdsNacks.WithLabelValues(typeName).Inc()
+		nodeNacked.WithLabelValues(nodeID, typeName).Set(1)
+	} else {
+		typeStatus.AckedVersion = typeStatus.SentVersion
+		xdsAcks.WithLabelValues(typeName).Inc()
+		nodeNacked.WithLabelValues(nodeID, typeName).Set(0)
+	}
+	nodeInSync.WithLabelValues(nodeID, typeName).Set(boolToFloat(typeStatus.AckedVersion == typeStatus.SentVersion))
+}
+
+// StreamResponse records a response sent to a node
+func (t *NodeTracker) StreamResponse(streamID int64, delta bool, typeURL string, version string, nonce string) {
+	t.Lock()
+	defer t.Unlock()
+
+	nodeID, ok := t.streams[streamKey{id: streamID, delta: delta}]
+	if !ok {
+		return
+	}
+
+	typeStatus := t.nodes[nodeID].typeStatus(typeURL)
+	typeStatus.SentVersion = version
+	typeStatus.nonce = nonce
+	nodeInSync.WithLabelValues(nodeID, shortTypeName(typeURL)).Set(boolToFloat(typeStatus.AckedVersion == version))
+}
+
+// StreamClosed forgets a stream, and its node once the node has no stream left
+func (t *NodeTracker) StreamClosed(streamID int64, delta bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	key := streamKey{id: streamID, delta: delta}
+	nodeID, ok := t.streams[key]
+	if !ok {
+		return
+	}
+	delete(t.streams, key)
+
+	node := t.nodes[nodeID]
+	node.Streams--
+	if node.Streams > 0 {
+		return
+	}
+	delete(t.nodes, nodeID)
+	for typeURL := range node.Types {
+		nodeNacked.DeleteLabelValues(nodeID, shortTypeName(typeURL))
+		nodeInSync.DeleteLabelValues(nodeID, shortTypeName(typeURL))
+	}
+	connectedNodes.Set(float64(len(t.nodes)))
+}
+
+// Nodes returns the connected nodes, sorted by ID
+func (t *NodeTracker) Nodes() []NodeStatus {
+	t.Lock()
+	defer t.Unlock()
+
+	nodes := []NodeStatus{}
+	for _, node := range t.nodes {
+		copied := *node
+		copied.Types = map[string]*TypeStatus{}
+		for typeURL, typeStatus := range node.Types {
+			copiedType := *typeStatus
+			copied.Types[typeURL] = &copiedType
+		}
+		nodes = append(nodes, copied)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID < nodes[j].ID
+	})
+	return nodes
+}
+
+func (n *NodeStatus) typeStatus(typeURL string) *TypeStatus {
+	if _, ok := n.Types[typeURL]; !ok {
+		n.Types[typeURL] = &TypeStatus{}
+	}
+	return n.Types[typeURL]
+}
+
+// shortTypeName returns the message name of a type URL, such as Cluster or RouteConfiguration
+func shortTypeName(typeURL string) string {
+	return typeURL[strings.LastIndex(typeURL, ".")+1:]
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,61 @@
+package envoy
+
+import (
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
+)
+
+func TestNodeTrackerAcks(t *testing.T) {
+	tracker := NewNodeTracker()
+	node := &core.Node{Id: "envoy-1", Cluster: "edge"}
+
+	tracker.StreamRequest(1, false, node, resource.ClusterType, "", "", nil)
+	tracker.StreamResponse(1, false, resource.ClusterType, "v1", "nonce-1")
+	tracker.StreamRequest(1, false, node, resource.ClusterType, "v1", "nonce-1", nil)
+
+	tracker.StreamResponse(1, false, resource.ClusterType, "v2", "nonce-2")
+	tracker.StreamRequest(1, false, node, resource.ClusterType, "v1", "nonce-2", &status.Status{Message: "invalid cluster"})
+
+	nodes := tracker.Nodes()
+	if len(nodes) != 1 || nodes[0].ID != "envoy-1" || nodes[0].Cluster != "edge" || nodes[0].Streams != 1 {
+		t.Fatalf("expected the connected node, got %+v", nodes)
+	}
+	clusters := nodes[0].Types[resource.ClusterType]
+	if clusters.SentVersion != "v2" || clusters.AckedVersion != "v1" {
+		t.Errorf("expected v2 sent and v1 acked, got %+v", clusters)
+	}
+	if clusters.LastNack == nil || clusters.LastNack.Version != "v2" || clusters.LastNack.Message != "invalid cluster" {
+		t.Errorf("expected v2 to be nacked, got %+v", clusters.LastNack)
+	}
+
+	// a request answering an older response is not an acknowledgement of the current one
+	tracker.StreamResponse(1, false, resource.ClusterType, "v3", "nonce-3")
+	tracker.StreamRequest(1, false, node, resource.ClusterType, "v1", "nonce-2", nil)
+	if acked := tracker.Nodes()[0].Types[resource.ClusterType].AckedVersion; acked != "v1" {
+		t.Errorf("expected a stale nonce to be ignored, got %s acked", acked)
+	}
+}
+
+func TestNodeTrackerStreams(t *testing.T) {
+	tracker := NewNodeTracker()
+	node := &core.Node{Id: "envoy-1"}
+
+	tracker.StreamRequest(1, false, node, resource.ListenerType, "", "", nil)
+	tracker.StreamRequest(1, true, node, resource.ListenerType, "", "", nil)
+	if nodes := tracker.Nodes(); len(nodes) != 1 || nodes[0].Streams != 2 {
+		t.Fatalf("expected one node with two streams, got %+v", nodes)
+	}
+
+	tracker.StreamClosed(1, false)
+	if nodes := tracker.Nodes(); len(nodes) != 1 || nodes[0].Streams != 1 {
+		t.Fatalf("expected the node to stay connected over its delta stream, got %+v", nodes)
+	}
+
+	tracker.StreamClosed(1, true)
+	if nodes := tracker.Nodes(); len(nodes) != 0 {
+		t.Errorf("expected the node to be forgotten once disconnected, got %+v", nodes)
+	}
+}
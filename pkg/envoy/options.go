@@ -1,5 +1,7 @@
 package envoy
 
+import "time"
+
 type option func(c *KubernetesConfigurator)
 
 // WithEWithEnvoyListenerIpv4AddressnvoyPort configures envoy IPv4 listen address into a KubernetesConfigurator
@@ -23,6 +25,13 @@ func WithUpstreamPort(port uint32) option {
 	}
 }
 
+// WithSourceOptions configures the per source cluster options into a KubernetesConfigurator
+func WithSourceOptions(sourceOptions map[string]SourceOptions) option {
+	return func(c *KubernetesConfigurator) {
+		c.sourceOptions = sourceOptions
+	}
+}
+
 // WithOutlierPercentage configures the given percentage as maximal outlier percentage into a KubernetesConfigurator
 func WithOutlierPercentage(percentage int32) option {
 	return func(c *KubernetesConfigurator) {
@@ -92,3 +101,87 @@ func WithTracingProvider(tracingProvider string) option {
 		c.tracingProvider = tracingProvider
 	}
 }
+
+// WithGatewayClasses configures the Gateway API gateway classes to select HTTPRoutes from
+func WithGatewayClasses(gatewayClasses []string) option {
+	return func(c *KubernetesConfigurator) {
+		c.gatewayClasses = gatewayClasses
+	}
+}
+
+// WithEndpointDiscovery configures the KubernetesConfigurator to resolve the upstream hosts and serve them over EDS
+func WithEndpointDiscovery(enabled bool) option {
+	return func(c *KubernetesConfigurator) {
+		c.endpointDiscovery = enabled
+	}
+}
+
+// WithResolver configures the resolver used to look up upstream hosts into a KubernetesConfigurator
+func WithResolver(resolver Resolver) option {
+	return func(c *KubernetesConfigurator) {
+		c.resolver = resolver
+	}
+}
+
+// WithUpstreamGracePeriod configures how long the removed upstreams, and the ones of the ingresses being deleted,
+// are kept draining before being removed, 0 removes them right away
+func WithUpstreamGracePeriod(gracePeriod time.Duration) option {
+	return func(c *KubernetesConfigurator) {
+		c.upstreamGracePeriod = gracePeriod
+	}
+}
+
+type snapshotterOption func(s *Snapshotter)
+
+// WithRefreshInterval configures the Snapshotter to regenerate the snapshot at least every interval,
+// so that the upstream hosts resolved for EDS follow DNS changes
+func WithRefreshInterval(interval time.Duration) snapshotterOption {
+	return func(s *Snapshotter) {
+		s.refreshInterval = interval
+	}
+}
+
+// WithResyncInterval configures how often the snapshot is rebuilt from all the resources, 0 disables it
+func WithResyncInterval(interval time.Duration) snapshotterOption {
+	return func(s *Snapshotter) {
+		s.resyncInterval = interval
+	}
+}
+
+// WithDebounce configures how long the Snapshotter waits for Kubernetes changes to settle,
+// and how long it may delay a snapshot at most while changes keep coming
+func WithDebounce(window time.Duration, maxDelay time.Duration) snapshotterOption {
+	return func(s *Snapshotter) {
+		s.debounceWindow = window
+		s.maxDelay = maxDelay
+	}
+}
+
+// WithMaxRetryDelay configures how long the Snapshotter may wait at most before retrying a failing snapshot
+func WithMaxRetryDelay(delay time.Duration) snapshotterOption {
+	return func(s *Snapshotter) {
+		s.maxRetryDelay = delay
+	}
+}
+
+// WithNodeGroups configures the Snapshotter to also generate the snapshots of the given node groups
+func WithNodeGroups(configurators ...Configurator) snapshotterOption {
+	return func(s *Snapshotter) {
+		s.nodeGroups = append(s.nodeGroups, configurators...)
+	}
+}
+
+// WithHistory configures how many published snapshots are kept for each node ID, and the directory they are written to when set
+func WithHistory(size int, dir string) snapshotterOption {
+	return func(s *Snapshotter) {
+		s.history = newSnapshotHistory(size, dir)
+	}
+}
+
+// WithDeletionGuard configures the Snapshotter to refuse the snapshots removing more than the given percentage
+// of the virtual hosts or clusters, or all the upstreams of a cluster, until overridden. 0 disables it
+func WithDeletionGuard(maxPercentage int) snapshotterOption {
+	return func(s *Snapshotter) {
+		s.maxDeletionPercentage = maxPercentage
+	}
+}
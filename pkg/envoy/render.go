@@ -0,0 +1,67 @@
+package envoy
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+
+	types "github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	resource "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// RenderedSnapshot is the configuration of a snapshot as envoy reads it, each type sorted by resource name
+type RenderedSnapshot struct {
+	Listeners []json.RawMessage `json:"listeners"`
+	Clusters  []json.RawMessage `json:"clusters"`
+	Routes    []json.RawMessage `json:"routes"`
+	Endpoints []json.RawMessage `json:"endpoints,omitempty"`
+}
+
+var renderOptions = protojson.MarshalOptions{UseProtoNames: true}
+
+// Render marshals the listeners, clusters, routes and endpoints of a snapshot into the envoy JSON format.
+// Secrets are left out so that the output does not contain private keys
+func Render(snapshot cache.ResourceSnapshot) (RenderedSnapshot, error) {
+	rendered := RenderedSnapshot{}
+	for typeURL, into := range map[string]*[]json.RawMessage{
+		resource.ListenerType: &rendered.Listeners,
+		resource.ClusterType:  &rendered.Clusters,
+		resource.RouteType:    &rendered.Routes,
+		resource.EndpointType: &rendered.Endpoints,
+	} {
+		resources, err := renderResources(snapshot.GetResources(typeURL))
+		if err != nil {
+			return RenderedSnapshot{}, err
+		}
+		*into = resources
+	}
+	if len(rendered.Endpoints) == 0 {
+		rendered.Endpoints = nil
+	}
+	return rendered, nil
+}
+
+func renderResources(resources map[string]types.Resource) ([]json.RawMessage, error) {
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rendered := []json.RawMessage{}
+	for _, name := range names {
+		marshaled, err := renderOptions.Marshal(resources[name])
+		if err != nil {
+			return nil, err
+		}
+		// protojson output is deliberately unstable, compacting it makes it comparable
+		compacted := &bytes.Buffer{}
+		if err := json.Compact(compacted, marshaled); err != nil {
+			return nil, err
+		}
+		rendered = append(rendered, compacted.Bytes())
+	}
+	return rendered, nil
+}
@@ -0,0 +1,34 @@
+package envoy
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/uswitch/yggdrasil/pkg/k8s"
+)
+
+func TestRender(t *testing.T) {
+	certificates := []Certificate{{Hosts: []string{"*.app.com"}, Cert: "b", Key: "private-key"}}
+	configurator := NewKubernetesConfigurator("a", certificates, "", []string{"bar"}, nil)
+	snapshot, err := configurator.Generate([]*k8s.Ingress{newGenericIngress("foo.app.com", "foo.cluster.com"), newGenericIngress("bar.app.com", "bar.cluster.com")}, nil)
+	if err != nil {
+		t.Fatalf("error generating snapshot %v", err)
+	}
+
+	rendered, err := Render(&snapshot)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(rendered.Listeners) != 1 || len(rendered.Clusters) != 2 || len(rendered.Routes) != 1 || rendered.Endpoints != nil {
+		t.Fatalf("unexpected resources %+v", rendered)
+	}
+	if !strings.Contains(string(rendered.Clusters[0]), `"name":"bar_app_com"`) {
+		t.Errorf("expected the clusters sorted by name with proto field names, got %s", rendered.Clusters[0])
+	}
+
+	bytes, _ := json.Marshal(rendered)
+	if strings.Contains(string(bytes), "private-key") {
+		t.Errorf("expected the private keys to be left out")
+	}
+}
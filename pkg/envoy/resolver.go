@@ -0,0 +1,72 @@
+package envoy
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	resolveTimeout     = 5 * time.Second
+	resolveConcurrency = 16
+)
+
+// Resolver looks up the addresses of the upstream hosts when endpoints are served over EDS,
+// net.Resolver satisfies it
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// resolveHosts looks up the addresses of the given hosts. IP addresses are used as they are
+// and the last known addresses of a host are kept when its lookup fails
+func (c *KubernetesConfigurator) resolveHosts(hosts []string) map[string][]string {
+	resolved := map[string][]string{}
+	seen := map[string]bool{}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, resolveConcurrency)
+
+	for _, host := range hosts {
+		if seen[host] {
+			continue
+		}
+		seen[host] = true
+
+		if net.ParseIP(host) != nil {
+			lock.Lock()
+			resolved[host] = []string{host}
+			lock.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(host string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+			defer cancel()
+
+			addresses, err := c.resolver.LookupHost(ctx, host)
+			if err != nil {
+				resolveErrors.Inc()
+				logrus.Warnf("failed to resolve %s, keeping %d last known addresses: %s", host, len(c.resolvedHosts[host]), err)
+				addresses = c.resolvedHosts[host]
+			}
+			sort.Strings(addresses)
+
+			lock.Lock()
+			resolved[host] = addresses
+			lock.Unlock()
+		}(host)
+	}
+	wg.Wait()
+
+	c.resolvedHosts = resolved
+	return resolved
+}
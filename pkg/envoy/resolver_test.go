@@ -0,0 +1,80 @@
+package envoy
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	v3cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	tcache "github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/uswitch/yggdrasil/pkg/k8s"
+	v1 "k8s.io/api/core/v1"
+)
+
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addresses, ok := r[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return addresses, nil
+}
+
+func TestResolveHosts(t *testing.T) {
+	resolver := fakeResolver{"lb.com": {"10.0.0.2", "10.0.0.1"}}
+	configurator := NewKubernetesConfigurator("a", nil, "", nil, nil, WithResolver(resolver))
+
+	resolved := configurator.resolveHosts([]string{"lb.com", "192.168.1.1", "lb.com"})
+	expected := map[string][]string{
+		"lb.com":      {"10.0.0.1", "10.0.0.2"},
+		"192.168.1.1": {"192.168.1.1"},
+	}
+	if !reflect.DeepEqual(resolved, expected) {
+		t.Errorf("expected %v, got %v", expected, resolved)
+	}
+
+	delete(resolver, "lb.com")
+	resolved = configurator.resolveHosts([]string{"lb.com"})
+	if !reflect.DeepEqual(resolved["lb.com"], []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("expected last known addresses to be kept on lookup failure, got %v", resolved["lb.com"])
+	}
+}
+
+func TestGenerateEndpointDiscovery(t *testing.T) {
+	resolver := fakeResolver{"bibble": {"10.0.0.1"}}
+	configurator := NewKubernetesConfigurator("a", nil, "", []string{"bar"}, []string{"192.168.0.0/16"},
+		WithEndpointDiscovery(true), WithResolver(resolver), WithUpstreamPort(443))
+
+	ingresses := []*k8s.Ingress{newGenericIngress("foo.app.com", "bibble")}
+	snapshot, err := configurator.Generate(ingresses, []*v1.Secret{})
+	if err != nil {
+		t.Fatalf("Error generating snapshot %v", err)
+	}
+
+	cluster := snapshot.Resources[tcache.Cluster].Items["foo_app_com"].Resource.(*v3cluster.Cluster)
+	if cluster.GetType() != v3cluster.Cluster_EDS || cluster.LoadAssignment != nil {
+		t.Errorf("expected an EDS cluster without load assignment, got %v", cluster)
+	}
+
+	assignment := snapshot.Resources[tcache.Endpoint].Items["foo_app_com"].Resource.(*endpoint.ClusterLoadAssignment)
+	lbEndpoints := assignment.Endpoints[0].LbEndpoints
+	if len(lbEndpoints) != 1 || lbEndpoints[0].GetEndpoint().Address.GetSocketAddress().Address != "10.0.0.1" {
+		t.Fatalf("expected the resolved address as endpoint, got %v", lbEndpoints)
+	}
+
+	resolver["bibble"] = []string{"10.0.0.1", "10.0.0.2"}
+	updated, err := configurator.Generate(ingresses, []*v1.Secret{})
+	if err != nil {
+		t.Fatalf("Error generating snapshot %v", err)
+	}
+
+	if updated.Resources[tcache.Cluster].Version != snapshot.Resources[tcache.Cluster].Version {
+		t.Errorf("expected an endpoint change not to update the clusters")
+	}
+	if updated.Resources[tcache.Endpoint].Version == snapshot.Resources[tcache.Endpoint].Version {
+		t.Errorf("expected an endpoint change to update the endpoints")
+	}
+}
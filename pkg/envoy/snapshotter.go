@@ -2,6 +2,11 @@ package envoy
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	"github.com/sirupsen/logrus"
@@ -20,61 +25,321 @@ type Configurator interface {
 // Snapshotter watches for Ingress changes and updates the
 // config snapshot
 type Snapshotter struct {
-	snapshotCache cache.SnapshotCache
-	configurator  Configurator
-	aggregator    *k8s.Aggregator
+	snapshotCache   cache.SnapshotCache
+	configurator    Configurator
+	nodeGroups      []Configurator
+	aggregator      *k8s.Aggregator
+	refreshInterval time.Duration
+	resyncInterval  time.Duration
+	debounceWindow  time.Duration
+	maxDelay        time.Duration
+	history         *snapshotHistory
+
+	// maxRetryDelay bounds the delay before retrying a failing snapshot, doubled after every failure
+	maxRetryDelay time.Duration
+
+	// maxDeletionPercentage is how much of the virtual hosts or clusters a snapshot may remove, 0 disables the guard
+	maxDeletionPercentage int
+
+	// pinned are the node IDs rolled back to a version, latest their last generated snapshot
+	// and refused why it was not published by the deletion guard
+	pinned      map[string]string
+	latest      map[string]cache.ResourceSnapshot
+	refused     map[string]string
+	frozen      bool
+	publishLock sync.Mutex
+
+	status     SnapshotStatus
+	statusLock sync.RWMutex
 }
 
+// SnapshotStatus tells whether the last snapshots could be published, failed snapshots
+// are not published and envoy keeps being served the previous one
+type SnapshotStatus struct {
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastFailure *time.Time `json:"lastFailure,omitempty"`
+	// Error is why the last snapshot failed, it is empty when the last snapshot was published
+	Error string `json:"error,omitempty"`
+	// Pinned are the versions the node IDs were rolled back to
+	Pinned map[string]string `json:"pinned,omitempty"`
+	// Frozen is whether the publication of the snapshots is frozen
+	Frozen bool `json:"frozen,omitempty"`
+	// Refused are why the last snapshots of the node IDs were refused by the deletion guard
+	Refused map[string]string `json:"refused,omitempty"`
+}
+
+const (
+	defaultDebounceWindow = 100 * time.Millisecond
+	defaultMaxDelay       = time.Second
+	defaultMaxRetryDelay  = 5 * time.Minute
+)
+
 // NewSnapshotter returns a new Snapshotter
-func NewSnapshotter(snapshotCache cache.SnapshotCache, config Configurator, aggregator *k8s.Aggregator) *Snapshotter {
-	return &Snapshotter{snapshotCache: snapshotCache, configurator: config, aggregator: aggregator}
+func NewSnapshotter(snapshotCache cache.SnapshotCache, config Configurator, aggregator *k8s.Aggregator, options ...snapshotterOption) *Snapshotter {
+	s := &Snapshotter{snapshotCache: snapshotCache, configurator: config, aggregator: aggregator, debounceWindow: defaultDebounceWindow, maxDelay: defaultMaxDelay, maxRetryDelay: defaultMaxRetryDelay, history: newSnapshotHistory(defaultHistorySize, ""),
+		pinned: map[string]string{}, latest: map[string]cache.ResourceSnapshot{}, refused: map[string]string{}}
+	for _, opt := range options {
+		opt(s)
+	}
+	return s
 }
 
-func (s *Snapshotter) snapshot() error {
+func (s *Snapshotter) snapshot(changes ...string) error {
 	genericIngresses, err := s.aggregator.GetGenericIngresses()
 	if err != nil {
-		return err
+		return s.failed(err)
 	}
 	secrets, err := s.aggregator.GetSecrets()
 	if err != nil {
-		return err
+		return s.failed(err)
 	}
 
-	snapshot, err := s.configurator.Generate(genericIngresses, secrets)
+	// a failing node group does not prevent the others from being updated
+	errs := []string{}
+	for _, configurator := range append([]Configurator{s.configurator}, s.nodeGroups...) {
+		if err := s.publish(configurator, genericIngresses, secrets, changes); err != nil {
+			errs = append(errs, fmt.Sprintf("node %s: %s", configurator.NodeID(), err))
+		}
+	}
+	if len(errs) > 0 {
+		return s.failed(errors.New(strings.Join(errs, "; ")))
+	}
+
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	now := time.Now()
+	s.status.LastSuccess = &now
+	s.status.Error = ""
+	consecutiveSnapshotFailures.Set(0)
+
+	return nil
+}
+
+// publish generates the snapshot of a configurator and serves it to its nodes once validated, unless they are
+// pinned, frozen or it removes too many resources
+func (s *Snapshotter) publish(configurator Configurator, ingresses []*k8s.Ingress, secrets []*v1.Secret, changes []string) error {
+	snapshot, err := configurator.Generate(ingresses, secrets)
+	if err != nil {
+		return fmt.Errorf("failed to generate snapshot: %s", err)
+	}
+	if err := validateSnapshot(&snapshot); err != nil {
+		return fmt.Errorf("invalid snapshot: %s", err)
+	}
 
-	log.Debugf("took snapshot: %+v", snapshot)
+	log.Debugf("took snapshot of %s: %+v", configurator.NodeID(), snapshot)
 
-	s.snapshotCache.SetSnapshot(context.Background(), s.configurator.NodeID(), &snapshot)
+	nodeID := configurator.NodeID()
+	s.publishLock.Lock()
+	defer s.publishLock.Unlock()
+	s.latest[nodeID] = &snapshot
+	if held, reason := s.held(nodeID); held {
+		current, err := s.snapshotCache.GetSnapshot(nodeID)
+		if err == nil {
+			log.Debugf("not publishing the snapshot of %s %s", nodeID, reason)
+			heldSnapshots.WithLabelValues(nodeID).Set(boolToFloat(snapshotVersion(current) != snapshotVersion(&snapshot)))
+			return nil
+		}
+		// nothing is served yet, the nodes get the last published snapshot or this one when there is none
+		if last, ok := s.history.last(nodeID); ok {
+			log.Infof("serving the last published snapshot %s of %s %s", last.record.Version, nodeID, reason)
+			served, err := last.servable(&snapshot)
+			if err != nil {
+				return err
+			}
+			heldSnapshots.WithLabelValues(nodeID).Set(boolToFloat(snapshotVersion(served) != snapshotVersion(&snapshot)))
+			if err := s.snapshotCache.SetSnapshot(context.Background(), nodeID, served); err != nil {
+				return fmt.Errorf("failed to set snapshot: %s", err)
+			}
+			s.published(nodeID, served)
+			return nil
+		}
+	}
 
+	if !s.guard(nodeID, &snapshot) {
+		return nil
+	}
+	if err := s.snapshotCache.SetSnapshot(context.Background(), nodeID, &snapshot); err != nil {
+		return fmt.Errorf("failed to set snapshot: %s", err)
+	}
+	s.published(nodeID, &snapshot)
+	heldSnapshots.WithLabelValues(nodeID).Set(0)
+	s.history.record(nodeID, &snapshot, changes)
 	return nil
 }
 
+// publishListener is a configurator keeping state about its snapshots that only advances once they are served
+type publishListener interface {
+	Published(version string)
+}
+
+// published tells the configurator of a node ID that a snapshot is served to its nodes
+func (s *Snapshotter) published(nodeID string, snapshot cache.ResourceSnapshot) {
+	for _, configurator := range append([]Configurator{s.configurator}, s.nodeGroups...) {
+		if listener, ok := configurator.(publishListener); ok && configurator.NodeID() == nodeID {
+			listener.Published(snapshotVersion(snapshot))
+		}
+	}
+}
+
+// failed records the failure of a snapshot, the previous snapshot is kept
+func (s *Snapshotter) failed(err error) error {
+	snapshotFailures.Inc()
+	consecutiveSnapshotFailures.Inc()
+
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	now := time.Now()
+	s.status.LastFailure = &now
+	s.status.Error = err.Error()
+
+	return err
+}
+
+// Status returns whether the last snapshots could be published
+func (s *Snapshotter) Status() SnapshotStatus {
+	s.statusLock.RLock()
+	status := s.status
+	s.statusLock.RUnlock()
+
+	s.publishLock.Lock()
+	defer s.publishLock.Unlock()
+	status.Frozen = s.frozen
+	for nodeID, version := range s.pinned {
+		if status.Pinned == nil {
+			status.Pinned = map[string]string{}
+		}
+		status.Pinned[nodeID] = version
+	}
+	for nodeID, reason := range s.refused {
+		if status.Refused == nil {
+			status.Refused = map[string]string{}
+		}
+		status.Refused[nodeID] = reason
+	}
+	return status
+}
+
 func (s *Snapshotter) CurrentSnapshot() (cache.ResourceSnapshot, error) {
 	return s.snapshotCache.GetSnapshot(s.configurator.NodeID())
 }
 
-// Run will periodically refresh the snapshot
+// NodeSnapshot returns the current snapshot of a node group, or of the default nodes when empty
+func (s *Snapshotter) NodeSnapshot(nodeID string) (cache.ResourceSnapshot, error) {
+	if nodeID == "" {
+		return s.CurrentSnapshot()
+	}
+	return s.snapshotCache.GetSnapshot(nodeID)
+}
+
+// ingressErrorReporter is a configurator reporting the ingresses left out of its last snapshot
+type ingressErrorReporter interface {
+	IngressErrors() []IngressError
+}
+
+// IngressErrors returns the ingresses left out of the last snapshot of the default nodes and of each node group,
+// by node ID
+func (s *Snapshotter) IngressErrors() map[string][]IngressError {
+	ingressErrors := map[string][]IngressError{}
+	for _, configurator := range append([]Configurator{s.configurator}, s.nodeGroups...) {
+		if reporter, ok := configurator.(ingressErrorReporter); ok {
+			ingressErrors[configurator.NodeID()] = reporter.IngressErrors()
+		}
+	}
+	return ingressErrors
+}
+
+// Run takes a snapshot once the Kubernetes changes settle for the debounce window, or at the latest
+// after the maximum delay since the first change, as well as every refresh and resync interval.
+// A failing snapshot is retried after the maximum delay, doubled after every failure until the inputs change,
+// the refresh and resync intervals waiting for the retry
 func (s *Snapshotter) Run(a *k8s.Aggregator) {
 	log.Infof("started snapshotter")
-	hadChanges := false
-	for event := range a.Events() {
-		change := false
-		switch event.SyncType {
-		case k8s.COMMAND:
-			if hadChanges {
-				err := s.snapshot()
-				if err != nil {
-					logrus.Errorf("caught error in snapshot: %s", err)
-					continue
+
+	var pendingSince time.Time
+	var maxDelay <-chan time.Time
+	retryDelay := s.maxDelay
+	retrying := false
+	changes := &changeSet{}
+	// the first snapshot is taken even when there are no resources to sync
+	debounce := time.After(s.debounceWindow)
+	refresh := newTicker(s.refreshInterval)
+	resync := newTicker(s.resyncInterval)
+
+	for {
+		select {
+		case event, ok := <-a.Events():
+			if !ok {
+				return
+			}
+			if pendingSince.IsZero() {
+				pendingSince = event.Time
+				if pendingSince.IsZero() {
+					pendingSince = time.Now()
 				}
-				hadChanges = false
+				maxDelay = time.After(s.maxDelay)
+			}
+			changes.add(describeEvent(event))
+			debounce = time.After(s.debounceWindow)
+			retryDelay = s.maxDelay
+			continue
+		case <-debounce:
+		case <-maxDelay:
+		case <-refresh:
+			changes.add("refresh")
+			if retrying {
+				continue
+			}
+		case <-resync:
+			log.Debugf("resyncing snapshot")
+			changes.add("resync")
+			if retrying {
 				continue
 			}
-		case k8s.INGRESS:
-			change = true
-		case k8s.SECRET:
-			change = true
 		}
-		hadChanges = hadChanges || change
+
+		if err := s.snapshot(changes.list()...); err != nil {
+			logrus.Errorf("caught error in snapshot, keeping the previous one and retrying in %s: %s", retryDelay, err)
+			debounce, maxDelay = nil, time.After(retryDelay)
+			retryDelay = s.nextRetryDelay(retryDelay)
+			retrying = true
+			continue
+		}
+		retryDelay = s.maxDelay
+		retrying = false
+		if !pendingSince.IsZero() {
+			snapshotLatency.Observe(time.Since(pendingSince).Seconds())
+		}
+		pendingSince = time.Time{}
+		changes = &changeSet{}
+		debounce, maxDelay = nil, nil
+	}
+}
+
+// nextRetryDelay doubles the delay before retrying a failing snapshot, up to the maximum retry delay
+func (s *Snapshotter) nextRetryDelay(delay time.Duration) time.Duration {
+	delay *= 2
+	if delay <= 0 {
+		delay = defaultMaxDelay
+	}
+	if s.maxRetryDelay > 0 && delay > s.maxRetryDelay {
+		delay = s.maxRetryDelay
+	}
+	return delay
+}
+
+// describeEvent describes a Kubernetes change, such as ingress default/foo
+func describeEvent(event k8s.SyncDataEvent) string {
+	change := strings.ToLower(string(event.SyncType))
+	if key, ok := event.Data.(string); ok {
+		change = fmt.Sprintf("%s %s", change, key)
+	}
+	return change
+}
+
+// newTicker returns the channel of a ticker of the given interval, or nil when there is no interval
+func newTicker(interval time.Duration) <-chan time.Time {
+	if interval <= 0 {
+		return nil
 	}
+	return time.NewTicker(interval).C
 }
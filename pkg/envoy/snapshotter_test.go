@@ -0,0 +1,256 @@
+package envoy
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/uswitch/yggdrasil/pkg/k8s"
+	v1 "k8s.io/api/core/v1"
+)
+
+type countingConfigurator struct {
+	generated chan struct{}
+}
+
+func (c *countingConfigurator) Generate([]*k8s.Ingress, []*v1.Secret) (cache.Snapshot, error) {
+	c.generated <- struct{}{}
+	return cache.Snapshot{}, nil
+}
+
+func (c *countingConfigurator) NodeID() string {
+	return "a"
+}
+
+func expectSnapshots(t *testing.T, configurator *countingConfigurator, expected int, within time.Duration) {
+	t.Helper()
+	deadline := time.After(within)
+	for taken := 0; ; {
+		select {
+		case <-configurator.generated:
+			taken++
+			if taken > expected {
+				t.Fatalf("expected %d snapshots, got %d", expected, taken)
+			}
+		case <-deadline:
+			if taken != expected {
+				t.Fatalf("expected %d snapshots, got %d", expected, taken)
+			}
+			return
+		}
+	}
+}
+
+func TestSnapshotterDebounce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	aggregator := k8s.NewAggregator(nil, ctx, false, false)
+	configurator := &countingConfigurator{generated: make(chan struct{}, 100)}
+	snapshotter := NewSnapshotter(cache.NewSnapshotCache(true, cache.IDHash{}, nil), configurator, aggregator,
+		WithDebounce(50*time.Millisecond, time.Minute))
+	go snapshotter.Run(aggregator)
+
+	expectSnapshots(t, configurator, 1, 500*time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		aggregator.Events() <- k8s.SyncDataEvent{SyncType: k8s.INGRESS, Time: time.Now()}
+	}
+	expectSnapshots(t, configurator, 1, 500*time.Millisecond)
+}
+
+func TestSnapshotterMaxDelay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	aggregator := k8s.NewAggregator(nil, ctx, false, false)
+	configurator := &countingConfigurator{generated: make(chan struct{}, 100)}
+	snapshotter := NewSnapshotter(cache.NewSnapshotCache(true, cache.IDHash{}, nil), configurator, aggregator,
+		WithDebounce(200*time.Millisecond, 300*time.Millisecond))
+	go snapshotter.Run(aggregator)
+
+	expectSnapshots(t, configurator, 1, 500*time.Millisecond)
+
+	// changes coming faster than the debounce window are snapshotted after the maximum delay
+	stop := time.After(500 * time.Millisecond)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+Changes:
+	for {
+		select {
+		case <-ticker.C:
+			aggregator.Events() <- k8s.SyncDataEvent{SyncType: k8s.INGRESS, Time: time.Now()}
+		case <-stop:
+			break Changes
+		}
+	}
+
+	select {
+	case <-configurator.generated:
+	default:
+		t.Fatalf("expected a snapshot within the maximum delay while changes keep coming")
+	}
+}
+
+type failingConfigurator struct {
+	err error
+}
+
+func (c *failingConfigurator) Generate([]*k8s.Ingress, []*v1.Secret) (cache.Snapshot, error) {
+	return cache.Snapshot{}, c.err
+}
+
+func (c *failingConfigurator) NodeID() string {
+	return "a"
+}
+
+func TestSnapshotterKeepsPreviousSnapshotOnFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	aggregator := k8s.NewAggregator(nil, ctx, false, false)
+	configurator := &failingConfigurator{}
+	snapshotCache := cache.NewSnapshotCache(true, cache.IDHash{}, nil)
+	snapshotter := NewSnapshotter(snapshotCache, configurator, aggregator)
+
+	if err := snapshotter.snapshot(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	previous, err := snapshotter.CurrentSnapshot()
+	if err != nil {
+		t.Fatalf("expected a snapshot to be published, got %v", err)
+	}
+
+	configurator.err = errors.New("broken")
+	if err := snapshotter.snapshot(); err == nil {
+		t.Fatalf("expected the snapshot to fail")
+	}
+	if current, _ := snapshotter.CurrentSnapshot(); current != previous {
+		t.Errorf("expected the previous snapshot to be kept")
+	}
+	if status := snapshotter.Status(); !strings.Contains(status.Error, "broken") || status.LastFailure == nil {
+		t.Errorf("expected the failure in the status, got %+v", status)
+	}
+
+	configurator.err = nil
+	if err := snapshotter.snapshot(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if status := snapshotter.Status(); status.Error != "" {
+		t.Errorf("expected the error to be cleared once a snapshot succeeds, got %+v", status)
+	}
+}
+
+type nodeConfigurator struct {
+	failingConfigurator
+	nodeID string
+}
+
+func (c *nodeConfigurator) NodeID() string {
+	return c.nodeID
+}
+
+func TestSnapshotterNodeGroups(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	aggregator := k8s.NewAggregator(nil, ctx, false, false)
+	internal := &nodeConfigurator{nodeID: "internal"}
+	broken := &nodeConfigurator{nodeID: "broken", failingConfigurator: failingConfigurator{err: errors.New("broken")}}
+	snapshotter := NewSnapshotter(cache.NewSnapshotCache(true, cache.IDHash{}, nil), &failingConfigurator{}, aggregator,
+		WithNodeGroups(internal, broken))
+
+	err := snapshotter.snapshot()
+	if err == nil || !strings.Contains(err.Error(), "node broken") {
+		t.Fatalf("expected the broken node group to fail, got %v", err)
+	}
+	for _, nodeID := range []string{"", "internal"} {
+		if _, err := snapshotter.NodeSnapshot(nodeID); err != nil {
+			t.Errorf("expected a snapshot for %q despite the broken node group, got %v", nodeID, err)
+		}
+	}
+	if _, err := snapshotter.NodeSnapshot("broken"); err == nil {
+		t.Errorf("expected no snapshot for the broken node group")
+	}
+}
+
+func TestSnapshotterIngressErrorsOfNodeGroups(t *testing.T) {
+	invalid := newGenericIngress("bar.app.com", "bibble")
+	invalid.Namespace, invalid.Name = "ns", "invalid-path"
+	invalid.Annotations["kubernetes.io/ingress.class"] = "internal"
+	invalid.RulesPaths = map[string][]*k8s.IngressPath{
+		"bar.app.com": {{Path: "/api/(", PathType: k8s.PathTypeRegularExpression}},
+	}
+
+	defaultNodes := NewKubernetesConfigurator("a", nil, "", []string{"bar"}, nil)
+	internal := NewKubernetesConfigurator("internal", nil, "", []string{"internal"}, nil)
+	snapshotter := NewSnapshotter(cache.NewSnapshotCache(true, cache.IDHash{}, nil), defaultNodes, nil, WithNodeGroups(internal))
+	for _, configurator := range []*KubernetesConfigurator{defaultNodes, internal} {
+		if _, err := configurator.Generate([]*k8s.Ingress{newGenericIngress("foo.app.com", "bibble"), invalid}, nil); err != nil {
+			t.Fatalf("Error generating snapshot %v", err)
+		}
+	}
+
+	ingressErrors := snapshotter.IngressErrors()
+	if len(ingressErrors["a"]) != 0 {
+		t.Errorf("expected no errors for the default nodes, got %+v", ingressErrors["a"])
+	}
+	if len(ingressErrors["internal"]) != 1 || ingressErrors["internal"][0].Name != "invalid-path" {
+		t.Errorf("expected the invalid ingress of the node group to be reported, got %+v", ingressErrors["internal"])
+	}
+}
+
+type brokenConfigurator struct {
+	generated chan struct{}
+}
+
+func (c *brokenConfigurator) Generate([]*k8s.Ingress, []*v1.Secret) (cache.Snapshot, error) {
+	c.generated <- struct{}{}
+	return cache.Snapshot{}, errors.New("broken")
+}
+
+func (c *brokenConfigurator) NodeID() string {
+	return "a"
+}
+
+func TestSnapshotterBacksOffFailingSnapshots(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	aggregator := k8s.NewAggregator(nil, ctx, false, false)
+	configurator := &brokenConfigurator{generated: make(chan struct{}, 100)}
+	snapshotter := NewSnapshotter(cache.NewSnapshotCache(true, cache.IDHash{}, nil), configurator, aggregator,
+		WithDebounce(10*time.Millisecond, 20*time.Millisecond), WithMaxRetryDelay(time.Minute))
+	go snapshotter.Run(aggregator)
+
+	// retried after 20, 40, 80, 160 and 320ms rather than every 20ms
+	time.Sleep(700 * time.Millisecond)
+	if attempts := len(configurator.generated); attempts < 4 || attempts > 7 {
+		t.Fatalf("expected the failing snapshot to be retried with an increasing delay, got %d attempts", attempts)
+	}
+	for len(configurator.generated) > 0 {
+		<-configurator.generated
+	}
+
+	// a change is snapshotted right away and resets the delay
+	aggregator.Events() <- k8s.SyncDataEvent{SyncType: k8s.INGRESS, Time: time.Now()}
+	time.Sleep(100 * time.Millisecond)
+	if attempts := len(configurator.generated); attempts < 2 {
+		t.Errorf("expected a change to be retried with the initial delay again, got %d attempts", attempts)
+	}
+}
+
+func TestSnapshotterBacksOffFailingRefreshes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	aggregator := k8s.NewAggregator(nil, ctx, false, false)
+	configurator := &brokenConfigurator{generated: make(chan struct{}, 100)}
+	snapshotter := NewSnapshotter(cache.NewSnapshotCache(true, cache.IDHash{}, nil), configurator, aggregator,
+		WithDebounce(10*time.Millisecond, 20*time.Millisecond), WithMaxRetryDelay(time.Minute),
+		WithRefreshInterval(10*time.Millisecond), WithResyncInterval(15*time.Millisecond))
+	go snapshotter.Run(aggregator)
+
+	// the refreshes and resyncs wait for the retries after 20, 40, 80, 160 and 320ms
+	time.Sleep(700 * time.Millisecond)
+	if attempts := len(configurator.generated); attempts < 4 || attempts > 7 {
+		t.Errorf("expected the refreshes not to retry the failing snapshot, got %d attempts", attempts)
+	}
+}
@@ -0,0 +1,74 @@
+package envoy
+
+import (
+	"fmt"
+	"sort"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	tcache "github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+)
+
+// validateSnapshot checks that the resources of the snapshot reference each other consistently,
+// and that the route configurations are free of mistakes envoy would reject or serve errors for
+func validateSnapshot(snapshot *cache.Snapshot) error {
+	if err := snapshot.Consistent(); err != nil {
+		return err
+	}
+
+	clusters := snapshot.Resources[tcache.Cluster].Items
+	routes := snapshot.Resources[tcache.Route].Items
+
+	names := make([]string, 0, len(routes))
+	for name := range routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		routeConfiguration, ok := routes[name].Resource.(*route.RouteConfiguration)
+		if !ok {
+			return fmt.Errorf("unexpected resource in route configuration %s: %T", name, routes[name].Resource)
+		}
+
+		domains := map[string]string{}
+		for _, virtualHost := range routeConfiguration.VirtualHosts {
+			for _, domain := range virtualHost.Domains {
+				if other, ok := domains[domain]; ok {
+					return fmt.Errorf("domain %s of route configuration %s is in both virtual hosts %s and %s", domain, name, other, virtualHost.Name)
+				}
+				domains[domain] = virtualHost.Name
+			}
+
+			for _, r := range virtualHost.Routes {
+				for _, cluster := range routeClusters(r) {
+					if _, ok := clusters[cluster]; !ok {
+						return fmt.Errorf("virtual host %s of route configuration %s references unknown cluster %s", virtualHost.Name, name, cluster)
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// routeClusters returns the clusters a route sends requests to
+func routeClusters(r *route.Route) []string {
+	action := r.GetRoute()
+	if action == nil {
+		return nil
+	}
+
+	clusters := []string{}
+	if action.GetCluster() != "" {
+		clusters = append(clusters, action.GetCluster())
+	}
+	for _, weightedCluster := range action.GetWeightedClusters().GetClusters() {
+		clusters = append(clusters, weightedCluster.Name)
+	}
+	for _, mirror := range action.RequestMirrorPolicies {
+		clusters = append(clusters, mirror.Cluster)
+	}
+	return clusters
+}
@@ -0,0 +1,87 @@
+package envoy
+
+import (
+	"strings"
+	"testing"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	tcache "github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/uswitch/yggdrasil/pkg/k8s"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateGeneratedSnapshots(t *testing.T) {
+	ingress := newGenericIngress("foo.app.com", "bibble")
+	ingress.Namespace = "ns"
+	ingress.TLS = map[string]*k8s.IngressTLS{
+		"foo.app.com": {Host: "foo.app.com", SecretName: "foo-tls"},
+	}
+	ingresses := []*k8s.Ingress{ingress, newGenericIngress("bar.app.com", "bibble")}
+	secrets := []*v1.Secret{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "foo-tls"},
+		Data:       map[string][]byte{"tls.crt": []byte(p256crt), "tls.key": []byte(p256key)},
+	}}
+	certificates := []Certificate{{Hosts: []string{"*.app.com"}, Cert: "b", Key: "c"}}
+
+	configurators := map[string]*KubernetesConfigurator{
+		"http":               NewKubernetesConfigurator("a", nil, "", []string{"bar"}, nil),
+		"certificates":       NewKubernetesConfigurator("a", certificates, "", []string{"bar"}, nil),
+		"synced secrets":     NewKubernetesConfigurator("a", certificates, "", []string{"bar"}, nil, WithSyncSecrets(true)),
+		"endpoint discovery": NewKubernetesConfigurator("a", nil, "", []string{"bar"}, nil, WithEndpointDiscovery(true), WithResolver(fakeResolver{"bibble": {"10.0.0.1"}})),
+	}
+
+	for name, configurator := range configurators {
+		snapshot, err := configurator.Generate(ingresses, secrets)
+		if err != nil {
+			t.Fatalf("%s: error generating snapshot %v", name, err)
+		}
+		if err := validateSnapshot(&snapshot); err != nil {
+			t.Errorf("%s: expected a valid snapshot, got %s", name, err)
+		}
+	}
+}
+
+func TestValidateSnapshotErrors(t *testing.T) {
+	configurator := NewKubernetesConfigurator("a", nil, "", []string{"bar"}, nil)
+
+	testCases := []struct {
+		name   string
+		modify func(routeConfiguration *route.RouteConfiguration)
+		err    string
+	}{
+		{
+			name: "duplicate domain",
+			modify: func(routeConfiguration *route.RouteConfiguration) {
+				routeConfiguration.VirtualHosts[1].Domains = routeConfiguration.VirtualHosts[0].Domains
+			},
+			err: "domain bar.app.com",
+		},
+		{
+			name: "dangling cluster",
+			modify: func(routeConfiguration *route.RouteConfiguration) {
+				routeConfiguration.VirtualHosts[0].Routes[0].GetRoute().ClusterSpecifier = &route.RouteAction_Cluster{Cluster: "missing"}
+			},
+			err: "unknown cluster missing",
+		},
+	}
+
+	for _, tc := range testCases {
+		snapshot, err := configurator.Generate([]*k8s.Ingress{newGenericIngress("foo.app.com", "bibble"), newGenericIngress("bar.app.com", "bibble")}, nil)
+		if err != nil {
+			t.Fatalf("%s: error generating snapshot %v", tc.name, err)
+		}
+		tc.modify(snapshot.Resources[tcache.Route].Items[defaultRouteName].Resource.(*route.RouteConfiguration))
+
+		if err := validateSnapshot(&snapshot); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected an error about %q, got %v", tc.name, tc.err, err)
+		}
+	}
+
+	inconsistent := cache.Snapshot{}
+	inconsistent.Resources[tcache.Route] = cache.NewResources("1", []tcache.Resource{makeRouteConfiguration("orphan", nil)})
+	if err := validateSnapshot(&inconsistent); err == nil {
+		t.Errorf("expected a route configuration not referenced by any listener to be inconsistent")
+	}
+}
@@ -0,0 +1,59 @@
+package envoy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+
+	tcache "github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cache "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+var deterministic = proto.MarshalOptions{Deterministic: true}
+
+// newAny wraps the given message like anypb.New but marshals it deterministically,
+// so that equal configurations always produce equal bytes
+func newAny(m proto.Message) (*anypb.Any, error) {
+	a := &anypb.Any{}
+	if err := anypb.MarshalFrom(a, m, deterministic); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// resourcesVersion hashes the given resources into a version which only changes with their content,
+// replicas generating the same resources hand out the same version
+func resourcesVersion(resources []tcache.Resource) (string, error) {
+	sorted := make([]tcache.Resource, len(resources))
+	copy(sorted, resources)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return cache.GetResourceName(sorted[i]) < cache.GetResourceName(sorted[j])
+	})
+
+	hash := sha256.New()
+	for _, resource := range sorted {
+		bytes, err := deterministic.Marshal(resource)
+		if err != nil {
+			return "", err
+		}
+		length := make([]byte, 8)
+		binary.BigEndian.PutUint64(length, uint64(len(bytes)))
+		hash.Write(length)
+		hash.Write(bytes)
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16], nil
+}
+
+// snapshotVersion hashes the versions of every resource type of a snapshot into the version of the snapshot
+func snapshotVersion(snapshot cache.ResourceSnapshot) string {
+	hash := sha256.New()
+	for i := 0; i < int(tcache.UnknownType); i++ {
+		typeURL, _ := cache.GetResponseTypeURL(tcache.ResponseType(i))
+		hash.Write([]byte(snapshot.GetVersion(typeURL)))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
@@ -0,0 +1,190 @@
+package envoy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// XDSCertificates serves the certificate of the xDS server and the CA verifying its clients,
+// reloading them when their files change
+type XDSCertificates struct {
+	certPath string
+	keyPath  string
+	caPath   string
+
+	certPEM     []byte
+	keyPEM      []byte
+	caPEM       []byte
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	sync.RWMutex
+}
+
+// NewXDSCertificates loads the certificate and key of the xDS server, and the CA verifying the client
+// certificates when caPath is set
+func NewXDSCertificates(certPath, keyPath, caPath string) (*XDSCertificates, error) {
+	c := &XDSCertificates{certPath: certPath, keyPath: keyPath, caPath: caPath}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Watch reloads the files every interval until the context is done
+func (c *XDSCertificates) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := c.reload()
+			if err != nil {
+				log.Errorf("failed to reload the xDS server certificates, keeping the previous ones: %s", err)
+				continue
+			}
+			if reloaded {
+				log.Infof("reloaded the xDS server certificates")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reload reads the files again and returns whether they changed
+func (c *XDSCertificates) reload() (bool, error) {
+	certPEM, err := ioutil.ReadFile(c.certPath)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := ioutil.ReadFile(c.keyPath)
+	if err != nil {
+		return false, err
+	}
+	caPEM := []byte{}
+	if c.caPath != "" {
+		caPEM, err = ioutil.ReadFile(c.caPath)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	c.RLock()
+	changed := !bytes.Equal(certPEM, c.certPEM) || !bytes.Equal(keyPEM, c.keyPEM) || !bytes.Equal(caPEM, c.caPEM)
+	c.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, fmt.Errorf("invalid certificate %s: %s", c.certPath, err)
+	}
+	var clientCAs *x509.CertPool
+	if c.caPath != "" {
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return false, fmt.Errorf("no certificate found in %s", c.caPath)
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.certPEM, c.keyPEM, c.caPEM = certPEM, keyPEM, caPEM
+	c.certificate = &certificate
+	c.clientCAs = clientCAs
+	return true, nil
+}
+
+// TLSConfig returns a TLS configuration always using the last loaded files.
+// Client certificates are required and verified when a CA is set
+func (c *XDSCertificates) TLSConfig() *tls.Config {
+	// the configuration returned for each client replaces the outer one, so it keeps its fields, such as the
+	// h2 protocol gRPC requires to be negotiated
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2"},
+	}
+	config := base.Clone()
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c.RLock()
+		defer c.RUnlock()
+		config := base.Clone()
+		config.Certificates = []tls.Certificate{*c.certificate}
+		if c.clientCAs != nil {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+			config.ClientCAs = c.clientCAs
+		}
+		return config, nil
+	}
+	return config
+}
+
+// NodeAuthorizer restricts the node IDs the xDS clients may request to the ones allowed for their certificate identities
+type NodeAuthorizer struct {
+	allowed map[string]map[string]bool
+}
+
+// NewNodeAuthorizer returns a NodeAuthorizer allowing each client certificate identity, a URI or DNS SAN or
+// the subject common name, to request the given node IDs. "*" allows an identity to request any node ID
+func NewNodeAuthorizer(identities map[string][]string) *NodeAuthorizer {
+	allowed := map[string]map[string]bool{}
+	for identity, nodeIDs := range identities {
+		allowed[identity] = map[string]bool{}
+		for _, nodeID := range nodeIDs {
+			allowed[identity][nodeID] = true
+		}
+	}
+	return &NodeAuthorizer{allowed: allowed}
+}
+
+// Authorize returns a PermissionDenied error unless the client certificate of the stream allows the node ID.
+// Every node ID is allowed when no identity is configured
+func (a *NodeAuthorizer) Authorize(ctx context.Context, nodeID string) error {
+	if a == nil || len(a.allowed) == 0 {
+		return nil
+	}
+
+	identities := clientIdentities(ctx)
+	for _, identity := range identities {
+		if a.allowed[identity][nodeID] || a.allowed[identity]["*"] {
+			return nil
+		}
+	}
+	return status.Errorf(codes.PermissionDenied, "client %v is not allowed to request node %s", identities, nodeID)
+}
+
+// clientIdentities returns the URI and DNS SANs and the common name of the verified client certificate
+func clientIdentities(ctx context.Context) []string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 {
+		return nil
+	}
+
+	certificate := tlsInfo.State.VerifiedChains[0][0]
+	identities := []string{}
+	for _, uri := range certificate.URIs {
+		identities = append(identities, uri.String())
+	}
+	identities = append(identities, certificate.DNSNames...)
+	if certificate.Subject.CommonName != "" {
+		identities = append(identities, certificate.Subject.CommonName)
+	}
+	return identities
+}
@@ -0,0 +1,194 @@
+package envoy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func newTestCertificate(t *testing.T, commonName string) (*x509.Certificate, []byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, _ := url.Parse("spiffe://cluster.local/ns/edge/sa/" + commonName)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		URIs:         []*url.URL{uri},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return certificate, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestXDSCertificatesReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath, caPath := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+
+	_, certPEM, keyPEM := newTestCertificate(t, "first")
+	ioutil.WriteFile(certPath, certPEM, 0600)
+	ioutil.WriteFile(keyPath, keyPEM, 0600)
+	ioutil.WriteFile(caPath, certPEM, 0600)
+
+	certificates, err := NewXDSCertificates(certPath, keyPath, caPath)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	config, _ := certificates.TLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if config.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("expected client certificates to be required with a CA")
+	}
+	first := config.Certificates[0].Certificate[0]
+
+	if reloaded, err := certificates.reload(); reloaded || err != nil {
+		t.Errorf("expected unchanged files not to be reloaded, got %v, %v", reloaded, err)
+	}
+
+	_, certPEM, keyPEM = newTestCertificate(t, "second")
+	ioutil.WriteFile(certPath, certPEM, 0600)
+	ioutil.WriteFile(keyPath, []byte("garbage"), 0600)
+	if _, err := certificates.reload(); err == nil {
+		t.Errorf("expected an invalid key to fail the reload")
+	}
+	config, _ = certificates.TLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if string(config.Certificates[0].Certificate[0]) != string(first) {
+		t.Errorf("expected the previous certificate to be kept after a failed reload")
+	}
+
+	ioutil.WriteFile(keyPath, keyPEM, 0600)
+	if reloaded, err := certificates.reload(); !reloaded || err != nil {
+		t.Fatalf("expected the new certificate to be reloaded, got %v, %v", reloaded, err)
+	}
+	config, _ = certificates.TLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if string(config.Certificates[0].Certificate[0]) == string(first) {
+		t.Errorf("expected the new certificate to be served")
+	}
+}
+
+func TestXDSCertificatesGRPCHandshake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath, caPath := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+
+	_, certPEM, keyPEM := newTestCertificate(t, "server")
+	_, clientCertPEM, clientKeyPEM := newTestCertificate(t, "edge")
+	ioutil.WriteFile(certPath, certPEM, 0600)
+	ioutil.WriteFile(keyPath, keyPEM, 0600)
+	ioutil.WriteFile(caPath, clientCertPEM, 0600)
+
+	certificates, err := NewXDSCertificates(certPath, keyPath, caPath)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(certificates.TLSConfig())))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(lis)
+	defer server.Stop()
+
+	clientCertificate, err := tls.X509KeyPair(clientCertPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig := &tls.Config{
+		Certificates: []tls.Certificate{clientCertificate},
+		// the test certificate has no SAN matching the address of the listener
+		InsecureSkipVerify: true,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, lis.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(clientConfig)), grpc.WithBlock())
+	if err != nil {
+		t.Fatalf("error connecting to the server %v", err)
+	}
+	defer conn.Close()
+
+	var p peer.Peer
+	if _, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Peer(&p)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if protocol := p.AuthInfo.(credentials.TLSInfo).State.NegotiatedProtocol; protocol != "h2" {
+		t.Errorf("expected h2 to be negotiated, got %q", protocol)
+	}
+}
+
+func TestNodeAuthorizer(t *testing.T) {
+	edge, _, _ := newTestCertificate(t, "edge")
+	admin, _, _ := newTestCertificate(t, "admin")
+	clientContext := func(certificate *x509.Certificate) context.Context {
+		state := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{certificate}}}
+		return peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{State: state}})
+	}
+
+	authorizer := NewNodeAuthorizer(map[string][]string{
+		"spiffe://cluster.local/ns/edge/sa/edge": {"edge", "internal"},
+		"admin":                                  {"*"},
+	})
+
+	testCases := []struct {
+		name    string
+		ctx     context.Context
+		nodeID  string
+		allowed bool
+	}{
+		{name: "allowed uri", ctx: clientContext(edge), nodeID: "internal", allowed: true},
+		{name: "other node", ctx: clientContext(edge), nodeID: "public", allowed: false},
+		{name: "wildcard common name", ctx: clientContext(admin), nodeID: "public", allowed: true},
+		{name: "no client certificate", ctx: context.Background(), nodeID: "edge", allowed: false},
+	}
+
+	for _, tc := range testCases {
+		err := authorizer.Authorize(tc.ctx, tc.nodeID)
+		if tc.allowed && err != nil {
+			t.Errorf("%s: expected to be allowed, got %v", tc.name, err)
+		}
+		if !tc.allowed && status.Code(err) != codes.PermissionDenied {
+			t.Errorf("%s: expected to be denied, got %v", tc.name, err)
+		}
+	}
+
+	if err := NewNodeAuthorizer(nil).Authorize(context.Background(), "edge"); err != nil {
+		t.Errorf("expected every node to be allowed without identities, got %v", err)
+	}
+}
@@ -3,6 +3,8 @@ package k8s
 import (
 	"context"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -10,6 +12,8 @@ import (
 	"k8s.io/api/extensions/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
@@ -19,101 +23,370 @@ type IngressLister interface {
 	List() ([]v1beta1.Ingress, error)
 }
 
+// Source is a Kubernetes cluster watched by the aggregator
+type Source struct {
+	Name     string
+	Locality Locality
+	// Namespaces restricts the namespaces ingresses, secrets and routes are read from, all of them when empty
+	Namespaces    []string
+	Client        kubernetes.Interface
+	DynamicClient dynamic.Interface
+}
+
+// SourceAnnotation is set on the secrets read from the source clusters to the name of their cluster
+const SourceAnnotation = "yggdrasil.uswitch.com/source"
+
+// SecretSource returns the name of the source cluster a secret was read from
+func SecretSource(secret *v1.Secret) string {
+	return secret.Annotations[SourceAnnotation]
+}
+
+// withSource returns a copy of the secret annotated with the name of its source cluster,
+// sharing its data with the secret of the store
+func withSource(secret *v1.Secret, source *Source) *v1.Secret {
+	if source == nil || source.Name == "" {
+		return secret
+	}
+	sourced := *secret
+	sourced.Annotations = map[string]string{}
+	for key, value := range secret.Annotations {
+		sourced.Annotations[key] = value
+	}
+	sourced.Annotations[SourceAnnotation] = source.Name
+	return &sourced
+}
+
+// namespaces returns the namespaces the informers of the source are scoped to, every namespace when none is listed,
+// so that a source may be read with the permissions of its namespaces only
+func (s *Source) namespaces() []string {
+	if len(s.Namespaces) == 0 {
+		return []string{metav1.NamespaceAll}
+	}
+	return s.Namespaces
+}
+
+// Locality is where the upstreams of a source run, upstreams of a lower priority
+// (higher value) only receive traffic when the ones of higher priorities are unhealthy
+type Locality struct {
+	Region   string
+	Zone     string
+	Priority uint32
+}
+
 type Aggregator struct {
-	factories     []*informers.SharedInformerFactory
-	events        chan SyncDataEvent
-	ingressStores []cache.Store
-	secretsStore  []cache.Store
+	factories        []*informers.SharedInformerFactory
+	events           chan SyncDataEvent
+	ingressStores    []cache.Store
+	ingressSources   []*Source
+	secretsStore     []cache.Store
+	secretsSources   []*Source
+	gatewayAPIStores []*gatewayAPIStores
+
+	syncTimeout    time.Duration
+	retryInterval  time.Duration
+	stalenessLimit time.Duration
+	statuses       map[*Source]*SourceStatus
+	sync.RWMutex
+}
+
+// SourceStatus is the sync state of a source cluster
+type SourceStatus struct {
+	Name             string     `json:"name"`
+	Synced           bool       `json:"synced"`
+	Reachable        bool       `json:"reachable"`
+	Stale            bool       `json:"stale"`
+	LastSynced       *time.Time `json:"lastSynced,omitempty"`
+	UnreachableSince *time.Time `json:"unreachableSince,omitempty"`
+	LastError        string     `json:"lastError,omitempty"`
 }
 
+const (
+	defaultSyncTimeout   = 30 * time.Second
+	defaultRetryInterval = 10 * time.Second
+)
+
 func (a *Aggregator) Events() chan SyncDataEvent {
 	return a.events
 }
 
 func (a *Aggregator) GetSecrets() ([]*v1.Secret, error) {
+	a.RLock()
+	defer a.RUnlock()
+
 	allSecrets := make([]*v1.Secret, 0)
-	for _, store := range a.secretsStore {
+	for idx, store := range a.secretsStore {
+		if a.stale(a.secretsSources[idx]) {
+			continue
+		}
 		secrets := store.List()
 		for _, obj := range secrets {
 			secret, ok := obj.(*v1.Secret)
 			if !ok {
 				return nil, fmt.Errorf("unexpected object in store: %+v", obj)
 			}
-			allSecrets = append(allSecrets, secret)
+			allSecrets = append(allSecrets, withSource(secret, a.secretsSources[idx]))
 		}
 	}
 	return allSecrets, nil
 }
 
-// NewAggregator returns a new Aggregator initialized with resource informers
-func NewAggregator(k8sClients []*kubernetes.Clientset, ctx context.Context, syncSecrets bool) *Aggregator {
-	a := Aggregator{
+// SourceStatuses returns the sync state of every source cluster, sorted by name
+func (a *Aggregator) SourceStatuses() []SourceStatus {
+	a.RLock()
+	defer a.RUnlock()
+
+	statuses := []SourceStatus{}
+	for _, status := range a.statuses {
+		statuses = append(statuses, *status)
+	}
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// NewAggregator returns a new Aggregator initialized with resource informers. It waits for the sources
+// to sync up to the sync timeout, the sources which are not synced by then keep being retried in the background
+func NewAggregator(sources []*Source, ctx context.Context, syncSecrets bool, syncGatewayAPI bool, options ...aggregatorOption) *Aggregator {
+	a := &Aggregator{
 		events:        make(chan SyncDataEvent, watch.DefaultChanSize),
 		ingressStores: []cache.Store{},
 		secretsStore:  []cache.Store{},
+		syncTimeout:   defaultSyncTimeout,
+		retryInterval: defaultRetryInterval,
+		statuses:      map[*Source]*SourceStatus{},
+	}
+	for _, opt := range options {
+		opt(a)
+	}
+
+	synced := make(chan *Source, len(sources))
+	for _, source := range sources {
+		a.statuses[source] = &SourceStatus{Name: source.Name}
+		sourceSynced.WithLabelValues(source.Name).Set(0)
+		go a.watchSource(ctx, source, syncSecrets, syncGatewayAPI, synced)
+	}
+
+	var timeout <-chan time.Time
+	if a.syncTimeout > 0 {
+		timeout = time.After(a.syncTimeout)
+	}
+	for pending := len(sources); pending > 0; pending-- {
+		select {
+		case <-synced:
+		case <-timeout:
+			logrus.Warnf("%d of %d clusters not synced after %s, retrying them in the background", pending, len(sources), a.syncTimeout)
+			return a
+		case <-ctx.Done():
+			return a
+		}
+	}
+	return a
+}
+
+// watchSource starts the informers of a source, retrying until its API can be reached,
+// then keeps probing the API to tell whether the resources of the source are up to date
+func (a *Aggregator) watchSource(ctx context.Context, source *Source, syncSecrets bool, syncGatewayAPI bool, synced chan<- *Source) {
+	var informersSynced []cache.InformerSynced
+	for {
+		var err error
+		informersSynced, err = a.addSource(ctx, source, syncSecrets, syncGatewayAPI)
+		if err == nil {
+			break
+		}
+		a.setReachable(source, err)
+		logrus.Warnf("unable to watch cluster %s, retrying in %s: %s", source.Name, a.retryInterval, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(a.retryInterval):
+		}
+	}
+
+	if !cache.WaitForCacheSync(ctx.Done(), informersSynced...) {
+		return
+	}
+	a.setSynced(source)
+	logrus.Infof("synced cluster %s", source.Name)
+	synced <- source
+
+	ticker := time.NewTicker(a.retryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		_, err := source.Client.Discovery().ServerVersion()
+		if a.setReachable(source, err) {
+			a.notify(INGRESS, nil)
+		}
+	}
+}
+
+// addSource creates and starts the informers of a source, one per namespace of the source
+func (a *Aggregator) addSource(ctx context.Context, source *Source, syncSecrets bool, syncGatewayAPI bool) ([]cache.InformerSynced, error) {
+	c := source.Client
+	factories := []informers.SharedInformerFactory{}
+	for _, namespace := range source.namespaces() {
+		factories = append(factories, informers.NewSharedInformerFactoryWithOptions(c, time.Minute, informers.WithNamespace(namespace)))
+	}
+
+	ingressInformers, err := getIngressInformers(factories, source)
+	if err != nil {
+		return nil, err
 	}
-	informersSynced := []cache.InformerSynced{}
 
-	for _, c := range k8sClients {
-		factory := informers.NewSharedInformerFactory(c, time.Minute)
+	var gatewayInformers, httpRouteInformers []cache.SharedIndexInformer
+	if syncGatewayAPI {
+		gatewayFactories := []dynamicinformer.DynamicSharedInformerFactory{}
+		for _, namespace := range source.namespaces() {
+			gatewayFactories = append(gatewayFactories, newGatewayAPIInformerFactory(source.DynamicClient, namespace))
+		}
+		gatewayInformers, httpRouteInformers = getGatewayAPIInformers(gatewayFactories, source)
+		if gatewayInformers == nil {
+			logrus.Warnf("gateway API resources not found in cluster %s, not watching gateways and httproutes", source.Name)
+		}
+	}
 
-		ingressInformer := getIngressInformer(factory, c)
+	a.Lock()
+	defer a.Unlock()
+
+	informersSynced := []cache.InformerSynced{}
+	for idx, ingressInformer := range ingressInformers {
 		a.EventsIngresses(ctx, ingressInformer)
 		a.ingressStores = append(a.ingressStores, ingressInformer.GetStore())
-
-		a.factories = append(a.factories, &factory)
+		a.ingressSources = append(a.ingressSources, source)
+		a.factories = append(a.factories, &factories[idx])
 		informersSynced = append(informersSynced, ingressInformer.HasSynced)
+	}
 
-		if syncSecrets {
+	if syncSecrets {
+		for _, namespace := range source.namespaces() {
 			tlsFilter := informers.WithTweakListOptions(func(lo *metav1.ListOptions) {
 				lo.FieldSelector = "type=kubernetes.io/tls"
 			})
 			// using new factory here to apply filter to secrets lister only
 			// see https://github.com/kubernetes/kubernetes/issues/90262#issuecomment-671479190
-			secretsFactory := informers.NewSharedInformerFactoryWithOptions(c, time.Minute, tlsFilter)
+			secretsFactory := informers.NewSharedInformerFactoryWithOptions(c, time.Minute, tlsFilter, informers.WithNamespace(namespace))
 			secretsInformer := secretsFactory.Core().V1().Secrets().Informer()
 			a.EventsSecrets(ctx, secretsInformer)
 			a.secretsStore = append(a.secretsStore, secretsInformer.GetStore())
+			a.secretsSources = append(a.secretsSources, source)
 			informersSynced = append(informersSynced, secretsInformer.HasSynced)
 		}
 	}
 
-	if !cache.WaitForCacheSync(ctx.Done(), informersSynced...) {
-		logrus.Panicf("Unable to populate caches")
+	if gatewayInformers != nil {
+		stores := &gatewayAPIStores{source: source}
+		for idx := range gatewayInformers {
+			a.EventsGatewayAPI(ctx, gatewayInformers[idx])
+			a.EventsGatewayAPI(ctx, httpRouteInformers[idx])
+			stores.gateways = append(stores.gateways, gatewayInformers[idx].GetStore())
+			stores.httpRoutes = append(stores.httpRoutes, httpRouteInformers[idx].GetStore())
+			informersSynced = append(informersSynced, gatewayInformers[idx].HasSynced, httpRouteInformers[idx].HasSynced)
+		}
+		a.gatewayAPIStores = append(a.gatewayAPIStores, stores)
 	}
-	return &a
+
+	return informersSynced, nil
 }
 
-func getIngressInformer(factory informers.SharedInformerFactory, clientSet *kubernetes.Clientset) (ingressInformer cache.SharedIndexInformer) {
+func (a *Aggregator) setSynced(source *Source) {
+	a.Lock()
+	defer a.Unlock()
+
+	now := time.Now()
+	status := a.statuses[source]
+	status.Synced = true
+	status.Reachable = true
+	status.LastSynced = &now
+	status.UnreachableSince = nil
+	status.LastError = ""
+	sourceSynced.WithLabelValues(source.Name).Set(1)
+	sourceReachable.WithLabelValues(source.Name).Set(1)
+}
+
+// setReachable records whether the API of a source could be reached and tells whether the
+// source became stale or fresh again. The resources of a source are kept while it is unreachable,
+// until they become stale after the staleness limit
+func (a *Aggregator) setReachable(source *Source, err error) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	status := a.statuses[source]
+	wasStale := status.Stale
+	if err == nil {
+		if !status.Reachable {
+			logrus.Infof("cluster %s is reachable again", source.Name)
+		}
+		status.Reachable = true
+		status.UnreachableSince = nil
+		status.LastError = ""
+		status.Stale = false
+	} else {
+		if status.UnreachableSince == nil {
+			now := time.Now()
+			status.UnreachableSince = &now
+			logrus.Warnf("cluster %s is unreachable, keeping its last known resources: %s", source.Name, err)
+		}
+		status.Reachable = false
+		status.LastError = err.Error()
+		status.Stale = a.stalenessLimit > 0 && time.Since(*status.UnreachableSince) > a.stalenessLimit
+		if status.Stale && !wasStale {
+			logrus.Warnf("cluster %s unreachable for more than %s, dropping its resources", source.Name, a.stalenessLimit)
+		}
+	}
+
+	sourceReachable.WithLabelValues(source.Name).Set(boolToFloat(status.Reachable))
+	sourceStale.WithLabelValues(source.Name).Set(boolToFloat(status.Stale))
+	return status.Stale != wasStale
+}
+
+// stale tells whether the resources of a source are too old to be used, the caller must hold the lock
+func (a *Aggregator) stale(source *Source) bool {
+	status, ok := a.statuses[source]
+	return ok && status.Stale
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// getIngressInformers returns an ingress informer of each factory, for the most recent apiGroup served by the cluster
+func getIngressInformers(factories []informers.SharedInformerFactory, source *Source) ([]cache.SharedIndexInformer, error) {
+	var err error
 	for _, apiGroup := range []string{"networking.k8s.io/v1", "networking.k8s.io/v1beta1", "extensions/v1beta1"} {
-		resources, err := clientSet.ServerResourcesForGroupVersion(apiGroup)
-		if err != nil {
+		resources, lookupErr := source.Client.Discovery().ServerResourcesForGroupVersion(apiGroup)
+		if lookupErr != nil {
+			err = lookupErr
 			continue
 		}
 		for _, rs := range resources.APIResources {
-			if rs.Name == "ingresses" {
+			if rs.Name != "ingresses" {
+				continue
+			}
+			ingressInformers := []cache.SharedIndexInformer{}
+			for _, factory := range factories {
 				switch apiGroup {
 				case "networking.k8s.io/v1":
-					ingressInformer = factory.Networking().V1().Ingresses().Informer()
+					ingressInformers = append(ingressInformers, factory.Networking().V1().Ingresses().Informer())
 				case "networking.k8s.io/v1beta1":
-					ingressInformer = factory.Networking().V1beta1().Ingresses().Informer()
+					ingressInformers = append(ingressInformers, factory.Networking().V1beta1().Ingresses().Informer())
 				case "extensions/v1beta1":
-					ingressInformer = factory.Extensions().V1beta1().Ingresses().Informer()
+					ingressInformers = append(ingressInformers, factory.Extensions().V1beta1().Ingresses().Informer())
 				}
-				logrus.Infof("watching ingress resources of apiGroup %s", apiGroup)
 			}
-		}
-		if ingressInformer != nil {
-			break
+			logrus.Infof("watching ingress resources of apiGroup %s in cluster %s", apiGroup, source.Name)
+			return ingressInformers, nil
 		}
 	}
-	return ingressInformer
-}
-
-// Run is the synchronization loop
-func (a *Aggregator) Run() {
-	for {
-		a.events <- SyncDataEvent{SyncType: COMMAND}
-		time.Sleep(5 * time.Second)
+	if err == nil {
+		err = fmt.Errorf("no ingress resources found")
 	}
+	return nil, err
 }
@@ -0,0 +1,421 @@
+package k8s
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+const gatewayAPIGroup = "gateway.networking.k8s.io"
+
+// gateway holds the fields of a gateway.networking.k8s.io Gateway used by yggdrasil
+type gateway struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		GatewayClassName string `json:"gatewayClassName"`
+		Listeners        []struct {
+			Hostname *string `json:"hostname"`
+		} `json:"listeners"`
+	} `json:"spec"`
+	Status struct {
+		Addresses []struct {
+			Value string `json:"value"`
+		} `json:"addresses"`
+	} `json:"status"`
+}
+
+// httpRoute holds the fields of a gateway.networking.k8s.io HTTPRoute used by yggdrasil
+type httpRoute struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		ParentRefs []struct {
+			Group     *string `json:"group"`
+			Kind      *string `json:"kind"`
+			Namespace *string `json:"namespace"`
+			Name      string  `json:"name"`
+		} `json:"parentRefs"`
+		Hostnames []string        `json:"hostnames"`
+		Rules     []httpRouteRule `json:"rules"`
+	} `json:"spec"`
+}
+
+type httpRouteRule struct {
+	Matches []struct {
+		Path *struct {
+			Type  *string `json:"type"`
+			Value *string `json:"value"`
+		} `json:"path"`
+		Headers []struct {
+			Type  *string `json:"type"`
+			Name  string  `json:"name"`
+			Value string  `json:"value"`
+		} `json:"headers"`
+	} `json:"matches"`
+	Filters     []httpRouteFilter `json:"filters"`
+	BackendRefs []struct {
+		Namespace *string `json:"namespace"`
+		Name      string  `json:"name"`
+		Port      *int32  `json:"port"`
+		Weight    *int32  `json:"weight"`
+	} `json:"backendRefs"`
+}
+
+type httpHeaderModifier struct {
+	Set    []HTTPHeader `json:"set"`
+	Add    []HTTPHeader `json:"add"`
+	Remove []string     `json:"remove"`
+}
+
+type httpPathModifier struct {
+	Type               string  `json:"type"`
+	ReplaceFullPath    *string `json:"replaceFullPath"`
+	ReplacePrefixMatch *string `json:"replacePrefixMatch"`
+}
+
+type httpRouteFilter struct {
+	Type                   string              `json:"type"`
+	RequestHeaderModifier  *httpHeaderModifier `json:"requestHeaderModifier"`
+	ResponseHeaderModifier *httpHeaderModifier `json:"responseHeaderModifier"`
+	RequestRedirect        *struct {
+		Scheme     *string           `json:"scheme"`
+		Hostname   *string           `json:"hostname"`
+		Path       *httpPathModifier `json:"path"`
+		Port       *int32            `json:"port"`
+		StatusCode *int              `json:"statusCode"`
+	} `json:"requestRedirect"`
+	URLRewrite *struct {
+		Hostname *string           `json:"hostname"`
+		Path     *httpPathModifier `json:"path"`
+	} `json:"urlRewrite"`
+}
+
+// gatewayAPIStores holds the Gateway API objects of a single source cluster, a store per namespace of the source,
+// HTTPRoutes only being resolved against the Gateways of their own cluster
+type gatewayAPIStores struct {
+	source     *Source
+	gateways   []cache.Store
+	httpRoutes []cache.Store
+}
+
+// getGatewayAPIResources returns the Gateway and HTTPRoute resources served by the cluster, if any
+func getGatewayAPIResources(source *Source) (gateways schema.GroupVersionResource, httpRoutes schema.GroupVersionResource, found bool) {
+	for _, version := range []string{"v1", "v1beta1"} {
+		resources, err := source.Client.Discovery().ServerResourcesForGroupVersion(gatewayAPIGroup + "/" + version)
+		if err != nil {
+			continue
+		}
+		gateways = schema.GroupVersionResource{Group: gatewayAPIGroup, Version: version, Resource: "gateways"}
+		httpRoutes = schema.GroupVersionResource{Group: gatewayAPIGroup, Version: version, Resource: "httproutes"}
+		var hasGateways, hasHTTPRoutes bool
+		for _, rs := range resources.APIResources {
+			hasGateways = hasGateways || rs.Name == gateways.Resource
+			hasHTTPRoutes = hasHTTPRoutes || rs.Name == httpRoutes.Resource
+		}
+		if hasGateways && hasHTTPRoutes {
+			logrus.Infof("watching gateway resources of apiGroup %s/%s in cluster %s", gatewayAPIGroup, version, source.Name)
+			return gateways, httpRoutes, true
+		}
+	}
+	return gateways, httpRoutes, false
+}
+
+func getGatewayAPIInformers(factories []dynamicinformer.DynamicSharedInformerFactory, source *Source) (gatewayInformers []cache.SharedIndexInformer, httpRouteInformers []cache.SharedIndexInformer) {
+	gateways, httpRoutes, found := getGatewayAPIResources(source)
+	if !found {
+		return nil, nil
+	}
+	for _, factory := range factories {
+		gatewayInformers = append(gatewayInformers, factory.ForResource(gateways).Informer())
+		httpRouteInformers = append(httpRouteInformers, factory.ForResource(httpRoutes).Informer())
+	}
+	return gatewayInformers, httpRouteInformers
+}
+
+func newGatewayAPIInformerFactory(client dynamic.Interface, namespace string) dynamicinformer.DynamicSharedInformerFactory {
+	return dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, time.Minute, namespace, nil)
+}
+
+func fromUnstructured(obj interface{}, into interface{}) error {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return fmt.Errorf("unexpected object in store: %+v", obj)
+	}
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), into)
+}
+
+func listStores(stores []cache.Store) []interface{} {
+	objects := []interface{}{}
+	for _, store := range stores {
+		objects = append(objects, store.List()...)
+	}
+	return objects
+}
+
+// convertHTTPRoutes converts the HTTPRoutes of a store into apiGroup-agnostic ingresses,
+// one per parent Gateway, using the Gateway addresses as upstreams
+func convertHTTPRoutes(stores *gatewayAPIStores) ([]*Ingress, error) {
+	gateways := map[string]*gateway{}
+	for _, obj := range listStores(stores.gateways) {
+		gw := &gateway{}
+		if err := fromUnstructured(obj, gw); err != nil {
+			return nil, err
+		}
+		gateways[gw.Namespace+"/"+gw.Name] = gw
+	}
+
+	ingresses := []*Ingress{}
+	for _, obj := range listStores(stores.httpRoutes) {
+		route := &httpRoute{}
+		if err := fromUnstructured(obj, route); err != nil {
+			return nil, err
+		}
+
+		for _, parentRef := range route.Spec.ParentRefs {
+			if (parentRef.Group != nil && *parentRef.Group != gatewayAPIGroup) ||
+				(parentRef.Kind != nil && *parentRef.Kind != "Gateway") {
+				continue
+			}
+			namespace := route.Namespace
+			if parentRef.Namespace != nil {
+				namespace = *parentRef.Namespace
+			}
+			gw, ok := gateways[namespace+"/"+parentRef.Name]
+			if !ok {
+				logrus.Debugf("gateway %s/%s of httproute %s/%s not found", namespace, parentRef.Name, route.Namespace, route.Name)
+				continue
+			}
+			ingresses = append(ingresses, convertHTTPRoute(route, gw))
+		}
+	}
+	return ingresses, nil
+}
+
+func convertHTTPRoute(route *httpRoute, gw *gateway) *Ingress {
+	hosts := routeHostnames(route, gw)
+
+	paths := []*IngressPath{}
+	for _, rule := range route.Spec.Rules {
+		paths = append(paths, convertHTTPRouteRule(route.Namespace, rule)...)
+	}
+
+	ingress := &Ingress{
+		Namespace:    route.Namespace,
+		Name:         route.Name,
+		GatewayClass: gw.Spec.GatewayClassName,
+		Annotations:  route.Annotations,
+		RulesHosts:   hosts,
+		Deleting:     route.DeletionTimestamp != nil,
+		RulesPaths:   map[string][]*IngressPath{},
+		TLS:          map[string]*IngressTLS{},
+	}
+	for _, host := range hosts {
+		ingress.RulesPaths[host] = paths
+	}
+	for _, address := range gw.Status.Addresses {
+		ingress.Upstreams = append(ingress.Upstreams, address.Value)
+	}
+	return ingress
+}
+
+// routeHostnames returns the hostnames of a route attached to a gateway, the intersection of the hostnames of
+// the route and of the gateway listeners. A listener without hostname accepts every hostname of the route, and
+// a route without hostnames takes the ones of the listeners
+func routeHostnames(route *httpRoute, gw *gateway) []string {
+	listenerHosts := []string{}
+	anyHost := len(gw.Spec.Listeners) == 0
+	for _, listener := range gw.Spec.Listeners {
+		if listener.Hostname == nil || *listener.Hostname == "" {
+			anyHost = true
+			continue
+		}
+		listenerHosts = append(listenerHosts, *listener.Hostname)
+	}
+	if len(route.Spec.Hostnames) == 0 {
+		return listenerHosts
+	}
+	if anyHost {
+		return route.Spec.Hostnames
+	}
+
+	hosts := []string{}
+	added := map[string]bool{}
+	for _, routeHost := range route.Spec.Hostnames {
+		for _, listenerHost := range listenerHosts {
+			host := intersectHostnames(routeHost, listenerHost)
+			if host != "" && !added[host] {
+				added[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	return hosts
+}
+
+// intersectHostnames returns the most specific of two hostnames when one matches the other, a wildcard
+// matching one or more labels, or an empty string
+func intersectHostnames(a, b string) string {
+	if hostnameMatches(b, a) {
+		return a
+	}
+	if hostnameMatches(a, b) {
+		return b
+	}
+	return ""
+}
+
+func hostnameMatches(pattern, host string) bool {
+	if pattern == host {
+		return true
+	}
+	return strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1
+}
+
+func convertHTTPRouteRule(namespace string, rule httpRouteRule) []*IngressPath {
+	// the requests are split between the backends by weight, a single backend needs no split
+	backends := []IngressBackend{}
+	for _, backendRef := range rule.BackendRefs {
+		backend := IngressBackend{Name: backendName(namespace, backendRef.Namespace, backendRef.Name, backendRef.Port), Weight: 1}
+		if backendRef.Weight != nil {
+			backend.Weight = 0
+			if *backendRef.Weight > 0 {
+				backend.Weight = uint32(*backendRef.Weight)
+			}
+		}
+		backends = append(backends, backend)
+	}
+	weight := uint32(0)
+	for _, backend := range backends {
+		weight += backend.Weight
+	}
+	if len(backends) < 2 || weight == 0 {
+		backends = nil
+	}
+
+	filters := convertHTTPRouteFilters(rule.Filters)
+
+	paths := []*IngressPath{}
+	for _, match := range rule.Matches {
+		path := newHTTPRoutePath(weight, backends, filters)
+		if match.Path != nil {
+			if match.Path.Value != nil {
+				path.Path = *match.Path.Value
+			}
+			if match.Path.Type != nil {
+				switch *match.Path.Type {
+				case "Exact":
+					path.PathType = PathTypeExact
+				case "RegularExpression":
+					path.PathType = PathTypeRegularExpression
+				}
+			}
+		}
+		for _, header := range match.Headers {
+			path.Headers = append(path.Headers, HeaderMatch{
+				Name:  header.Name,
+				Value: header.Value,
+				Regex: header.Type != nil && *header.Type == "RegularExpression",
+			})
+		}
+		paths = append(paths, path)
+	}
+
+	// a rule without matches matches every request
+	if len(paths) == 0 {
+		paths = append(paths, newHTTPRoutePath(weight, backends, filters))
+	}
+	return paths
+}
+
+// newHTTPRoutePath returns a catch-all path weighted by its backends
+func newHTTPRoutePath(weight uint32, backends []IngressBackend, filters *IngressPathFilters) *IngressPath {
+	path := &IngressPath{Path: "/", PathType: PathTypePrefix, Backends: backends, Filters: filters}
+	if backends == nil {
+		path.Weight = &weight
+	}
+	return path
+}
+
+// backendName names a backendRef after its namespace, name and port
+func backendName(routeNamespace string, namespace *string, name string, port *int32) string {
+	if namespace != nil {
+		routeNamespace = *namespace
+	}
+	backend := routeNamespace + "/" + name
+	if port != nil {
+		backend = fmt.Sprintf("%s:%d", backend, *port)
+	}
+	return backend
+}
+
+func convertHTTPRouteFilters(routeFilters []httpRouteFilter) *IngressPathFilters {
+	if len(routeFilters) == 0 {
+		return nil
+	}
+
+	filters := &IngressPathFilters{}
+	for _, f := range routeFilters {
+		switch {
+		case f.Type == "RequestHeaderModifier" && f.RequestHeaderModifier != nil:
+			filters.RequestHeadersToSet = append(filters.RequestHeadersToSet, f.RequestHeaderModifier.Set...)
+			filters.RequestHeadersToAdd = append(filters.RequestHeadersToAdd, f.RequestHeaderModifier.Add...)
+			filters.RequestHeadersToRemove = append(filters.RequestHeadersToRemove, f.RequestHeaderModifier.Remove...)
+		case f.Type == "ResponseHeaderModifier" && f.ResponseHeaderModifier != nil:
+			filters.ResponseHeadersToSet = append(filters.ResponseHeadersToSet, f.ResponseHeaderModifier.Set...)
+			filters.ResponseHeadersToAdd = append(filters.ResponseHeadersToAdd, f.ResponseHeaderModifier.Add...)
+			filters.ResponseHeadersToRemove = append(filters.ResponseHeadersToRemove, f.ResponseHeaderModifier.Remove...)
+		case f.Type == "RequestRedirect" && f.RequestRedirect != nil:
+			redirect := &IngressRedirect{}
+			if f.RequestRedirect.Scheme != nil {
+				redirect.Scheme = *f.RequestRedirect.Scheme
+			}
+			if f.RequestRedirect.Hostname != nil {
+				redirect.Hostname = *f.RequestRedirect.Hostname
+			}
+			if f.RequestRedirect.Path != nil {
+				if f.RequestRedirect.Path.ReplaceFullPath != nil {
+					redirect.Path = *f.RequestRedirect.Path.ReplaceFullPath
+				}
+				if f.RequestRedirect.Path.ReplacePrefixMatch != nil {
+					redirect.PrefixReplace = *f.RequestRedirect.Path.ReplacePrefixMatch
+					// an empty prefix removes the matched one
+					if redirect.PrefixReplace == "" {
+						redirect.PrefixReplace = "/"
+					}
+				}
+			}
+			if f.RequestRedirect.Port != nil {
+				redirect.Port = uint32(*f.RequestRedirect.Port)
+			}
+			if f.RequestRedirect.StatusCode != nil {
+				redirect.StatusCode = *f.RequestRedirect.StatusCode
+			}
+			filters.Redirect = redirect
+		case f.Type == "URLRewrite" && f.URLRewrite != nil:
+			rewrite := &IngressRewrite{}
+			if f.URLRewrite.Hostname != nil {
+				rewrite.Hostname = *f.URLRewrite.Hostname
+			}
+			if f.URLRewrite.Path != nil {
+				if f.URLRewrite.Path.ReplaceFullPath != nil {
+					rewrite.FullPath = *f.URLRewrite.Path.ReplaceFullPath
+				}
+				if f.URLRewrite.Path.ReplacePrefixMatch != nil {
+					rewrite.PrefixReplace = *f.URLRewrite.Path.ReplacePrefixMatch
+				}
+			}
+			filters.Rewrite = rewrite
+		default:
+			logrus.Debugf("ignoring unsupported httproute filter %s", f.Type)
+		}
+	}
+	return filters
+}
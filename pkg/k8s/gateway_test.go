@@ -0,0 +1,197 @@
+package k8s
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newGatewayAPIStores(t *testing.T, objects ...map[string]interface{}) *gatewayAPIStores {
+	stores := &gatewayAPIStores{
+		gateways:   []cache.Store{cache.NewStore(cache.MetaNamespaceKeyFunc)},
+		httpRoutes: []cache.Store{cache.NewStore(cache.MetaNamespaceKeyFunc)},
+	}
+	for _, obj := range objects {
+		u := &unstructured.Unstructured{Object: obj}
+		store := stores.httpRoutes[0]
+		if u.GetKind() == "Gateway" {
+			store = stores.gateways[0]
+		}
+		if err := store.Add(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return stores
+}
+
+func newGatewayObject(namespace, name, class string, addresses ...string) map[string]interface{} {
+	statusAddresses := []interface{}{}
+	for _, address := range addresses {
+		statusAddresses = append(statusAddresses, map[string]interface{}{"type": "Hostname", "value": address})
+	}
+	return map[string]interface{}{
+		"apiVersion": "gateway.networking.k8s.io/v1",
+		"kind":       "Gateway",
+		"metadata":   map[string]interface{}{"namespace": namespace, "name": name},
+		"spec": map[string]interface{}{
+			"gatewayClassName": class,
+			"listeners":        []interface{}{map[string]interface{}{"name": "http", "hostname": "listener.io"}},
+		},
+		"status": map[string]interface{}{"addresses": statusAddresses},
+	}
+}
+
+func TestConvertHTTPRoutes(t *testing.T) {
+	route := map[string]interface{}{
+		"apiVersion": "gateway.networking.k8s.io/v1",
+		"kind":       "HTTPRoute",
+		"metadata": map[string]interface{}{
+			"namespace":   "apps",
+			"name":        "foo",
+			"annotations": map[string]interface{}{"yggdrasil.uswitch.com/timeout": "30s"},
+		},
+		"spec": map[string]interface{}{
+			"parentRefs": []interface{}{
+				map[string]interface{}{"name": "edge", "namespace": "gateways"},
+				map[string]interface{}{"name": "missing"},
+			},
+			"hostnames": []interface{}{"foobar.io"},
+			"rules": []interface{}{
+				map[string]interface{}{
+					"matches": []interface{}{
+						map[string]interface{}{
+							"path":    map[string]interface{}{"type": "PathPrefix", "value": "/api"},
+							"headers": []interface{}{map[string]interface{}{"name": "x-canary", "value": "true"}},
+						},
+					},
+					"filters": []interface{}{
+						map[string]interface{}{
+							"type": "RequestHeaderModifier",
+							"requestHeaderModifier": map[string]interface{}{
+								"set":    []interface{}{map[string]interface{}{"name": "x-team", "value": "api"}},
+								"remove": []interface{}{"x-debug"},
+							},
+						},
+					},
+					"backendRefs": []interface{}{
+						map[string]interface{}{"name": "api", "weight": int64(3)},
+						map[string]interface{}{"name": "api-next"},
+					},
+				},
+				map[string]interface{}{
+					"filters": []interface{}{
+						map[string]interface{}{
+							"type": "RequestRedirect",
+							"requestRedirect": map[string]interface{}{
+								"scheme":     "https",
+								"statusCode": int64(301),
+								"path":       map[string]interface{}{"type": "ReplacePrefixMatch", "replacePrefixMatch": "/v2"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	gw := newGatewayObject("gateways", "edge", "multi-cluster", "lb.foobar.io")
+	gw["spec"].(map[string]interface{})["listeners"] = []interface{}{map[string]interface{}{"name": "http", "hostname": "*.io"}}
+	stores := newGatewayAPIStores(t, gw, route)
+
+	ingresses, err := convertHTTPRoutes(stores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ingresses) != 1 {
+		t.Fatalf("expected one ingress for the found parent gateway, got %d", len(ingresses))
+	}
+
+	ing := ingresses[0]
+	if ing.Namespace != "apps" ||
+		ing.Name != "foo" ||
+		ing.GatewayClass != "multi-cluster" ||
+		ing.Annotations["yggdrasil.uswitch.com/timeout"] != "30s" ||
+		!testEq(ing.RulesHosts, []string{"foobar.io"}) ||
+		!testEq(ing.Upstreams, []string{"lb.foobar.io"}) {
+		t.Errorf("httproute conversion error: %+v", ing)
+	}
+
+	noWeight := uint32(0)
+	expected := []*IngressPath{
+		{
+			Path:     "/api",
+			PathType: PathTypePrefix,
+			Headers:  []HeaderMatch{{Name: "x-canary", Value: "true"}},
+			Backends: []IngressBackend{{Name: "apps/api", Weight: 3}, {Name: "apps/api-next", Weight: 1}},
+			Filters: &IngressPathFilters{
+				RequestHeadersToSet:    []HTTPHeader{{Name: "x-team", Value: "api"}},
+				RequestHeadersToRemove: []string{"x-debug"},
+			},
+		},
+		{
+			Path:     "/",
+			PathType: PathTypePrefix,
+			Weight:   &noWeight,
+			Filters: &IngressPathFilters{
+				Redirect: &IngressRedirect{Scheme: "https", PrefixReplace: "/v2", StatusCode: 301},
+			},
+		},
+	}
+	if !reflect.DeepEqual(ing.RulesPaths["foobar.io"], expected) {
+		t.Errorf("unexpected paths: %+v", ing.RulesPaths["foobar.io"])
+	}
+}
+
+func TestConvertHTTPRouteWithoutHostnames(t *testing.T) {
+	route := map[string]interface{}{
+		"apiVersion": "gateway.networking.k8s.io/v1",
+		"kind":       "HTTPRoute",
+		"metadata":   map[string]interface{}{"namespace": "apps", "name": "foo"},
+		"spec": map[string]interface{}{
+			"parentRefs": []interface{}{map[string]interface{}{"name": "edge"}},
+		},
+	}
+	stores := newGatewayAPIStores(t, newGatewayObject("apps", "edge", "multi-cluster", "1.2.3.4"), route)
+
+	ingresses, err := convertHTTPRoutes(stores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ingresses) != 1 || !testEq(ingresses[0].RulesHosts, []string{"listener.io"}) {
+		t.Errorf("expected the gateway listener hostname to be used, got %+v", ingresses)
+	}
+}
+
+func TestRouteHostnames(t *testing.T) {
+	testCases := []struct {
+		name      string
+		listeners []*string
+		hostnames []string
+		expected  []string
+	}{
+		{name: "route hostnames without listener hostname", listeners: []*string{nil}, hostnames: []string{"foo.io"}, expected: []string{"foo.io"}},
+		{name: "listener hostnames without route hostnames", listeners: []*string{strPtr("foo.io"), nil}, expected: []string{"foo.io"}},
+		{name: "route hostname matching a listener wildcard", listeners: []*string{strPtr("*.foo.io")}, hostnames: []string{"api.foo.io", "foo.io", "bar.io"}, expected: []string{"api.foo.io"}},
+		{name: "route wildcard matching a listener hostname", listeners: []*string{strPtr("api.foo.io")}, hostnames: []string{"*.foo.io"}, expected: []string{"api.foo.io"}},
+		{name: "no intersection", listeners: []*string{strPtr("foo.io")}, hostnames: []string{"bar.io"}, expected: []string{}},
+	}
+
+	for _, tc := range testCases {
+		gw := &gateway{}
+		for _, hostname := range tc.listeners {
+			gw.Spec.Listeners = append(gw.Spec.Listeners, struct {
+				Hostname *string `json:"hostname"`
+			}{Hostname: hostname})
+		}
+		route := &httpRoute{}
+		route.Spec.Hostnames = tc.hostnames
+		if hosts := routeHostnames(route, gw); !testEq(hosts, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, hosts)
+		}
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
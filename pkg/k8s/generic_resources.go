@@ -14,13 +14,93 @@ import (
 
 // Ingress is the version-agnostic description of an ingress
 type Ingress struct {
-	Namespace   string
-	Name        string
-	Class       *string
-	Annotations map[string]string
-	RulesHosts  []string
-	Upstreams   []string
-	TLS         map[string]*IngressTLS
+	Namespace string
+	Name      string
+	Class     *string
+	// GatewayClass is set on ingresses derived from Gateway API HTTPRoutes
+	GatewayClass string
+	Annotations  map[string]string
+	RulesHosts   []string
+	RulesPaths   map[string][]*IngressPath
+	Upstreams    []string
+	TLS          map[string]*IngressTLS
+	// Source is the name of the cluster the ingress was read from
+	Source   string
+	Locality Locality
+	// Deleting is whether the ingress has a deletionTimestamp and waits for its finalizers
+	Deleting bool
+	// Draining is set on the copies of the ingresses kept by the configurator for their removed upstreams
+	Draining bool
+}
+
+// Path types supported by IngressPath, mirroring the networking.k8s.io ones
+const (
+	PathTypeExact                  = "Exact"
+	PathTypePrefix                 = "Prefix"
+	PathTypeImplementationSpecific = "ImplementationSpecific"
+	PathTypeRegularExpression      = "RegularExpression"
+)
+
+// IngressPath describes a single HTTP path of an ingress rule.
+type IngressPath struct {
+	Path     string
+	PathType string
+	// Headers restricts the path to requests carrying all of these headers
+	Headers []HeaderMatch
+	// Weight overrides the weight of the ingress upstreams for this path when set
+	Weight *uint32
+	// Backends split the requests of the path between them in proportion to their weights when set
+	Backends []IngressBackend
+	Filters  *IngressPathFilters
+}
+
+// IngressBackend is a backend of a path, receiving a share of its requests proportional to its weight
+type IngressBackend struct {
+	Name   string
+	Weight uint32
+}
+
+// HeaderMatch matches a request header against a value or a regular expression
+type HeaderMatch struct {
+	Name  string
+	Value string
+	Regex bool
+}
+
+// HTTPHeader is a header name and value
+type HTTPHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// IngressPathFilters describes the request and response modifications applied on a path
+type IngressPathFilters struct {
+	RequestHeadersToSet     []HTTPHeader
+	RequestHeadersToAdd     []HTTPHeader
+	RequestHeadersToRemove  []string
+	ResponseHeadersToSet    []HTTPHeader
+	ResponseHeadersToAdd    []HTTPHeader
+	ResponseHeadersToRemove []string
+	Redirect                *IngressRedirect
+	Rewrite                 *IngressRewrite
+}
+
+// IngressRedirect answers the requests with a redirection instead of proxying them
+type IngressRedirect struct {
+	Scheme   string
+	Hostname string
+	Path     string
+	// PrefixReplace replaces the matched prefix of the path in the redirection
+	PrefixReplace string
+	Port          uint32
+	StatusCode    int
+}
+
+// IngressRewrite rewrites the host and path of proxied requests
+type IngressRewrite struct {
+	Hostname      string
+	FullPath      string
+	PrefixReplace string
 }
 
 // IngressTLS describes the transport layer security associated with an Ingress.
@@ -31,17 +111,37 @@ type IngressTLS struct {
 
 // Get ingresses from stores and convert them to apiGroup-agnostic ingresses
 func (a *Aggregator) GetGenericIngresses() ([]*Ingress, error) {
+	a.RLock()
+	defer a.RUnlock()
+
 	ing := make([]*Ingress, 0)
-	for _, store := range a.ingressStores {
+	for idx, store := range a.ingressStores {
+		if a.stale(a.ingressSources[idx]) {
+			continue
+		}
 		ingresses := store.List()
 		for _, obj := range ingresses {
 			genericIng, err := convertToGenericIngress(obj)
 			if err != nil {
 				return nil, err
 			}
+			genericIng.setSource(a.ingressSources[idx])
 			ing = append(ing, genericIng)
 		}
 	}
+	for _, stores := range a.gatewayAPIStores {
+		if a.stale(stores.source) {
+			continue
+		}
+		routes, err := convertHTTPRoutes(stores)
+		if err != nil {
+			return nil, err
+		}
+		for _, route := range routes {
+			route.setSource(stores.source)
+		}
+		ing = append(ing, routes...)
+	}
 	return ing, nil
 }
 
@@ -78,12 +178,25 @@ func convertExtensionsv1beta1Ingress(i *extensionsv1beta1.Ingress) *Ingress {
 		Name:        i.Name,
 		Class:       i.Spec.IngressClassName,
 		Annotations: i.Annotations,
+		Deleting:    i.DeletionTimestamp != nil,
 		RulesHosts: func(rules *[]extensionsv1beta1.IngressRule) (hosts []string) {
 			for _, rule := range *rules {
 				hosts = append(hosts, rule.Host)
 			}
 			return
 		}(&i.Spec.Rules),
+		RulesPaths: func(rules []extensionsv1beta1.IngressRule) (paths map[string][]*IngressPath) {
+			paths = make(map[string][]*IngressPath)
+			for _, rule := range rules {
+				if rule.HTTP == nil {
+					continue
+				}
+				for _, p := range rule.HTTP.Paths {
+					paths[rule.Host] = append(paths[rule.Host], newIngressPath(p.Path, (*string)(p.PathType)))
+				}
+			}
+			return
+		}(i.Spec.Rules),
 		Upstreams: func(i *[]v1.LoadBalancerIngress) (upstreams []string) {
 			for _, j := range *i {
 				if j.Hostname != "" {
@@ -115,12 +228,25 @@ func convertNetworkingv1beta1Ingress(i *networkingv1beta1.Ingress) *Ingress {
 		Name:        i.Name,
 		Class:       i.Spec.IngressClassName,
 		Annotations: i.Annotations,
+		Deleting:    i.DeletionTimestamp != nil,
 		RulesHosts: func(rules *[]networkingv1beta1.IngressRule) (hosts []string) {
 			for _, rule := range *rules {
 				hosts = append(hosts, rule.Host)
 			}
 			return
 		}(&i.Spec.Rules),
+		RulesPaths: func(rules []networkingv1beta1.IngressRule) (paths map[string][]*IngressPath) {
+			paths = make(map[string][]*IngressPath)
+			for _, rule := range rules {
+				if rule.HTTP == nil {
+					continue
+				}
+				for _, p := range rule.HTTP.Paths {
+					paths[rule.Host] = append(paths[rule.Host], newIngressPath(p.Path, (*string)(p.PathType)))
+				}
+			}
+			return
+		}(i.Spec.Rules),
 		Upstreams: func(i *[]v1.LoadBalancerIngress) (upstreams []string) {
 			for _, j := range *i {
 				if j.Hostname != "" {
@@ -152,12 +278,25 @@ func convertNetworkingv1Ingress(i *networkingv1.Ingress) *Ingress {
 		Name:        i.Name,
 		Class:       i.Spec.IngressClassName,
 		Annotations: i.Annotations,
+		Deleting:    i.DeletionTimestamp != nil,
 		RulesHosts: func(rules *[]networkingv1.IngressRule) (hosts []string) {
 			for _, rule := range *rules {
 				hosts = append(hosts, rule.Host)
 			}
 			return
 		}(&i.Spec.Rules),
+		RulesPaths: func(rules []networkingv1.IngressRule) (paths map[string][]*IngressPath) {
+			paths = make(map[string][]*IngressPath)
+			for _, rule := range rules {
+				if rule.HTTP == nil {
+					continue
+				}
+				for _, p := range rule.HTTP.Paths {
+					paths[rule.Host] = append(paths[rule.Host], newIngressPath(p.Path, (*string)(p.PathType)))
+				}
+			}
+			return
+		}(i.Spec.Rules),
 		Upstreams: func(i *[]v1.LoadBalancerIngress) (upstreams []string) {
 			for _, j := range *i {
 				if j.Hostname != "" {
@@ -183,16 +322,45 @@ func convertNetworkingv1Ingress(i *networkingv1.Ingress) *Ingress {
 	}
 }
 
+// newIngressPath defaults an empty path to "/" and a missing path type to ImplementationSpecific
+func newIngressPath(path string, pathType *string) *IngressPath {
+	p := &IngressPath{Path: path, PathType: PathTypeImplementationSpecific}
+	if p.Path == "" {
+		p.Path = "/"
+	}
+	if pathType != nil && *pathType != "" {
+		p.PathType = *pathType
+	}
+	return p
+}
+
+func (i *Ingress) setSource(source *Source) {
+	if source == nil {
+		return
+	}
+	i.Source = source.Name
+	i.Locality = source.Locality
+}
+
 func GenericIngressEqual(a, b *Ingress) bool {
 	if a.Name != b.Name ||
 		a.Namespace != b.Namespace ||
 		!deepStringEqualIgnoreOrder(a.RulesHosts, b.RulesHosts) ||
 		!deepStringEqualIgnoreOrder(a.Upstreams, b.Upstreams) ||
+		!reflect.DeepEqual(a.RulesPaths, b.RulesPaths) ||
 		!reflect.DeepEqual(a.Annotations, b.Annotations) ||
 		!reflect.DeepEqual(a.TLS, b.TLS) {
 		return false
 	}
 
+	if a.GatewayClass != b.GatewayClass {
+		return false
+	}
+
+	if a.Source != b.Source || a.Locality != b.Locality {
+		return false
+	}
+
 	if a.getUsableIngressClass() != b.getUsableIngressClass() {
 		return false
 	}
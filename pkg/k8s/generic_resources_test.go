@@ -1,7 +1,12 @@
 package k8s
 
 import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
 	networkingv1 "k8s.io/api/networking/v1"
@@ -9,6 +14,11 @@ import (
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
 )
 
 func TestConvertExtensionsV1beta1Ingress(t *testing.T) {
@@ -164,6 +174,20 @@ func TestConvertNetworkingV1Ingress(t *testing.T) {
 	}
 }
 
+func TestConvertDeletingIngress(t *testing.T) {
+	deleted := v1.Now()
+	nv1 := &networkingv1.Ingress{
+		ObjectMeta: v1.ObjectMeta{Name: "foo", Namespace: "bar", DeletionTimestamp: &deleted},
+	}
+	gen, err := convertToGenericIngress(nv1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gen.Deleting {
+		t.Error("expected the ingress with a deletionTimestamp to be deleting")
+	}
+}
+
 func TestCompareConvertedV1V1beta1Ingresses(t *testing.T) {
 	ev1b1 := &extensionsv1beta1.Ingress{
 		ObjectMeta: v1.ObjectMeta{
@@ -236,6 +260,78 @@ func TestCompareConvertedV1V1beta1Ingresses(t *testing.T) {
 	}
 }
 
+func TestConvertNetworkingV1IngressPaths(t *testing.T) {
+	prefix := networkingv1.PathTypePrefix
+	exact := networkingv1.PathTypeExact
+	nv1 := &networkingv1.Ingress{
+		ObjectMeta: v1.ObjectMeta{Name: "foo", Namespace: "bar"},
+		Spec: networkingv1.IngressSpec{
+			Rules: []networkingv1.IngressRule{
+				{
+					Host: "foobar.io",
+					IngressRuleValue: networkingv1.IngressRuleValue{
+						HTTP: &networkingv1.HTTPIngressRuleValue{
+							Paths: []networkingv1.HTTPIngressPath{
+								{Path: "/api", PathType: &prefix},
+								{Path: "/healthz", PathType: &exact},
+								{Path: "", PathType: nil},
+							},
+						},
+					},
+				},
+				{Host: "barfoo.io"},
+			},
+		},
+	}
+	gen, err := convertToGenericIngress(nv1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := gen.RulesPaths["foobar.io"]
+	expected := []*IngressPath{
+		{Path: "/api", PathType: PathTypePrefix},
+		{Path: "/healthz", PathType: PathTypeExact},
+		{Path: "/", PathType: PathTypeImplementationSpecific},
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("unexpected paths for foobar.io: %+v", paths)
+	}
+
+	if len(gen.RulesPaths["barfoo.io"]) != 0 {
+		t.Errorf("expected no paths for a rule without http, got %+v", gen.RulesPaths["barfoo.io"])
+	}
+}
+
+func TestConvertExtensionsV1beta1IngressPaths(t *testing.T) {
+	ev1b1 := &extensionsv1beta1.Ingress{
+		ObjectMeta: v1.ObjectMeta{Name: "foo", Namespace: "bar"},
+		Spec: extensionsv1beta1.IngressSpec{
+			Rules: []extensionsv1beta1.IngressRule{
+				{
+					Host: "foobar.io",
+					IngressRuleValue: extensionsv1beta1.IngressRuleValue{
+						HTTP: &extensionsv1beta1.HTTPIngressRuleValue{
+							Paths: []extensionsv1beta1.HTTPIngressPath{
+								{Path: "/web"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	gen, err := convertToGenericIngress(ev1b1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := gen.RulesPaths["foobar.io"]
+	if !reflect.DeepEqual(paths, []*IngressPath{{Path: "/web", PathType: PathTypeImplementationSpecific}}) {
+		t.Errorf("unexpected paths for foobar.io: %+v", paths)
+	}
+}
+
 func testEq(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
@@ -247,3 +343,131 @@ func testEq(a, b []string) bool {
 	}
 	return true
 }
+
+func TestGetGenericIngressesSources(t *testing.T) {
+	primary := &Source{Name: "primary", Locality: Locality{Region: "eu-west-1", Priority: 0}}
+	secondary := &Source{Name: "secondary", Locality: Locality{Region: "eu-central-1", Priority: 1}}
+
+	a := &Aggregator{ingressSources: []*Source{primary, secondary}}
+	for _, source := range a.ingressSources {
+		store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+		store.Add(&networkingv1.Ingress{ObjectMeta: v1.ObjectMeta{Name: "foo", Namespace: source.Name}})
+		a.ingressStores = append(a.ingressStores, store)
+	}
+
+	ingresses, err := a.GetGenericIngresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ingresses) != 2 {
+		t.Fatalf("expected 2 ingresses, got %d", len(ingresses))
+	}
+	for idx, source := range []*Source{primary, secondary} {
+		if ingresses[idx].Source != source.Name || ingresses[idx].Locality != source.Locality {
+			t.Errorf("expected ingress of %s to carry its source, got %s %+v", source.Name, ingresses[idx].Source, ingresses[idx].Locality)
+		}
+	}
+}
+
+func TestAddSourceNamespaces(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&networkingv1.Ingress{ObjectMeta: v1.ObjectMeta{Name: "foo", Namespace: "watched"}},
+		&networkingv1.Ingress{ObjectMeta: v1.ObjectMeta{Name: "foo", Namespace: "ignored"}},
+	)
+	client.Resources = []*v1.APIResourceList{{GroupVersion: "networking.k8s.io/v1", APIResources: []v1.APIResource{{Name: "ingresses"}}}}
+
+	var lock sync.Mutex
+	requested := map[string]map[string]bool{}
+	record := func(action k8stesting.Action) {
+		lock.Lock()
+		defer lock.Unlock()
+		key := action.GetVerb() + " " + action.GetResource().Resource
+		if requested[key] == nil {
+			requested[key] = map[string]bool{}
+		}
+		requested[key][action.GetNamespace()] = true
+	}
+	client.PrependReactor("list", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		record(action)
+		return false, nil, nil
+	})
+	client.PrependWatchReactor("*", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		record(action)
+		return false, nil, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := &Source{Name: "primary", Namespaces: []string{"watched", "other"}, Client: client}
+	a := &Aggregator{events: make(chan SyncDataEvent, 100), statuses: map[*Source]*SourceStatus{}}
+	informersSynced, err := a.addSource(ctx, source, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cache.WaitForCacheSync(ctx.Done(), informersSynced...) {
+		t.Fatal("informers not synced")
+	}
+
+	expected := map[string]bool{"watched": true, "other": true}
+	for _, key := range []string{"list ingresses", "watch ingresses", "list secrets", "watch secrets"} {
+		// the watches start asynchronously after the lists
+		for i := 0; i < 100 && !hasRequested(&lock, requested, key); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		lock.Lock()
+		if !reflect.DeepEqual(requested[key], expected) {
+			t.Errorf("expected %s of the listed namespaces only, got %v", key, requested[key])
+		}
+		lock.Unlock()
+	}
+
+	ingresses, err := a.GetGenericIngresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ingresses) != 1 || ingresses[0].Namespace != "watched" {
+		t.Errorf("expected only the ingress of the watched namespace, got %+v", ingresses)
+	}
+}
+
+func hasRequested(lock *sync.Mutex, requested map[string]map[string]bool, key string) bool {
+	lock.Lock()
+	defer lock.Unlock()
+	return len(requested[key]) == 2
+}
+
+func TestGetGenericIngressesStaleSource(t *testing.T) {
+	source := &Source{Name: "primary"}
+
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	store.Add(&networkingv1.Ingress{ObjectMeta: v1.ObjectMeta{Name: "foo", Namespace: "default"}})
+	a := &Aggregator{
+		ingressStores:  []cache.Store{store},
+		ingressSources: []*Source{source},
+		stalenessLimit: time.Minute,
+		statuses:       map[*Source]*SourceStatus{source: {Name: source.Name, Synced: true, Reachable: true}},
+	}
+
+	if a.setReachable(source, errors.New("connection refused")) {
+		t.Errorf("expected an unreachable source to be kept until the staleness limit")
+	}
+	if ingresses, _ := a.GetGenericIngresses(); len(ingresses) != 1 {
+		t.Errorf("expected the last known ingresses of an unreachable source, got %d", len(ingresses))
+	}
+
+	since := time.Now().Add(-2 * time.Minute)
+	a.statuses[source].UnreachableSince = &since
+	if !a.setReachable(source, errors.New("connection refused")) {
+		t.Errorf("expected the source to become stale after the staleness limit")
+	}
+	if ingresses, _ := a.GetGenericIngresses(); len(ingresses) != 0 {
+		t.Errorf("expected the ingresses of a stale source to be dropped, got %d", len(ingresses))
+	}
+
+	if !a.setReachable(source, nil) {
+		t.Errorf("expected the source to be fresh once reachable again")
+	}
+	if statuses := a.SourceStatuses(); len(statuses) != 1 || !statuses[0].Reachable || statuses[0].Stale || statuses[0].LastError != "" {
+		t.Errorf("expected a reachable source status, got %+v", statuses)
+	}
+}
@@ -2,6 +2,7 @@ package k8s
 
 import (
 	"context"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"k8s.io/client-go/tools/cache"
@@ -11,15 +12,15 @@ func (a *Aggregator) EventsIngresses(ctx context.Context, informer cache.SharedI
 	informer.AddEventHandler(
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
-				a.events <- SyncDataEvent{SyncType: INGRESS}
+				a.notify(INGRESS, obj)
 				logrus.Debugf("adding %+v", obj)
 			},
 			DeleteFunc: func(obj interface{}) {
-				a.events <- SyncDataEvent{SyncType: INGRESS}
+				a.notify(INGRESS, obj)
 				logrus.Debugf("deleting %+v", obj)
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
-				a.events <- SyncDataEvent{SyncType: INGRESS}
+				a.notify(INGRESS, newObj)
 				logrus.Debugf("updating %+v", newObj)
 			},
 		},
@@ -31,18 +32,49 @@ func (a *Aggregator) EventsSecrets(ctx context.Context, informer cache.SharedInd
 	informer.AddEventHandler(
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
-				a.events <- SyncDataEvent{SyncType: SECRET}
+				a.notify(SECRET, obj)
 				logrus.Debugf("adding %+v", obj)
 			},
 			DeleteFunc: func(obj interface{}) {
-				a.events <- SyncDataEvent{SyncType: SECRET}
+				a.notify(SECRET, obj)
 				logrus.Debugf("deleting %+v", obj)
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
-				a.events <- SyncDataEvent{SyncType: SECRET}
+				a.notify(SECRET, newObj)
 				logrus.Debugf("updating %+v", newObj)
 			},
 		},
 	)
 	go informer.Run(ctx.Done())
 }
+
+func (a *Aggregator) EventsGatewayAPI(ctx context.Context, informer cache.SharedIndexInformer) {
+	informer.AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				a.notify(GATEWAY, obj)
+				logrus.Debugf("adding %+v", obj)
+			},
+			DeleteFunc: func(obj interface{}) {
+				a.notify(GATEWAY, obj)
+				logrus.Debugf("deleting %+v", obj)
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				a.notify(GATEWAY, newObj)
+				logrus.Debugf("updating %+v", newObj)
+			},
+		},
+	)
+	go informer.Run(ctx.Done())
+}
+
+// notify tells the snapshotter the resources of the given type changed, with the key of the changed object as data
+func (a *Aggregator) notify(syncType SyncType, obj interface{}) {
+	event := SyncDataEvent{SyncType: syncType, Time: time.Now()}
+	if obj != nil {
+		if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+			event.Data = key
+		}
+	}
+	a.events <- event
+}
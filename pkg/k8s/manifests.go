@@ -0,0 +1,122 @@
+package k8s
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// ReadManifests reads the ingresses and secrets of YAML or JSON manifests, such as the output of
+// kubectl get -o yaml. Directories are read recursively and the objects of any other kind are ignored
+func ReadManifests(paths []string, source *Source) ([]*Ingress, []*v1.Secret, error) {
+	ingresses := []*Ingress{}
+	secrets := []*v1.Secret{}
+
+	for _, path := range paths {
+		err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || (file != path && !isManifest(file)) {
+				return nil
+			}
+
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			objects, err := decodeManifests(f)
+			if err != nil {
+				return fmt.Errorf("error reading %s: %s", file, err)
+			}
+			for _, obj := range objects {
+				switch o := obj.(type) {
+				case *v1.Secret:
+					secrets = append(secrets, withSource(o, source))
+				default:
+					ingress, err := convertToGenericIngress(obj)
+					if err != nil {
+						log.Debugf("ignoring %T in %s", obj, file)
+						continue
+					}
+					ingress.setSource(source)
+					ingresses = append(ingresses, ingress)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return ingresses, secrets, nil
+}
+
+func isManifest(file string) bool {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// decodeManifests decodes the objects of every document of a manifest, flattening lists
+func decodeManifests(r io.Reader) ([]runtime.Object, error) {
+	objects := []runtime.Object{}
+	reader := yaml.NewYAMLReader(bufio.NewReader(r))
+	for {
+		document, err := reader.Read()
+		if err == io.EOF {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(document)) == 0 {
+			continue
+		}
+
+		decoded, err := decodeManifest(document)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, decoded...)
+	}
+}
+
+func decodeManifest(document []byte) ([]runtime.Object, error) {
+	obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(document, nil, nil)
+	if runtime.IsNotRegisteredError(err) || runtime.IsMissingKind(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	list, ok := obj.(*v1.List)
+	if !ok {
+		return []runtime.Object{obj}, nil
+	}
+	objects := []runtime.Object{}
+	for _, item := range list.Items {
+		decoded, err := decodeManifest(item.Raw)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, decoded...)
+	}
+	return objects, nil
+}
@@ -0,0 +1,68 @@
+package k8s
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const ingressManifest = `apiVersion: networking.k8s.io/v1
+kind: Ingress
+metadata:
+  name: foo
+  namespace: default
+  annotations:
+    kubernetes.io/ingress.class: multi-cluster
+spec:
+  tls:
+  - hosts: [foo.app.com]
+    secretName: foo-tls
+  rules:
+  - host: foo.app.com
+status:
+  loadBalancer:
+    ingress:
+    - hostname: foo.cluster.com
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: foo
+`
+
+const listManifest = `{
+  "apiVersion": "v1",
+  "kind": "List",
+  "items": [
+    {"apiVersion": "v1", "kind": "Secret", "metadata": {"name": "foo-tls", "namespace": "default"}},
+    {"apiVersion": "example.com/v1", "kind": "Unknown", "metadata": {"name": "bar"}}
+  ]
+}`
+
+func TestReadManifests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "ingress.yaml"), []byte(ingressManifest), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "list.json"), []byte(listManifest), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("# not a manifest"), 0600)
+
+	ingresses, secrets, err := ReadManifests([]string{dir}, &Source{Name: "cluster1"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if len(ingresses) != 1 {
+		t.Fatalf("expected 1 ingress, got %d", len(ingresses))
+	}
+	ingress := ingresses[0]
+	if ingress.Name != "foo" || ingress.Source != "cluster1" || len(ingress.Upstreams) != 1 || ingress.Upstreams[0] != "foo.cluster.com" {
+		t.Errorf("unexpected ingress %+v", ingress)
+	}
+	if len(secrets) != 1 || secrets[0].Name != "foo-tls" {
+		t.Errorf("expected the secret of the list, got %+v", secrets)
+	}
+}
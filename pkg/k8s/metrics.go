@@ -0,0 +1,36 @@
+package k8s
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	sourceSynced = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "yggdrasil",
+			Name:      "source_synced",
+			Help:      "Whether the resources of the source cluster have been synced",
+		},
+		[]string{"source"},
+	)
+
+	sourceReachable = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "yggdrasil",
+			Name:      "source_reachable",
+			Help:      "Whether the API of the source cluster can be reached",
+		},
+		[]string{"source"},
+	)
+
+	sourceStale = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "yggdrasil",
+			Name:      "source_stale",
+			Help:      "Whether the resources of the source cluster are dropped for being unreachable past the staleness limit",
+		},
+		[]string{"source"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sourceSynced, sourceReachable, sourceStale)
+}
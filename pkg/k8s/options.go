@@ -0,0 +1,26 @@
+package k8s
+
+import "time"
+
+type aggregatorOption func(a *Aggregator)
+
+// WithSyncTimeout configures how long NewAggregator waits for the sources to sync, 0 waits until they are all synced
+func WithSyncTimeout(timeout time.Duration) aggregatorOption {
+	return func(a *Aggregator) {
+		a.syncTimeout = timeout
+	}
+}
+
+// WithRetryInterval configures how often unreachable sources are retried and reachable ones probed
+func WithRetryInterval(interval time.Duration) aggregatorOption {
+	return func(a *Aggregator) {
+		a.retryInterval = interval
+	}
+}
+
+// WithStalenessLimit configures how long the resources of an unreachable source are kept, 0 keeps them forever
+func WithStalenessLimit(limit time.Duration) aggregatorOption {
+	return func(a *Aggregator) {
+		a.stalenessLimit = limit
+	}
+}
@@ -1,17 +1,21 @@
 package k8s
 
+import "time"
+
 // SyncType represents the type of k8s received message
 type SyncType string
 
-// SyncDataEvent represents converted k8s received message
+// SyncDataEvent represents converted k8s received message, Data being the namespace/name key of the changed object when known
 type SyncDataEvent struct {
 	_ [0]int
 	SyncType
 	Data interface{}
+	// Time is when the change was received
+	Time time.Time
 }
 
 const (
-	COMMAND SyncType = "COMMAND"
 	INGRESS SyncType = "INGRESS"
 	SECRET  SyncType = "SECRET"
+	GATEWAY SyncType = "GATEWAY"
 )